@@ -2,6 +2,7 @@
 
 TF_TAG="tinyFaaS"
 TMP_DIR="tmp"
+DATA_DIR="data"
 
 # remove old containers, networks and images
 containers=$(docker ps -a -q --filter label=$TF_TAG)
@@ -41,3 +42,10 @@ if [ -d "$TMP_DIR" ]; then
 else
     echo "No tmp directory to remove. Skipping..."
 fi
+
+# remove data directory
+if [ -d "$DATA_DIR" ]; then
+    rm -rf "$DATA_DIR" > /dev/null || echo "Failed to remove directory $DATA_DIR ! Please remove it manually..."
+else
+    echo "No data directory to remove. Skipping..."
+fi
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
+)
+
+// The /v1 API manages functions as JSON resources. Every response has a JSON
+// body, errors are reported as an apiError with a matching status code.
+
+// apiError is the body of an error response.
+type apiError struct {
+	Error struct {
+		// Code is the status text in snake case, e.g., not_found
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// functionSpec describes a function to deploy in the body of a JSON upload,
+// or in the parameters of a streamed upload. The function is deployed from
+// the base64 encoded Zip, from an archive that is downloaded from URL, from
+// the streamed archive, or from Image. Name is taken from the path in the /v1
+// API.
+type functionSpec struct {
+	Name           string                 `json:"name"`
+	Env            string                 `json:"env"`
+	Threads        int                    `json:"threads"`
+	MinReplicas    int                    `json:"min_replicas"`
+	MaxReplicas    int                    `json:"max_replicas"`
+	IdleTimeout    int                    `json:"idle_timeout"`
+	Envs           envs                   `json:"envs"`
+	Zip            string                 `json:"zip"`
+	URL            string                 `json:"url"`
+	Image          string                 `json:"image"`
+	SubfolderPath  string                 `json:"subfolder_path"`
+	Balancer       string                 `json:"balancer"`
+	BalancerHeader string                 `json:"balancer_header"`
+	Canary         *manager.Canary        `json:"canary"`
+	Auth           *rproxy.AuthPolicy     `json:"auth"`
+	RateLimit      *rproxy.RateLimit      `json:"rate_limit"`
+	MaxConcurrency int                    `json:"max_concurrency"`
+	QueueSize      int                    `json:"queue_size"`
+	QueueTimeout   int                    `json:"queue_timeout"`
+	Timeout        int                    `json:"timeout"`
+	Retry          *rproxy.RetryPolicy    `json:"retry"`
+	CircuitBreaker *rproxy.CircuitBreaker `json:"circuit_breaker"`
+	Async          bool                   `json:"async"`
+}
+
+// function returns the function described by spec.
+func (spec functionSpec) function() manager.Function {
+	f := manager.Function{
+		Name:          spec.Name,
+		Env:           spec.Env,
+		Threads:       spec.Threads,
+		MinReplicas:   spec.MinReplicas,
+		MaxReplicas:   spec.MaxReplicas,
+		IdleTimeout:   spec.IdleTimeout,
+		Envs:          spec.Envs,
+		Image:         spec.Image,
+		SubfolderPath: spec.SubfolderPath,
+		Canary:        spec.Canary,
+		Config: rproxy.Config{
+			Balancer:       spec.Balancer,
+			BalancerHeader: spec.BalancerHeader,
+			Auth:           spec.Auth,
+			RateLimit:      spec.RateLimit,
+			MaxConcurrency: spec.MaxConcurrency,
+			QueueSize:      spec.QueueSize,
+			QueueTimeout:   spec.QueueTimeout,
+			Timeout:        spec.Timeout,
+			Retry:          spec.Retry,
+			CircuitBreaker: spec.CircuitBreaker,
+		},
+	}
+
+	if f.Envs == nil {
+		f.Envs = make(map[string]string)
+	}
+
+	return f
+}
+
+// envs are the environment variables of a function. In JSON, they are given
+// either as an object or as a list of "key=value" strings.
+type envs map[string]string
+
+func (e *envs) UnmarshalJSON(b []byte) error {
+	var list []string
+
+	err := json.Unmarshal(b, &list)
+	if err != nil {
+		return json.Unmarshal(b, (*map[string]string)(e))
+	}
+
+	*e = parseEnvs(list)
+
+	return nil
+}
+
+// parseEnvs turns a list of "key=value" strings into envs. Entries without a
+// value are skipped.
+func parseEnvs(list []string) envs {
+	e := make(envs, len(list))
+
+	for _, l := range list {
+		k, v, ok := strings.Cut(l, "=")
+
+		if !ok {
+			log.Println("invalid env:", l)
+			continue
+		}
+
+		e[k] = v
+	}
+
+	return e
+}
+
+// registerAPI adds the handlers of the /v1 API to r.
+func (s *server) registerAPI(r *http.ServeMux) {
+	r.HandleFunc("/v1/functions", s.authorize(RoleRead, s.apiFunctionsHandler))
+	r.HandleFunc("/v1/functions/{name}", s.authorize(RoleDeploy, s.apiFunctionHandler))
+	r.HandleFunc("/v1/deployments", s.authorize(RoleRead, s.apiDeploymentsHandler))
+	r.HandleFunc("/v1/deployments/{id}", s.authorize(RoleRead, s.apiDeploymentHandler))
+	r.HandleFunc("/v1/", s.authorize(RoleRead, func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such resource %s", r.URL.Path))
+	}))
+}
+
+// apiFunctionsHandler lists all functions.
+func (s *server) apiFunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.ms.Functions())
+}
+
+// apiFunctionHandler describes a function in detail on GET, deploys it on
+// PUT, and deletes it on DELETE.
+func (s *server) apiFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		f, err := s.ms.FunctionStatus(name)
+		if err != nil {
+			writeError(w, apiErrorStatus(err), err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, f)
+
+	case http.MethodPut:
+		s.apiPutFunction(w, r, name)
+
+	case http.MethodDelete:
+		err := s.ms.Delete(name)
+		if err != nil {
+			writeError(w, apiErrorStatus(err), err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiPutFunction deploys function name. A JSON body is a functionSpec, any
+// other body is a streamed upload like for /uploadStream. A synchronous
+// deployment returns the function, an asynchronous one the deployment.
+func (s *server) apiPutFunction(w http.ResponseWriter, r *http.Request, name string) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+
+	_, err := s.ms.Function(name)
+	existed := err == nil
+
+	var d manager.Deployment
+	var async bool
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "application/json" {
+		var spec functionSpec
+
+		err = json.NewDecoder(r.Body).Decode(&spec)
+		if err != nil {
+			writeError(w, apiErrorStatus(err, http.StatusBadRequest), err)
+			return
+		}
+
+		async = spec.Async
+		d, err = s.deploySpec(name, spec)
+	} else {
+		var f manager.Function
+		var zip io.Reader
+
+		f, zip, async, err = streamedUpload(r, uploadParams(r))
+		if err != nil {
+			writeError(w, apiErrorStatus(err, http.StatusBadRequest), err)
+			return
+		}
+
+		f.Name = name
+		d, err = s.ms.UploadStream(f, zip, async)
+	}
+
+	if err != nil {
+		writeError(w, apiErrorStatus(err), err)
+		return
+	}
+
+	if async {
+		w.Header().Set("Location", "/v1/deployments/"+d.ID)
+		writeJSON(w, http.StatusAccepted, d)
+		return
+	}
+
+	f, err := s.ms.Function(name)
+	if err != nil {
+		writeError(w, apiErrorStatus(err), err)
+		return
+	}
+
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/v1/functions/"+name)
+	}
+
+	writeJSON(w, status, f)
+}
+
+// deploySpec deploys function name as described by spec.
+func (s *server) deploySpec(name string, spec functionSpec) (manager.Deployment, error) {
+	spec.Name = name
+	f := spec.function()
+
+	log.Println("got request to deploy function: Name", f.Name, "Env", f.Env, "Threads", f.Threads, "Replicas", f.MinReplicas, "-", f.MaxReplicas)
+
+	switch {
+	case spec.URL != "":
+		return s.ms.UrlUpload(f, spec.URL, spec.Async)
+	case spec.Zip != "" || spec.Image != "":
+		return s.ms.Upload(f, spec.Zip, spec.Async)
+	default:
+		return manager.Deployment{}, fmt.Errorf("%w: one of zip, url, or image is required", manager.ErrInvalidFunction)
+	}
+}
+
+// apiDeploymentsHandler lists running and recent deployments.
+func (s *server) apiDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.ms.Deployments())
+}
+
+// apiDeploymentHandler returns a single deployment.
+func (s *server) apiDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	d, err := s.ms.Deployment(r.PathValue("id"))
+	if err != nil {
+		writeError(w, apiErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// allowMethods reports whether r uses one of methods. Otherwise, it answers
+// with 405 Method Not Allowed.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %s", r.Method, r.URL.Path))
+
+	return false
+}
+
+// apiErrorStatus returns the status code for err. Errors that are not known
+// to be the client's fault are internal server errors, unless def is given.
+func apiErrorStatus(err error, def ...int) int {
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, manager.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, manager.ErrInvalidFunction):
+		return http.StatusBadRequest
+	case len(def) > 0:
+		return def[0]
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError answers with an apiError for err.
+func writeError(w http.ResponseWriter, status int, err error) {
+	log.Println(err)
+
+	var e apiError
+	e.Error.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	e.Error.Message = err.Error()
+
+	writeJSON(w, status, e)
+}
+
+// writeJSON answers with v as JSON.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
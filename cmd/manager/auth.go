@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Roles of management API clients. Each role may do everything the roles
+// before it may do: readers list and inspect functions, deployers also
+// upload, delete, and roll back functions, and admins may also wipe all
+// functions.
+const (
+	RoleRead   = "read"
+	RoleDeploy = "deploy"
+	RoleAdmin  = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleRead:   1,
+	RoleDeploy: 2,
+	RoleAdmin:  3,
+}
+
+// authConfig is the file that TF_AUTH_FILE points to. Clients authenticate
+// either with one of Tokens as a bearer token or with a TLS client
+// certificate whose common name is listed in Certificates.
+type authConfig struct {
+	Tokens []struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+		Role  string `json:"role"`
+	} `json:"tokens"`
+	Certificates []struct {
+		Name       string `json:"name"`
+		CommonName string `json:"common_name"`
+		Role       string `json:"role"`
+	} `json:"certificates"`
+}
+
+// identity is an authenticated client.
+type identity struct {
+	name string
+	role string
+}
+
+// authenticator checks who sends a request and whether they may do so. A nil
+// authenticator lets everyone do anything.
+type authenticator struct {
+	// tokens maps the SHA-256 of each token to its owner, so that tokens are
+	// compared in constant time
+	tokens map[[sha256.Size]byte]identity
+	// certificates maps client certificate common names to their owner
+	certificates map[string]identity
+}
+
+// loadAuth reads the tokens and client certificates from the config file at
+// p.
+func loadAuth(p string) (*authenticator, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var c authConfig
+
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", p, err)
+	}
+
+	a := &authenticator{
+		tokens:       make(map[[sha256.Size]byte]identity),
+		certificates: make(map[string]identity),
+	}
+
+	for _, t := range c.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("empty token for %s", t.Name)
+		}
+
+		if _, ok := roleLevels[t.Role]; !ok {
+			return nil, fmt.Errorf("invalid role %s for %s", t.Role, t.Name)
+		}
+
+		h := sha256.Sum256([]byte(t.Token))
+		if _, ok := a.tokens[h]; ok {
+			return nil, fmt.Errorf("duplicate token for %s", t.Name)
+		}
+
+		a.tokens[h] = identity{name: t.Name, role: t.Role}
+	}
+
+	for _, cert := range c.Certificates {
+		if cert.CommonName == "" {
+			return nil, fmt.Errorf("empty common name for %s", cert.Name)
+		}
+
+		if _, ok := roleLevels[cert.Role]; !ok {
+			return nil, fmt.Errorf("invalid role %s for %s", cert.Role, cert.Name)
+		}
+
+		a.certificates[cert.CommonName] = identity{name: cert.Name, role: cert.Role}
+	}
+
+	log.Printf("loaded %d tokens and %d client certificates from %s", len(a.tokens), len(a.certificates), p)
+
+	return a, nil
+}
+
+// newInternalAuth creates an authenticator with a single random token, which
+// the management service hands to the processes it starts itself.
+func newInternalAuth(name string, role string) (*authenticator, string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := hex.EncodeToString(b)
+
+	a := &authenticator{
+		tokens: map[[sha256.Size]byte]identity{
+			sha256.Sum256([]byte(token)): {name: name, role: role},
+		},
+	}
+
+	return a, token, nil
+}
+
+// authenticate returns who sent r. A verified client certificate takes
+// precedence over a bearer token.
+func (a *authenticator) authenticate(r *http.Request) (identity, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if id, ok := a.certificates[cn]; ok {
+			return id, true
+		}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return identity{}, false
+	}
+
+	h := sha256.Sum256([]byte(strings.TrimSpace(token)))
+
+	// a map lookup is not constant time, so compare against every token
+	found := identity{}
+	ok = false
+	for t, id := range a.tokens {
+		if subtle.ConstantTimeCompare(h[:], t[:]) == 1 {
+			found = id
+			ok = true
+		}
+	}
+
+	return found, ok
+}
+
+// requiredRole returns the role needed for r. Reading only needs RoleRead,
+// anything else needs role.
+func requiredRole(r *http.Request, role string) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return RoleRead
+	}
+
+	return role
+}
+
+// statusWriter remembers the status code of a response for the audit log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the original ResponseWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// authorize wraps h so that only clients with at least role may call it,
+// while reading requests only need RoleRead. Every call that is not just
+// reading is written to the audit log, whether it is allowed or not.
+func (s *server) authorize(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		need := requiredRole(r, role)
+
+		// without authentication, everyone is anonymous
+		id := identity{name: "anonymous", role: "none"}
+
+		if need != RoleRead {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			w = sw
+
+			defer func() {
+				s.audit.Printf("user=%q role=%s remote=%s method=%s path=%q status=%d duration=%s", id.name, id.role, r.RemoteAddr, r.Method, r.URL.Path, sw.status, time.Since(start))
+			}()
+		}
+
+		if s.auth != nil {
+			got, ok := s.auth.authenticate(r)
+
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tinyFaaS"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("authentication required for %s %s", r.Method, r.URL.Path))
+				return
+			}
+
+			id = got
+
+			if roleLevels[id.role] < roleLevels[need] {
+				writeError(w, http.StatusForbidden, fmt.Errorf("%s needs role %s for %s %s", id.name, need, r.Method, r.URL.Path))
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
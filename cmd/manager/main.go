@@ -2,21 +2,35 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/OpenFogStack/tinyFaaS/pkg/docker"
 	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+	"github.com/OpenFogStack/tinyFaaS/pkg/native"
+	"github.com/OpenFogStack/tinyFaaS/pkg/registry"
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
+	"github.com/OpenFogStack/tinyFaaS/pkg/util"
 	"github.com/google/uuid"
 )
 
@@ -24,10 +38,27 @@ const (
 	ConfigPort          = 8080
 	RProxyConfigPort    = 8081
 	RProxyListenAddress = ""
+	// RProxyConfigAddress keeps the configuration endpoint of the rproxy
+	// local, as anyone who can reach it can change where requests go and
+	// how they are authorized
+	RProxyConfigAddress = "127.0.0.1"
+	DefaultDataDir      = "./data"
+	DefaultVersions     = 5
+	RProxyStartTimeout  = 10 * time.Second
+	// DefaultMaxUploadSize is the largest archive in bytes that can be
+	// uploaded to /uploadStream unless TF_MAX_UPLOAD_SIZE says otherwise
+	DefaultMaxUploadSize = 1 << 30
+	// MaxFormFieldSize limits the size of the metadata fields of multipart
+	// uploads
+	MaxFormFieldSize = 1 << 16
 )
 
 type server struct {
-	ms *manager.ManagementService
+	ms            *manager.ManagementService
+	maxUploadSize int64
+	// auth checks who may call the management API, nil if everyone may
+	auth  *authenticator
+	audit *log.Logger
 }
 
 func main() {
@@ -66,8 +97,29 @@ func main() {
 		ports[p] = port
 	}
 
-	// setting backend to docker
-	id := uuid.New().String()
+	dataDir, ok := os.LookupEnv("TF_DATA_DIR")
+
+	if !ok {
+		dataDir = DefaultDataDir
+	}
+
+	// the instance id is used to label everything the backend creates, so it
+	// must stay the same across restarts to find our own resources again
+	id, ok := os.LookupEnv("TF_ID")
+
+	if !ok {
+		var err error
+		id, err = loadID(path.Join(dataDir, "id"))
+		if err != nil {
+			log.Fatalf("error loading instance id: %s", err)
+		}
+	}
+
+	if !util.IsAlphaNumericDash(id) {
+		log.Fatalf("invalid instance id %s", id)
+	}
+
+	log.Println("using instance id", id)
 
 	// find backend
 	backend, ok := os.LookupEnv("TF_BACKEND")
@@ -82,30 +134,183 @@ func main() {
 	case "docker":
 		log.Println("using docker backend")
 		tfBackend = docker.New(id)
+	case "native":
+		log.Println("using native backend")
+		tfBackend = native.New(id)
 	default:
 		log.Fatalf("invalid backend %s", backend)
 	}
 
+	// find registry
+	registryType, ok := os.LookupEnv("TF_REGISTRY")
+
+	if !ok {
+		registryType = "file"
+		log.Println("using default registry file")
+	}
+
+	var tfRegistry manager.Registry
+	switch registryType {
+	case "file":
+		log.Println("using file registry")
+
+		versions := DefaultVersions
+		if v, ok := os.LookupEnv("TF_VERSIONS"); ok {
+			var err error
+			versions, err = strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("invalid number of versions %s: %s", v, err)
+			}
+		}
+
+		r, err := registry.NewFileRegistry(path.Join(dataDir, "functions"), versions)
+		if err != nil {
+			log.Fatalf("error creating registry: %s", err)
+		}
+		tfRegistry = r
+	case "none":
+		log.Println("not persisting functions")
+	default:
+		log.Fatalf("invalid registry %s", registryType)
+	}
+
+	maxUploadSize := int64(DefaultMaxUploadSize)
+	if v, ok := os.LookupEnv("TF_MAX_UPLOAD_SIZE"); ok {
+		var err error
+		maxUploadSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxUploadSize <= 0 {
+			log.Fatalf("invalid maximum upload size %s", v)
+		}
+	}
+
+	// number of built images to keep for reuse, 0 disables the cache
+	cacheSize := manager.DefaultCacheSize
+	if v, ok := os.LookupEnv("TF_CACHE_SIZE"); ok {
+		var err error
+		cacheSize, err = strconv.Atoi(v)
+		if err != nil || cacheSize < 0 {
+			log.Fatalf("invalid cache size %s", v)
+		}
+	}
+
+	// management API clients authenticate with tokens or client
+	// certificates listed in the auth file
+	var auth *authenticator
+	if p, ok := os.LookupEnv("TF_AUTH_FILE"); ok {
+		var err error
+		auth, err = loadAuth(p)
+		if err != nil {
+			log.Fatalf("error loading auth file: %s", err)
+		}
+	} else {
+		log.Println("TF_AUTH_FILE not set, anyone who can reach the management service may manage functions")
+	}
+
+	// every call that changes something is logged, to a file of its own if
+	// TF_AUDIT_LOG is set
+	auditOut := io.Writer(os.Stderr)
+	if p, ok := os.LookupEnv("TF_AUDIT_LOG"); ok {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("error opening audit log: %s", err)
+		}
+		defer f.Close()
+		auditOut = f
+	}
+	audit := log.New(auditOut, "audit: ", log.LstdFlags|log.LUTC)
+
+	tlsCert := os.Getenv("TF_TLS_CERT")
+	tlsKey := os.Getenv("TF_TLS_KEY")
+	tlsClientCA := os.Getenv("TF_TLS_CLIENT_CA")
+
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("TF_TLS_CERT and TF_TLS_KEY must be set together")
+	}
+
+	var tlsConfig *tls.Config
+	if tlsClientCA != "" {
+		if tlsCert == "" {
+			log.Fatal("TF_TLS_CLIENT_CA requires TF_TLS_CERT and TF_TLS_KEY")
+		}
+
+		b, err := os.ReadFile(tlsClientCA)
+		if err != nil {
+			log.Fatalf("error loading client CA: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			log.Fatalf("no certificates found in %s", tlsClientCA)
+		}
+
+		// client certificates are optional, clients without one can still
+		// use a token
+		tlsConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
 	ms := manager.New(
 		id,
 		RProxyListenAddress,
 		ports,
+		RProxyConfigAddress,
 		RProxyConfigPort,
 		tfBackend,
+		tfRegistry,
+		cacheSize,
 	)
 
-	rproxyArgs := []string{fmt.Sprintf("%s:%d", RProxyListenAddress, RProxyConfigPort)}
+	s := &server{
+		ms:            ms,
+		maxUploadSize: maxUploadSize,
+		auth:          auth,
+		audit:         audit,
+	}
+
+	// the rproxy calls us back to wake up functions that are scaled to zero,
+	// on a listener of its own that only it has the token for
+	wakeAuth, wakeToken, err := newInternalAuth("rproxy", RoleDeploy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wakeListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	internal := &server{
+		ms:    ms,
+		auth:  wakeAuth,
+		audit: audit,
+	}
+
+	wakeMux := http.NewServeMux()
+	wakeMux.HandleFunc("/wake", internal.authorize(RoleDeploy, s.wakeHandler))
+
+	go func() {
+		err := http.Serve(wakeListener, wakeMux)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	rproxyArgs := []string{fmt.Sprintf("%s:%d", RProxyConfigAddress, RProxyConfigPort)}
 
 	for prot, port := range ports {
 		rproxyArgs = append(rproxyArgs, fmt.Sprintf("%s:%s:%d", prot, RProxyListenAddress, port))
 	}
 
+	rproxyArgs = append(rproxyArgs, fmt.Sprintf("manager:%s", wakeListener.Addr()))
+
 	log.Println("rproxy args:", rproxyArgs)
 
 	// unpack the rproxy binary in a temporary directory
 	rProxyDir := path.Join(os.TempDir(), id)
 
-	err := os.MkdirAll(rProxyDir, 0755)
+	err = os.MkdirAll(rProxyDir, 0755)
 
 	if err != nil {
 		log.Fatal(err)
@@ -120,6 +325,8 @@ func main() {
 	defer os.RemoveAll(rProxyDir)
 
 	c := exec.Command(path.Join(rProxyDir, "rproxy.bin"), rproxyArgs...)
+	// pending asynchronous invocations survive restarts in the data directory
+	c.Env = append(os.Environ(), "TF_MANAGER_TOKEN="+wakeToken, "TF_INVOCATIONS_DIR="+path.Join(dataDir, "invocations"))
 
 	stdout, err := c.StdoutPipe()
 	if err != nil {
@@ -154,18 +361,39 @@ func main() {
 
 	log.Println("started rproxy")
 
-	s := &server{
-		ms: ms,
+	err = waitForRProxy(fmt.Sprintf("%s:%d", RProxyConfigAddress, RProxyConfigPort), RProxyStartTimeout)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// create handlers
+	// bring back functions from the last run
+	err = ms.Restore()
+	if err != nil {
+		log.Println("error restoring functions:", err)
+	}
+
+	ms.StartAutoscaler()
+
+	// create handlers, reading only ever needs RoleRead
 	r := http.NewServeMux()
-	r.HandleFunc("/upload", s.uploadHandler)
-	r.HandleFunc("/delete", s.deleteHandler)
-	r.HandleFunc("/list", s.listHandler)
-	r.HandleFunc("/wipe", s.wipeHandler)
-	r.HandleFunc("/logs", s.logsHandler)
-	r.HandleFunc("/uploadURL", s.urlUploadHandler)
+	s.registerAPI(r)
+
+	// the original endpoints, kept for existing clients and scripts
+	r.HandleFunc("/upload", s.authorize(RoleDeploy, s.uploadHandler))
+	r.HandleFunc("/delete", s.authorize(RoleDeploy, s.deleteHandler))
+	r.HandleFunc("/list", s.authorize(RoleRead, s.listHandler))
+	r.HandleFunc("/wipe", s.authorize(RoleAdmin, s.wipeHandler))
+	r.HandleFunc("/logs", s.authorize(RoleRead, s.logsHandler))
+	r.HandleFunc("/uploadURL", s.authorize(RoleDeploy, s.urlUploadHandler))
+	r.HandleFunc("/uploadStream", s.authorize(RoleDeploy, s.streamUploadHandler))
+	r.HandleFunc("/wake", s.authorize(RoleDeploy, s.wakeHandler))
+	r.HandleFunc("/restarts", s.authorize(RoleRead, s.restartsHandler))
+	r.HandleFunc("/versions", s.authorize(RoleRead, s.versionsHandler))
+	r.HandleFunc("/rollback", s.authorize(RoleDeploy, s.rollbackHandler))
+	r.HandleFunc("/cache", s.authorize(RoleDeploy, s.cacheHandler))
+	r.HandleFunc("/functions/{name}", s.authorize(RoleRead, s.functionHandler))
+	r.HandleFunc("/deployments", s.authorize(RoleRead, s.deploymentsHandler))
+	r.HandleFunc("/deployments/{id}", s.authorize(RoleRead, s.deploymentHandler))
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
@@ -195,14 +423,74 @@ func main() {
 	}()
 
 	// start server
-	log.Println("starting HTTP server")
-	addr := fmt.Sprintf(":%d", ConfigPort)
-	err = http.ListenAndServe(addr, r)
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", ConfigPort),
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsCert != "" {
+		log.Println("starting HTTPS server")
+		err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		log.Println("starting HTTP server")
+		err = srv.ListenAndServe()
+	}
+
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// loadID reads the instance id from the file at p. If there is no such file
+// yet, a new id is generated and written to p.
+func loadID(p string) (string, error) {
+	b, err := os.ReadFile(p)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	id := uuid.New().String()
+
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	err = util.WriteFileAtomic(p, []byte(id+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("generated new instance id", id)
+
+	return id, nil
+}
+
+// waitForRProxy blocks until the rproxy accepts connections on its config
+// address or the timeout expires.
+func waitForRProxy(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("rproxy not reachable on %s after %s: %w", addr, timeout, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPost {
@@ -211,13 +499,7 @@ func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// parse request
-	d := struct {
-		FunctionName    string   `json:"name"`
-		FunctionEnv     string   `json:"env"`
-		FunctionThreads int      `json:"threads"`
-		FunctionZip     string   `json:"zip"`
-		FunctionEnvs    []string `json:"envs"`
-	}{}
+	var d functionSpec
 
 	err := json.NewDecoder(r.Body).Decode(&d)
 	if err != nil {
@@ -226,21 +508,11 @@ func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("got request to upload function: Name", d.FunctionName, "Env", d.FunctionEnv, "Threads", d.FunctionThreads, "Bytes", len(d.FunctionZip), "Envs", d.FunctionEnvs)
-
-	envs := make(map[string]string)
-	for _, e := range d.FunctionEnvs {
-		k, v, ok := strings.Cut(e, "=")
+	f := d.function()
 
-		if !ok {
-			log.Println("invalid env:", e)
-			continue
-		}
+	log.Println("got request to upload function: Name", f.Name, "Env", f.Env, "Threads", f.Threads, "Bytes", len(d.Zip), "Envs", envNames(f.Envs), "Replicas", f.MinReplicas, "-", f.MaxReplicas)
 
-		envs[k] = v
-	}
-
-	res, err := s.ms.Upload(d.FunctionName, d.FunctionEnv, d.FunctionThreads, d.FunctionZip, envs)
+	dep, err := s.ms.Upload(f, d.Zip, d.Async)
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -249,8 +521,7 @@ func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// return success
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, res)
+	writeDeployment(w, dep, d.Async)
 
 }
 
@@ -368,14 +639,7 @@ func (s *server) urlUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// parse request
-	d := struct {
-		FunctionName    string   `json:"name"`
-		FunctionEnv     string   `json:"env"`
-		FunctionThreads int      `json:"threads"`
-		FunctionURL     string   `json:"url"`
-		FunctionEnvs    []string `json:"envs"`
-		SubFolder       string   `json:"subfolder_path"`
-	}{}
+	var d functionSpec
 
 	err := json.NewDecoder(r.Body).Decode(&d)
 	if err != nil {
@@ -384,21 +648,293 @@ func (s *server) urlUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("got request to upload function:", d)
+	f := d.function()
+
+	log.Println("got request to upload function: Name", f.Name, "Env", f.Env, "Threads", f.Threads, "URL", redactURL(d.URL), "Envs", envNames(f.Envs), "Replicas", f.MinReplicas, "-", f.MaxReplicas)
+
+	dep, err := s.ms.UrlUpload(f, d.URL, d.Async)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// return success
+	writeDeployment(w, dep, d.Async)
+}
+
+// streamUploadHandler deploys a function from an archive that is sent either
+// as the raw request body (e.g., application/zip) or as the file of a
+// multipart form. The metadata of
+// the function is taken from the query string, from X-TinyFaaS-* headers
+// (e.g., X-TinyFaaS-Min-Replicas for min_replicas), and, for multipart forms,
+// from the form fields that precede the file.
+func (s *server) streamUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+
+	f, zip, async, err := streamedUpload(r, uploadParams(r))
+	if err != nil {
+		w.WriteHeader(uploadErrorStatus(err, http.StatusBadRequest))
+		log.Println(err)
+		return
+	}
+
+	log.Println("got request to stream upload function: Name", f.Name, "Env", f.Env, "Threads", f.Threads, "Envs", envNames(f.Envs), "Replicas", f.MinReplicas, "-", f.MaxReplicas)
+
+	dep, err := s.ms.UploadStream(f, zip, async)
+
+	if err != nil {
+		w.WriteHeader(uploadErrorStatus(err, http.StatusInternalServerError))
+		log.Println(err)
+		return
+	}
+
+	// return success
+	writeDeployment(w, dep, async)
+}
+
+// writeDeployment answers an upload. A synchronous upload has finished and
+// returns the URLs of the function, an asynchronous one returns the
+// deployment that can then be followed at /deployments/{id}.
+func writeDeployment(w http.ResponseWriter, d manager.Deployment, async bool) {
+	if !async {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, d.Result)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/deployments/"+d.ID)
+	w.WriteHeader(http.StatusAccepted)
 
-	envs := make(map[string]string)
-	for _, e := range d.FunctionEnvs {
-		k, v, ok := strings.Cut(e, "=")
+	err := json.NewEncoder(w).Encode(d)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// streamedUpload reads the function of a streamed upload from params and
+// returns it along with the archive in the body of r, which is either the
+// body itself or the file of a multipart form. Form fields that precede the
+// file are added to params.
+func streamedUpload(r *http.Request, params url.Values) (manager.Function, io.Reader, bool, error) {
+	// anything but a multipart form is taken to be the archive itself
+	var zip io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return manager.Function{}, nil, false, err
+		}
+
+		zip, err = multipartArchive(mr, params)
+		if err != nil {
+			return manager.Function{}, nil, false, err
+		}
+	}
+
+	spec, err := specFromParams(params)
+	if err != nil {
+		return manager.Function{}, nil, false, err
+	}
+
+	return spec.function(), zip, spec.Async, nil
+}
+
+// uploadErrorStatus returns the status code for an upload that failed with
+// err, which is def unless the upload was too large.
+func uploadErrorStatus(err error, def int) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
 
+	return def
+}
+
+// uploadParams collects the metadata of a streamed upload from X-TinyFaaS-*
+// headers and the query string. Values from the query string come first.
+func uploadParams(r *http.Request) url.Values {
+	params := r.URL.Query()
+
+	for k, v := range r.Header {
+		key, ok := strings.CutPrefix(k, "X-Tinyfaas-")
 		if !ok {
-			log.Println("invalid env:", e)
 			continue
 		}
 
-		envs[k] = v
+		key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+		params[key] = append(params[key], v...)
+	}
+
+	return params
+}
+
+// multipartArchive adds the form fields of mr to params until it finds the
+// part that contains the archive, i.e., the first file or the "zip" field.
+// That part is returned so that it can be streamed.
+func multipartArchive(mr *multipart.Reader, params url.Values) (io.Reader, error) {
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("multipart upload does not contain an archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if p.FileName() != "" || p.FormName() == "zip" {
+			return p, nil
+		}
+
+		v, err := io.ReadAll(io.LimitReader(p, MaxFormFieldSize+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(v) > MaxFormFieldSize {
+			return nil, fmt.Errorf("form field %s is too large", p.FormName())
+		}
+
+		params.Add(p.FormName(), string(v))
+	}
+}
+
+// specFromParams describes the function of a streamed upload by its
+// metadata.
+func specFromParams(params url.Values) (functionSpec, error) {
+	spec := functionSpec{
+		Name:           params.Get("name"),
+		Env:            params.Get("env"),
+		Image:          params.Get("image"),
+		SubfolderPath:  params.Get("subfolder_path"),
+		Balancer:       params.Get("balancer"),
+		BalancerHeader: params.Get("balancer_header"),
+		Envs:           parseEnvs(params["envs"]),
+	}
+
+	// policies are passed as JSON, like in a JSON upload
+	var err error
+
+	spec.Auth, err = jsonParam[rproxy.AuthPolicy](params, "auth")
+	if err != nil {
+		return spec, err
+	}
+
+	spec.RateLimit, err = jsonParam[rproxy.RateLimit](params, "rate_limit")
+	if err != nil {
+		return spec, err
+	}
+
+	spec.Retry, err = jsonParam[rproxy.RetryPolicy](params, "retry")
+	if err != nil {
+		return spec, err
+	}
+
+	spec.CircuitBreaker, err = jsonParam[rproxy.CircuitBreaker](params, "circuit_breaker")
+	if err != nil {
+		return spec, err
+	}
+
+	ints := map[string]*int{
+		"threads":         &spec.Threads,
+		"min_replicas":    &spec.MinReplicas,
+		"max_replicas":    &spec.MaxReplicas,
+		"idle_timeout":    &spec.IdleTimeout,
+		"max_concurrency": &spec.MaxConcurrency,
+		"queue_size":      &spec.QueueSize,
+		"queue_timeout":   &spec.QueueTimeout,
+		"timeout":         &spec.Timeout,
+	}
+
+	// any of the canary fields turns on a canary release, the others keep
+	// their defaults
+	if params.Has("canary_step") || params.Has("canary_interval") || params.Has("canary_max_error_rate") {
+		spec.Canary = &manager.Canary{}
+		ints["canary_step"] = &spec.Canary.Step
+		ints["canary_interval"] = &spec.Canary.Interval
+
+		if v := params.Get("canary_max_error_rate"); v != "" {
+			rate, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return spec, fmt.Errorf("invalid canary_max_error_rate %s", v)
+			}
+
+			spec.Canary.MaxErrorRate = &rate
+		}
+	}
+
+	for k, p := range ints {
+		v := params.Get(k)
+		if v == "" {
+			continue
+		}
+
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return spec, fmt.Errorf("invalid %s %s", k, v)
+		}
+
+		*p = i
 	}
 
-	res, err := s.ms.UrlUpload(d.FunctionName, d.FunctionEnv, d.FunctionThreads, d.FunctionURL, d.SubFolder, envs)
+	if v := params.Get("async"); v != "" {
+		spec.Async, err = strconv.ParseBool(v)
+		if err != nil {
+			return spec, fmt.Errorf("invalid async %s", v)
+		}
+	}
+
+	return spec, nil
+}
+
+// jsonParam decodes the JSON in parameter name, or returns nil if it is not
+// set.
+func jsonParam[T any](params url.Values, name string) (*T, error) {
+	v := params.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	t := new(T)
+
+	err := json.Unmarshal([]byte(v), t)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %w", name, v, err)
+	}
+
+	return t, nil
+}
+
+func (s *server) wakeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// parse request
+	d := struct {
+		FunctionName string `json:"name"`
+	}{}
+
+	err := json.NewDecoder(r.Body).Decode(&d)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	log.Println("got request to wake function:", d.FunctionName)
+
+	err = s.ms.Wake(d.FunctionName)
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -406,7 +942,207 @@ func (s *server) urlUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) restartsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(s.ms.Restarts())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	versions, err := s.ms.Versions(name)
+
+	if err != nil {
+		w.WriteHeader(apiErrorStatus(err))
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(versions)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *server) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// parse request
+	d := struct {
+		FunctionName string `json:"name"`
+		Version      int    `json:"version"`
+	}{}
+
+	err := json.NewDecoder(r.Body).Decode(&d)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	log.Println("got request to roll back function:", d.FunctionName, "to version", d.Version)
+
+	res, err := s.ms.Rollback(d.FunctionName, d.Version)
+
+	if err != nil {
+		w.WriteHeader(apiErrorStatus(err))
+		log.Println(err)
+		return
+	}
+
 	// return success
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, res)
 }
+
+// cacheHandler lists the images in the build cache on GET and removes them on
+// DELETE, either the one given by the "digest" query parameter or all of them.
+func (s *server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		images, err := s.ms.Cache()
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(images)
+		if err != nil {
+			log.Println(err)
+		}
+	case http.MethodDelete:
+		digest := r.URL.Query().Get("digest")
+
+		log.Println("got request to prune build cache:", digest)
+
+		err := s.ms.PruneCache(digest)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// deploymentsHandler lists running and recent deployments.
+func (s *server) deploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(s.ms.Deployments())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// deploymentHandler returns the phase, build logs, and result or error of a
+// single deployment.
+func (s *server) deploymentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d, err := s.ms.Deployment(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(d)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// functionHandler describes a function in detail, including the state and
+// health of each of its replicas.
+func (s *server) functionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f, err := s.ms.FunctionStatus(r.PathValue("name"))
+	if err != nil {
+		writeError(w, apiErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, f)
+}
+
+// envNames returns the names of envs for logging, as their values may be
+// secret.
+func envNames(envs map[string]string) []string {
+	names := make([]string, 0, len(envs))
+	for k := range envs {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// redactURL returns u without credentials or query for logging, as e.g.
+// pre-signed URLs carry their credentials in the query.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "(invalid URL)"
+	}
+
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+
+	return parsed.Redacted()
+}
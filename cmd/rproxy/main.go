@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,13 +21,14 @@ func main() {
 	log.SetPrefix("rproxy: ")
 
 	if len(os.Args) <= 3 {
-		fmt.Println("Usage: ./rproxy <listen-addr> [<protocol>:<listen-addr>]")
+		fmt.Println("Usage: ./rproxy <listen-addr> [<protocol>:<listen-addr>] [manager:<manager-addr>]")
 		os.Exit(1)
 	}
 
 	rproxyListenAddress := os.Args[1]
 
 	listenAddrs := make(map[string]string)
+	managerAddr := ""
 
 	for _, arg := range os.Args[2:] {
 		prot, listenAddr, ok := strings.Cut(arg, ":")
@@ -39,6 +41,13 @@ func main() {
 		prot = strings.ToLower(prot)
 		listenAddr = strings.ToLower(listenAddr)
 
+		// not a protocol but where to reach the management service
+		if prot == "manager" {
+			log.Printf("using manager on %s", listenAddr)
+			managerAddr = listenAddr
+			continue
+		}
+
 		log.Printf("adding %s listener on %s", prot, listenAddr)
 		listenAddrs[prot] = listenAddr
 	}
@@ -47,7 +56,10 @@ func main() {
 		return // nothing to do
 	}
 
-	r := rproxy.New()
+	// the management service passes a token for wake requests through the
+	// environment, so that it does not show up in the process list, and the
+	// directory for asynchronous invocations along with it
+	r := rproxy.New(managerAddr, os.Getenv("TF_MANAGER_TOKEN"), os.Getenv("TF_INVOCATIONS_DIR"))
 
 	// CoAP
 	if listenAddr, ok := listenAddrs["coap"]; ok {
@@ -68,59 +80,130 @@ func main() {
 	server := http.NewServeMux()
 
 	server.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "POST" {
+		if req.Method != http.MethodPost && req.Method != http.MethodDelete {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
-		log.Printf("have request: %+v", req)
+		log.Printf("have request: %s %s", req.Method, req.URL.Path)
 
 		buf := new(bytes.Buffer)
 		buf.ReadFrom(req.Body)
 		newStr := buf.String()
 
-		log.Printf("have body: %s", newStr)
-
 		var def struct {
-			FunctionResource   string   `json:"name"`
-			FunctionContainers []string `json:"ips"`
+			FunctionResource   string         `json:"name"`
+			FunctionContainers []string       `json:"ips"`
+			FunctionGroups     []rproxy.Group `json:"groups"`
+			rproxy.Config
 		}
 
 		err := json.Unmarshal([]byte(newStr), &def)
 
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if err != nil || def.FunctionResource == "" {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		log.Printf("have definition: %+v", def)
+		// the configuration is not logged, as its access policy may hold
+		// secrets
+		log.Printf("have definition for %s", def.FunctionResource)
 
 		if def.FunctionResource[0] == '/' {
 			def.FunctionResource = def.FunctionResource[1:]
 		}
 
-		if len(def.FunctionContainers) > 0 {
-			// "ips" field not empty: add function
-			log.Printf("adding %s", def.FunctionResource)
-			err = r.Add(def.FunctionResource, def.FunctionContainers)
+		if req.Method == http.MethodDelete {
+			log.Printf("deleting %s", def.FunctionResource)
+			err = r.Del(def.FunctionResource)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			w.Header().Set("Content-Type", "text/plain")
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
 			return
+		}
+
+		// an empty "ips" field means the function is scaled to zero, if
+		// "groups" are given, they replace "ips"
+		log.Printf("adding %s", def.FunctionResource)
+		if len(def.FunctionGroups) > 0 {
+			err = r.AddGroups(def.FunctionResource, def.FunctionGroups, def.Config)
 		} else {
+			err = r.Add(def.FunctionResource, def.FunctionContainers, def.Config)
+		}
+		if err != nil {
+			log.Printf("error adding %s: %s", def.FunctionResource, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
 
-			log.Printf("deleting %s", def.FunctionResource)
-			err = r.Del(def.FunctionResource)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+	server.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-			}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(r.Stats())
+	})
+
+	server.HandleFunc("/replicas", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(r.Replicas())
+	})
+
+	server.HandleFunc("/deadletters", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(r.DeadLetters())
+	})
+
+	// POST requeues a dead letter, DELETE drops it
+	server.HandleFunc("/deadletters/", func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/deadletters/")
+
+		var err error
+		switch req.Method {
+		case http.MethodPost:
+			log.Printf("requeueing invocation %s", id)
+			err = r.Requeue(id)
+		case http.MethodDelete:
+			log.Printf("deleting invocation %s", id)
+			err = r.DeleteDeadLetter(id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if errors.Is(err, rproxy.ErrInvocationNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
+
+		if err != nil {
+			log.Printf("error handling invocation %s: %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
 	})
 
 	log.Printf("listening on %s", rproxyListenAddress)
@@ -1,8 +1,11 @@
 package coap
 
 import (
+	"context"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
 	"github.com/pfandzelter/go-coap"
@@ -10,12 +13,40 @@ import (
 
 const async = false
 
+// tooManyRequests is the 4.29 response code of RFC 8516, which go-coap does
+// not know.
+const tooManyRequests coap.COAPCode = 157
+
+// exchangeLifetime is how long a CoAP client may wait for a response to a
+// request, EXCHANGE_LIFETIME in RFC 7252.
+const exchangeLifetime = 247 * time.Second
+
+// queryHeaders returns the URI-Query options of m as headers, as CoAP has no
+// headers of its own. A client passes credentials such as an API key as
+// "X-API-Key=<key>".
+func queryHeaders(m *coap.Message) map[string]string {
+	headers := make(map[string]string)
+
+	for _, o := range m.Options(coap.URIQuery) {
+		q, ok := o.(string)
+		if !ok {
+			continue
+		}
+
+		k, v, _ := strings.Cut(q, "=")
+		headers[k] = v
+	}
+
+	return headers
+}
+
 func Start(r *rproxy.RProxy, listenAddr string) {
 
 	h := coap.FuncHandler(
 		func(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
 
-			log.Printf("have request: %+v", m)
+			// the options may carry credentials, so they are not logged
+			log.Printf("have request: %s %s (message id %d)", m.Type, m.Code, m.MessageID)
 			log.Printf("is confirmable: %v", m.IsConfirmable())
 			log.Printf("path: %s", m.PathString())
 
@@ -27,7 +58,7 @@ func Start(r *rproxy.RProxy, listenAddr string) {
 
 			log.Printf("have request for path: %s (async: %v)", p, async)
 
-			s, res := r.Call(p, m.Payload, async, nil)
+			headers := queryHeaders(m)
 
 			mes := &coap.Message{
 				Type:      coap.Acknowledgement,
@@ -35,6 +66,30 @@ func Start(r *rproxy.RProxy, listenAddr string) {
 				Token:     m.Token,
 			}
 
+			// Max-Age tells the client when to try again, see RFC 8516
+			if wait, ok := r.Allow(p, a.IP.String(), headers); !ok {
+				mes.Code = tooManyRequests
+				mes.SetOption(coap.MaxAge, uint32(rproxy.RetryAfter(wait)))
+				return mes
+			}
+
+			// a client may also pass a shorter timeout as a query option
+			timeout := exchangeLifetime
+			if v, ok := headers[rproxy.TimeoutHeader]; ok {
+				t, err := rproxy.ParseTimeout(v)
+				if err != nil {
+					log.Print(err)
+					mes.Code = coap.BadRequest
+					return mes
+				}
+				timeout = min(timeout, t)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			s, res := r.Call(ctx, p, m.Payload, async, headers)
+
 			switch s {
 			case rproxy.StatusOK:
 				mes.SetOption(coap.ContentFormat, coap.TextPlain)
@@ -46,6 +101,16 @@ func Start(r *rproxy.RProxy, listenAddr string) {
 				mes.Code = coap.NotFound
 			case rproxy.StatusError:
 				mes.Code = coap.InternalServerError
+			case rproxy.StatusUnauthorized:
+				mes.Code = coap.Unauthorized
+			case rproxy.StatusForbidden:
+				mes.Code = coap.Forbidden
+			case rproxy.StatusOverloaded:
+				mes.Code = coap.ServiceUnavailable
+			case rproxy.StatusTimeout:
+				mes.Code = coap.GatewayTimeout
+			case rproxy.StatusCircuitOpen:
+				mes.Code = coap.ServiceUnavailable
 			}
 
 			return mes
@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+	"github.com/OpenFogStack/tinyFaaS/pkg/util"
+)
+
+// cacheRepo is the repository that cached images are tagged in, with their
+// digest as the tag.
+func (db *DockerBackend) cacheRepo() string {
+	return "tinyfaas-cache-" + strings.ToLower(db.tinyFaaSID)
+}
+
+func (db *DockerBackend) cacheRef(digest string) string {
+	return db.cacheRepo() + ":" + digest
+}
+
+// isCacheTag reports whether t is the tag of a cached image.
+func (db *DockerBackend) isCacheTag(t string) bool {
+	return strings.HasPrefix(t, db.cacheRepo()+":")
+}
+
+// RuntimeDigest hashes the files that the runtime of env adds to functions.
+func (db *DockerBackend) RuntimeDigest(env string) (string, error) {
+	return util.HashFS(runtimes, path.Join(runtimesDir, env))
+}
+
+// CreateCached creates a handler like Create, but runs the image cached under
+// digest if there is one. Otherwise, the image is built and cached.
+func (db *DockerBackend) CreateCached(digest string, name string, env string, threads int, filedir string, envs map[string]string, logs io.Writer) (manager.Handler, bool, error) {
+
+	ref := db.cacheRef(digest)
+
+	_, _, err := db.client.ImageInspectWithRaw(context.Background(), ref)
+
+	if err == nil {
+		log.Println("using cached image", ref, "for function", name)
+
+		fh, err := db.createTagged(name, env, ref, threads, envs)
+		return fh, true, err
+	}
+
+	if !client.IsErrNotFound(err) {
+		return nil, false, err
+	}
+
+	dh, err := db.newHandler(name, env, threads)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = dh.build(filedir, logs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// docker tag <image> <cache>
+	err = db.client.ImageTag(context.Background(), dh.uniqueName, ref)
+	if err != nil {
+		// the function works all the same, it is just built again next time
+		log.Printf("error caching image %s: %s", dh.uniqueName, err)
+	} else {
+		log.Println("cached image", dh.uniqueName, "as", ref)
+	}
+
+	err = dh.setup(envs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return dh, false, nil
+}
+
+// CachedImages lists the images in the build cache.
+func (db *DockerBackend) CachedImages() ([]manager.CachedImage, error) {
+	// docker image ls <cache>
+	images, err := db.client.ImageList(
+		context.Background(),
+		image.ListOptions{
+			Filters: filters.NewArgs(filters.Arg("reference", db.cacheRepo())),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := make([]manager.CachedImage, 0, len(images))
+
+	for _, i := range images {
+		for _, t := range i.RepoTags {
+			if !db.isCacheTag(t) {
+				continue
+			}
+
+			cached = append(cached, manager.CachedImage{
+				Digest:  strings.TrimPrefix(t, db.cacheRepo()+":"),
+				Size:    i.Size,
+				Created: time.Unix(i.Created, 0),
+			})
+		}
+	}
+
+	return cached, nil
+}
+
+// RemoveCachedImage removes the image cached under digest. Handlers that use
+// the image keep it, as they have their own tag.
+func (db *DockerBackend) RemoveCachedImage(digest string) error {
+	if digest == "" || strings.ContainsAny(digest, ":/@") {
+		return fmt.Errorf("invalid digest %s", digest)
+	}
+
+	ref := db.cacheRef(digest)
+
+	// docker rmi <cache>
+	_, err := db.client.ImageRemove(
+		context.Background(),
+		ref,
+		image.RemoveOptions{},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Println("removed cached image", ref)
+
+	return nil
+}
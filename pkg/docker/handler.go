@@ -4,21 +4,25 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/google/uuid"
 
@@ -32,6 +36,7 @@ const (
 )
 
 type dockerHandler struct {
+	backend    *DockerBackend
 	name       string
 	env        string
 	threads    int
@@ -39,13 +44,27 @@ type dockerHandler struct {
 	filePath   string
 	client     *client.Client
 	network    string
+	envs       []string
 	containers []string
 	handlerIPs []string
+	// next is the index of the next container to create
+	next int
+	// changed is called when a crashed container has been restarted
+	changed    func()
+	restarts   manager.Restarts
+	restarting map[string]struct{}
+	// mu guards the fields above and is never held while talking to
+	// containers, which may take seconds
+	mu sync.Mutex
+	// ops serializes Start, Scale, and Destroy
+	ops sync.Mutex
 }
 
 type DockerBackend struct {
 	client     *client.Client
 	tinyFaaSID string
+	handlers   map[string]*dockerHandler
+	hl         sync.Mutex
 }
 
 func New(tinyFaaSID string) *DockerBackend {
@@ -56,43 +75,213 @@ func New(tinyFaaSID string) *DockerBackend {
 		return nil
 	}
 
-	return &DockerBackend{
+	db := &DockerBackend{
 		client:     client,
 		tinyFaaSID: tinyFaaSID,
+		handlers:   make(map[string]*dockerHandler),
 	}
+
+	// clean up anything a previous run of this instance left behind
+	err = db.collectGarbage()
+	if err != nil {
+		log.Printf("error collecting garbage: %s", err)
+	}
+
+	go db.watch()
+	go db.reconcile()
+
+	return db
 }
 
 func (db *DockerBackend) Stop() error {
+	return db.collectGarbage()
+}
+
+// collectGarbage removes all containers, networks, and images that carry the
+// label of this tinyFaaS instance but do not belong to a live handler.
+func (db *DockerBackend) collectGarbage() error {
+	db.hl.Lock()
+	defer db.hl.Unlock()
+
+	liveContainers := make(map[string]struct{})
+	liveNetworks := make(map[string]struct{})
+	liveImages := make(map[string]struct{})
+
+	for _, dh := range db.handlers {
+		dh.mu.Lock()
+		for _, c := range dh.containers {
+			liveContainers[c] = struct{}{}
+		}
+		dh.mu.Unlock()
+		liveNetworks[dh.network] = struct{}{}
+		liveImages[dh.uniqueName+":latest"] = struct{}{}
+	}
+
+	f := filters.NewArgs(
+		filters.Arg("label", "tinyFaaS="+db.tinyFaaSID),
+		filters.Arg("label", "tinyfaas-function"),
+	)
+
+	// docker ps -a --filter label=tinyFaaS=<id>
+	containers, err := db.client.ContainerList(
+		context.Background(),
+		container.ListOptions{
+			All:     true,
+			Filters: f,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		if _, ok := liveContainers[c.ID]; ok {
+			continue
+		}
+
+		log.Println("removing orphaned container", c.ID)
+
+		err = db.client.ContainerRemove(
+			context.Background(),
+			c.ID,
+			container.RemoveOptions{
+				Force: true,
+			},
+		)
+		if err != nil {
+			log.Printf("error removing container %s: %s", c.ID, err)
+		}
+	}
+
+	// docker network ls --filter label=tinyFaaS=<id>
+	networks, err := db.client.NetworkList(
+		context.Background(),
+		network.ListOptions{
+			Filters: f,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range networks {
+		if _, ok := liveNetworks[n.ID]; ok {
+			continue
+		}
+
+		log.Println("removing orphaned network", n.Name)
+
+		err = db.client.NetworkRemove(
+			context.Background(),
+			n.ID,
+		)
+		if err != nil {
+			log.Printf("error removing network %s: %s", n.Name, err)
+		}
+	}
+
+	// docker image ls --filter label=tinyFaaS=<id>
+	images, err := db.client.ImageList(
+		context.Background(),
+		image.ListOptions{
+			All:     true,
+			Filters: f,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range images {
+		live := false
+		cached := false
+		for _, t := range i.RepoTags {
+			if _, ok := liveImages[t]; ok {
+				live = true
+			}
+			if db.isCacheTag(t) {
+				cached = true
+			}
+		}
+
+		// cached images are kept for the next function with the same source,
+		// only the tags of handlers that are gone are removed
+		if cached {
+			for _, t := range i.RepoTags {
+				if _, ok := liveImages[t]; ok || db.isCacheTag(t) {
+					continue
+				}
+
+				log.Println("removing orphaned tag", t, "of cached image", i.ID)
+
+				_, err = db.client.ImageRemove(
+					context.Background(),
+					t,
+					image.RemoveOptions{},
+				)
+				if err != nil {
+					log.Printf("error removing tag %s: %s", t, err)
+				}
+			}
+			continue
+		}
+
+		if live {
+			continue
+		}
+
+		log.Println("removing orphaned image", i.ID, i.RepoTags)
+
+		_, err = db.client.ImageRemove(
+			context.Background(),
+			i.ID,
+			image.RemoveOptions{
+				Force:         true,
+				PruneChildren: true,
+			},
+		)
+		if err != nil {
+			log.Printf("error removing image %s: %s", i.ID, err)
+		}
+	}
+
 	return nil
 }
 
-func (db *DockerBackend) Create(name string, env string, threads int, filedir string, envs map[string]string) (manager.Handler, error) {
+func (db *DockerBackend) Create(name string, env string, threads int, filedir string, envs map[string]string, logs io.Writer) (manager.Handler, error) {
 
-	// make a unique function name by appending uuid string to function name
-	uuid, err := uuid.NewRandom()
+	dh, err := db.newHandler(name, env, threads)
 	if err != nil {
 		return nil, err
 	}
 
-	dh := &dockerHandler{
-		name:       name,
-		env:        env,
-		client:     db.client,
-		threads:    threads,
-		containers: make([]string, 0, threads),
-		handlerIPs: make([]string, 0, threads),
+	err = dh.build(filedir, logs)
+	if err != nil {
+		return nil, err
 	}
 
-	dh.uniqueName = name + "-" + uuid.String()
-	log.Println("creating function", name, "with unique name", dh.uniqueName)
+	err = dh.setup(envs)
+	if err != nil {
+		return nil, err
+	}
+
+	return dh, nil
+
+}
+
+// build builds the image of handler dh from the runtime of its environment and
+// the function source at filedir, and tags it with the handler's unique name.
+// The output of the build is written to logs.
+func (dh *dockerHandler) build(filedir string, logs io.Writer) error {
+	db := dh.backend
 
 	// make a folder for the function
 	// mkdir <folder>
 	dh.filePath = path.Join(TmpDir, dh.uniqueName)
 
-	err = os.MkdirAll(dh.filePath, 0777)
+	err := os.MkdirAll(dh.filePath, 0777)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// copy Docker stuff into folder
@@ -100,7 +289,7 @@ func (db *DockerBackend) Create(name string, env string, threads int, filedir st
 
 	err = util.CopyDirFromEmbed(runtimes, path.Join(runtimesDir, dh.env), dh.filePath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	log.Println("copied runtime files to folder", dh.filePath)
@@ -110,19 +299,19 @@ func (db *DockerBackend) Create(name string, env string, threads int, filedir st
 	// cp <file> <folder>/fn
 	err = os.MkdirAll(path.Join(dh.filePath, "fn"), 0777)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = util.CopyAll(filedir, path.Join(dh.filePath, "fn"))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// build image
 	// docker build -t <image> <folder>
 	tar, err := archive.TarWithOptions(dh.filePath, &archive.TarOptions{})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	r, err := db.client.ImageBuild(
@@ -139,17 +328,74 @@ func (db *DockerBackend) Create(name string, env string, threads int, filedir st
 		},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer r.Body.Close()
-	scanner := bufio.NewScanner(r.Body)
-	for scanner.Scan() {
-		log.Println(scanner.Text())
+
+	// build errors are only reported in the stream of messages
+	dec := json.NewDecoder(r.Body)
+	for dec.More() {
+		var m jsonmessage.JSONMessage
+
+		err = dec.Decode(&m)
+		if err != nil {
+			return err
+		}
+
+		if m.Error != nil {
+			return m.Error
+		}
+
+		log.Println(strings.TrimSpace(m.Stream))
+		fmt.Fprint(logs, m.Stream)
 	}
 
 	log.Println("built image", dh.uniqueName)
 
+	// remove folder
+	// rm -rf <folder>
+	err = os.RemoveAll(dh.filePath)
+	if err != nil {
+		return err
+	}
+
+	log.Println("removed folder", dh.filePath)
+
+	return nil
+}
+
+// newHandler prepares a handler for function name. The handler's image must
+// be tagged with its unique name before calling setup.
+func (db *DockerBackend) newHandler(name string, env string, threads int) (*dockerHandler, error) {
+
+	// make a unique function name by appending uuid string to function name
+	uuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	dh := &dockerHandler{
+		backend:    db,
+		name:       name,
+		env:        env,
+		client:     db.client,
+		threads:    threads,
+		containers: make([]string, 0, threads),
+		handlerIPs: make([]string, 0, threads),
+		restarting: make(map[string]struct{}),
+	}
+
+	dh.uniqueName = name + "-" + uuid.String()
+	log.Println("creating function", name, "with unique name", dh.uniqueName)
+
+	return dh, nil
+}
+
+// setup creates the network and containers of handler dh from its image.
+func (dh *dockerHandler) setup(envs map[string]string) error {
+	db := dh.backend
+
 	// create network
 	// docker network create <network>
 	network, err := db.client.NetworkCreate(
@@ -163,153 +409,301 @@ func (db *DockerBackend) Create(name string, env string, threads int, filedir st
 		},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	dh.network = network.ID
 
 	log.Println("created network", dh.uniqueName, "with id", network.ID)
 
-	e := make([]string, 0, len(envs))
+	dh.envs = make([]string, 0, len(envs))
 
 	for k, v := range envs {
-		e = append(e, fmt.Sprintf("%s=%s", k, v))
+		dh.envs = append(dh.envs, fmt.Sprintf("%s=%s", k, v))
 	}
 
 	// create containers
-	// docker run -d --network <network> --name <container> <image>
 	for i := 0; i < dh.threads; i++ {
-		container, err := db.client.ContainerCreate(
-			context.Background(),
-			&container.Config{
-				Image: dh.uniqueName,
-				Labels: map[string]string{
-					"tinyfaas-function": dh.name,
-					"tinyFaaS":          db.tinyFaaSID,
-				},
-				Env: e,
-			},
-			&container.HostConfig{
-				NetworkMode: container.NetworkMode(dh.uniqueName),
-			},
-			nil,
-			nil,
-			dh.uniqueName+fmt.Sprintf("-%d", i),
-		)
+		c, err := dh.createContainer(dh.nextName())
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		log.Println("created container", container.ID)
+		dh.containers = append(dh.containers, c)
+	}
+
+	db.hl.Lock()
+	db.handlers[dh.uniqueName] = dh
+	db.hl.Unlock()
+
+	return nil
+}
 
-		dh.containers = append(dh.containers, container.ID)
+// nextName returns the name of the next container of the function. The caller
+// must hold dh.mu.
+func (dh *dockerHandler) nextName() string {
+	name := fmt.Sprintf("%s-%d", dh.uniqueName, dh.next)
+	dh.next++
+
+	return name
+}
+
+// createContainer creates a new container for the function with the given
+// name. It is up to the caller to add it to the handler's list of containers.
+func (dh *dockerHandler) createContainer(name string) (string, error) {
+	// docker run -d --network <network> --name <container> <image>
+	c, err := dh.client.ContainerCreate(
+		context.Background(),
+		&container.Config{
+			Image: dh.uniqueName,
+			Labels: map[string]string{
+				"tinyfaas-function": dh.name,
+				"tinyFaaS":          dh.backend.tinyFaaSID,
+			},
+			Env: dh.envs,
+		},
+		&container.HostConfig{
+			NetworkMode: container.NetworkMode(dh.uniqueName),
+		},
+		nil,
+		nil,
+		name,
+	)
+
+	if err != nil {
+		return "", err
 	}
 
-	// remove folder
-	// rm -rf <folder>
-	err = os.RemoveAll(dh.filePath)
+	log.Println("created container", c.ID)
+
+	return c.ID, nil
+}
+
+// startContainer starts container c and returns its IP address.
+func (dh *dockerHandler) startContainer(c string) (string, error) {
+	// docker start <container>
+	err := dh.client.ContainerStart(
+		context.Background(),
+		c,
+		container.StartOptions{},
+	)
 	if err != nil {
-		return nil, err
+		log.Printf("error starting container %s: %s", c, err)
+		return "", err
 	}
 
-	log.Println("removed folder", dh.filePath)
+	log.Println("started container", c)
 
-	return dh, nil
+	// get container IPs
+	// docker inspect <container>
+	ci, err := dh.client.ContainerInspect(
+		context.Background(),
+		c,
+	)
+	if err != nil {
+		return "", err
+	}
 
+	ip := ci.NetworkSettings.Networks[dh.uniqueName].IPAddress
+
+	log.Println("got ip", ip, "for container", c)
+
+	return ip, nil
+}
+
+// waitReady polls the health endpoint of container c with the given ip until
+// it reports to be ready.
+func (dh *dockerHandler) waitReady(c string, ip string) error {
+	// curl http://<container>:8000/ready
+	log.Println("waiting for container", ip, "to be ready")
+	maxRetries := 10
+	for {
+		maxRetries--
+		if maxRetries == 0 {
+			// container did not start properly!
+			// give people some logs to look at
+			log.Printf("container %s (ip %s) not ready after 10 retries", c, ip)
+			log.Printf("getting logs for container %s", c)
+			logs, err := dh.getContainerLogs(c)
+
+			if err != nil {
+				return fmt.Errorf("container %s not ready after 10 retries, error encountered when getting logs %s", ip, err)
+			}
+
+			log.Println(logs)
+
+			log.Printf("end of logs for container %s", c)
+
+			return fmt.Errorf("container %s not ready after 10 retries", ip)
+		}
+
+		// timeout of 1 second
+		client := http.Client{
+			Timeout: 3 * time.Second,
+		}
+
+		resp, err := client.Get("http://" + ip + ":8000/health")
+		if err != nil {
+			log.Println(err)
+			log.Println("retrying in 1 second")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			log.Println("container", ip, "is ready")
+			return nil
+		}
+		log.Println("container", ip, "is not ready yet, retrying in 1 second")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// removeContainer stops and removes container c.
+func (dh *dockerHandler) removeContainer(c string) {
+	log.Println("stopping container", c)
+
+	timeout := containerTimeout // seconds
+
+	err := dh.client.ContainerStop(
+		context.Background(),
+		c,
+		container.StopOptions{
+			Timeout: &timeout,
+		},
+	)
+	if err != nil {
+		log.Printf("error stopping container %s: %s", c, err)
+	}
+
+	log.Println("stopped container", c)
+
+	err = dh.client.ContainerRemove(
+		context.Background(),
+		c,
+		container.RemoveOptions{},
+	)
+	if err != nil {
+		log.Printf("error removing container %s: %s", c, err)
+		return
+	}
+
+	log.Println("removed container", c)
 }
 
 func (dh *dockerHandler) IPs() []string {
-	return dh.handlerIPs
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	ips := make([]string, len(dh.handlerIPs))
+	copy(ips, dh.handlerIPs)
+
+	return ips
 }
 
 func (dh *dockerHandler) Start() error {
-	log.Printf("dh: %+v", dh)
+	dh.ops.Lock()
+	defer dh.ops.Unlock()
+
+	dh.mu.Lock()
+	containers := make([]string, len(dh.containers))
+	copy(containers, dh.containers)
+	restarts := dh.restarts.Count
+	dh.mu.Unlock()
+
+	log.Printf("starting containers %v of function %s", containers, dh.name)
 
 	// start containers
 	// docker start <container>
 
+	ips := make([]string, len(containers))
+	errs := make([]error, len(containers))
+
 	wg := sync.WaitGroup{}
-	for _, c := range dh.containers {
+	for i, c := range containers {
 		wg.Add(1)
-		go func(c string) {
-			err := dh.client.ContainerStart(
-				context.Background(),
-				c,
-				container.StartOptions{},
-			)
-			wg.Done()
-			if err != nil {
-				log.Printf("error starting container %s: %s", c, err)
-				return
-			}
-
-			log.Println("started container", c)
-		}(c)
+		go func(i int, c string) {
+			defer wg.Done()
+			ips[i], errs[i] = dh.startContainer(c)
+		}(i, c)
 	}
 	wg.Wait()
 
-	// get container IPs
-	// docker inspect <container>
-	for _, container := range dh.containers {
-		c, err := dh.client.ContainerInspect(
-			context.Background(),
-			container,
-		)
+	for _, err := range errs {
 		if err != nil {
 			return err
 		}
+	}
+
+	// wait for the containers to be ready
+	for i, ip := range ips {
+		err := dh.waitReady(containers[i], ip)
+		if err != nil {
+			return err
+		}
+	}
 
-		dh.handlerIPs = append(dh.handlerIPs, c.NetworkSettings.Networks[dh.uniqueName].IPAddress)
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
 
-		log.Println("got ip", c.NetworkSettings.Networks[dh.uniqueName].IPAddress, "for container", container)
+	// a container that crashed in the meantime comes back with an IP address
+	// that we do not know
+	if dh.restarts.Count != restarts || len(dh.restarting) > 0 {
+		return fmt.Errorf("containers of function %s crashed while starting", dh.name)
 	}
 
-	// wait for the containers to be ready
-	// curl http://<container>:8000/ready
-	for i, ip := range dh.handlerIPs {
-		log.Println("waiting for container", ip, "to be ready")
-		maxRetries := 10
-		for {
-			maxRetries--
-			if maxRetries == 0 {
-				// container did not start properly!
-				// give people some logs to look at
-				log.Printf("container %s (ip %s) not ready after 10 retries", dh.containers[i], ip)
-				log.Printf("getting logs for container %s", dh.containers[i])
-				logs, err := dh.getContainerLogs(dh.containers[i])
+	dh.handlerIPs = ips
 
-				if err != nil {
-					return fmt.Errorf("container %s not ready after 10 retries, error encountered when getting logs %s", ip, err)
-				}
+	return nil
+}
 
-				log.Println(logs)
+// Scale adds or removes containers so that the function has the given number
+// of replicas. New containers are only added once they are ready.
+func (dh *dockerHandler) Scale(replicas int) error {
+	dh.ops.Lock()
+	defer dh.ops.Unlock()
+
+	dh.mu.Lock()
+	var removed []string
+	if len(dh.containers) > replicas {
+		removed = append(removed, dh.containers[replicas:]...)
+		dh.containers = dh.containers[:replicas]
+		dh.handlerIPs = dh.handlerIPs[:replicas]
+	}
+	missing := replicas - len(dh.containers)
+	dh.mu.Unlock()
 
-				log.Printf("end of logs for container %s", dh.containers[i])
+	// the removed containers are no longer part of the handler, so their exit
+	// does not trigger a restart
+	for _, c := range removed {
+		dh.removeContainer(c)
+	}
 
-				return fmt.Errorf("container %s not ready after 10 retries", ip)
-			}
+	for ; missing > 0; missing-- {
+		dh.mu.Lock()
+		name := dh.nextName()
+		dh.mu.Unlock()
 
-			// timeout of 1 second
-			client := http.Client{
-				Timeout: 3 * time.Second,
-			}
+		c, err := dh.createContainer(name)
+		if err != nil {
+			return err
+		}
 
-			resp, err := client.Get("http://" + ip + ":8000/health")
-			if err != nil {
-				log.Println(err)
-				log.Println("retrying in 1 second")
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			resp.Body.Close()
-			if resp.StatusCode == http.StatusOK {
-				log.Println("container", ip, "is ready")
-				break
-			}
-			log.Println("container", ip, "is not ready yet, retrying in 1 second")
-			time.Sleep(1 * time.Second)
+		ip, err := dh.startContainer(c)
+		if err == nil {
+			err = dh.waitReady(c, ip)
+		}
+
+		if err != nil {
+			dh.removeContainer(c)
+			return err
 		}
+
+		dh.mu.Lock()
+		dh.containers = append(dh.containers, c)
+		dh.handlerIPs = append(dh.handlerIPs, ip)
+		dh.mu.Unlock()
 	}
 
 	return nil
@@ -317,44 +711,30 @@ func (dh *dockerHandler) Start() error {
 
 func (dh *dockerHandler) Destroy() error {
 	log.Println("destroying function", dh.name)
-	log.Printf("dh: %+v", dh)
-
-	wg := sync.WaitGroup{}
-	log.Printf("stopping containers: %v", dh.containers)
-	for _, c := range dh.containers {
-		log.Println("removing container", c)
-
-		wg.Add(1)
-		go func(c string) {
-			log.Println("stopping container", c)
 
-			timeout := 1 // seconds
+	// whatever happens from here on, this handler is no longer live and
+	// anything we fail to remove is left for the garbage collector
+	dh.backend.hl.Lock()
+	delete(dh.backend.handlers, dh.uniqueName)
+	dh.backend.hl.Unlock()
 
-			err := dh.client.ContainerStop(
-				context.Background(),
-				c,
-				container.StopOptions{
-					Timeout: &timeout,
-				},
-			)
-			if err != nil {
-				log.Printf("error stopping container %s: %s", c, err)
-			}
+	dh.ops.Lock()
+	defer dh.ops.Unlock()
 
-			log.Println("stopped container", c)
+	dh.mu.Lock()
+	containers := dh.containers
+	dh.containers = nil
+	dh.handlerIPs = nil
+	dh.mu.Unlock()
 
-			err = dh.client.ContainerRemove(
-				context.Background(),
-				c,
-				container.RemoveOptions{},
-			)
-			wg.Done()
-			if err != nil {
-				log.Printf("error removing container %s: %s", c, err)
-			}
+	wg := sync.WaitGroup{}
+	log.Printf("stopping containers: %v", containers)
+	for _, c := range containers {
+		wg.Add(1)
+		go func(c string) {
+			defer wg.Done()
+			dh.removeContainer(c)
 		}(c)
-
-		log.Println("removed container", c)
 	}
 	wg.Wait()
 
@@ -445,7 +825,12 @@ func (dh *dockerHandler) Logs() (io.Reader, error) {
 	// docker logs <container>
 	var logs bytes.Buffer
 
-	for _, c := range dh.containers {
+	dh.mu.Lock()
+	containers := make([]string, len(dh.containers))
+	copy(containers, dh.containers)
+	dh.mu.Unlock()
+
+	for _, c := range containers {
 		l, err := dh.getContainerLogs(c)
 		if err != nil {
 			return nil, err
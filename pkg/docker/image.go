@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+// LoadImage loads an image tarball, as written by docker save, into the
+// Docker daemon and returns a reference to the image. If the tarball contains
+// several images, the first one is used. The daemon's output is written to
+// logs.
+func (db *DockerBackend) LoadImage(p string, logs io.Writer) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// docker load -i <file>
+	resp, err := db.client.ImageLoad(context.Background(), f, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	ref := ""
+
+	// the daemon reports what it loaded in a stream of JSON messages
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var m jsonmessage.JSONMessage
+
+		err = dec.Decode(&m)
+		if err != nil {
+			return "", err
+		}
+
+		if m.Error != nil {
+			return "", m.Error
+		}
+
+		log.Println(strings.TrimSpace(m.Stream))
+		fmt.Fprint(logs, m.Stream)
+
+		if ref != "" {
+			continue
+		}
+
+		if r, ok := strings.CutPrefix(m.Stream, "Loaded image: "); ok {
+			ref = strings.TrimSpace(r)
+		} else if r, ok := strings.CutPrefix(m.Stream, "Loaded image ID: "); ok {
+			ref = strings.TrimSpace(r)
+		}
+	}
+
+	if ref == "" {
+		return "", fmt.Errorf("no image found in %s", p)
+	}
+
+	log.Println("loaded image", ref)
+
+	return ref, nil
+}
+
+// CreateFromImage creates a handler for function name that runs the pre-built
+// image ref instead of building one. The image is pulled if it is not
+// available locally, with the progress of the pull written to logs.
+func (db *DockerBackend) CreateFromImage(name string, ref string, threads int, envs map[string]string, logs io.Writer) (manager.Handler, error) {
+
+	_, _, err := db.client.ImageInspectWithRaw(context.Background(), ref)
+
+	if client.IsErrNotFound(err) {
+		err = db.pullImage(ref, logs)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return db.createTagged(name, "", ref, threads, envs)
+}
+
+// createTagged creates a handler for function name that runs the local image
+// ref, which is tagged with the handler's unique name for that.
+func (db *DockerBackend) createTagged(name string, env string, ref string, threads int, envs map[string]string) (manager.Handler, error) {
+	dh, err := db.newHandler(name, env, threads)
+	if err != nil {
+		return nil, err
+	}
+
+	// give the image the name the handler uses for its containers
+	// docker tag <ref> <image>
+	err = db.client.ImageTag(context.Background(), ref, dh.uniqueName)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("tagged image", ref, "as", dh.uniqueName)
+
+	err = dh.setup(envs)
+	if err != nil {
+		// pulled or loaded images are not labelled, so the garbage collector
+		// would not find the tag
+		_, err2 := db.client.ImageRemove(context.Background(), dh.uniqueName, image.RemoveOptions{})
+		if err2 != nil {
+			log.Printf("error removing image %s: %s", dh.uniqueName, err2)
+		}
+
+		return nil, err
+	}
+
+	return dh, nil
+}
+
+// pullImage pulls image ref from its registry and writes its progress to
+// logs.
+func (db *DockerBackend) pullImage(ref string, logs io.Writer) error {
+	log.Println("pulling image", ref)
+
+	fmt.Fprintln(logs, "pulling image", ref)
+
+	// docker pull <ref>
+	r, err := db.client.ImagePull(context.Background(), ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	// errors during the pull are only reported in the stream of messages
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var m jsonmessage.JSONMessage
+
+		err = dec.Decode(&m)
+		if err != nil {
+			return err
+		}
+
+		if m.Error != nil {
+			return m.Error
+		}
+
+		log.Println(m.ID, m.Status)
+
+		// progress bars are left out, they change too often
+		if m.Progress == nil {
+			fmt.Fprintln(logs, strings.TrimSpace(m.ID+" "+m.Status))
+		}
+	}
+
+	log.Println("pulled image", ref)
+
+	return nil
+}
@@ -6,11 +6,16 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
 )
 
 func main() {
-	port := ":8000"
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000"
+	}
+	addr := os.Getenv("HOST") + ":" + port
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -49,7 +54,7 @@ func main() {
 	})
 
 	log.Printf("Server listening on port %s\n", port)
-	err := http.ListenAndServe(port, nil)
+	err := http.ListenAndServe(addr, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -59,7 +59,7 @@ func main() {
 	})
 
 	log.Printf("Server starting on port %s\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(os.Getenv("HOST")+":"+port, nil); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
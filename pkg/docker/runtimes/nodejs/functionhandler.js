@@ -16,4 +16,4 @@ app.all("/health", (req, res) => {
   return res.send("OK");
 });
 app.all("/fn", handler);
-app.listen(8000);
+app.listen(process.env.PORT || 8000, process.env.HOST);
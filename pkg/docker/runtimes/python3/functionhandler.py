@@ -2,6 +2,7 @@
 
 import typing
 import http.server
+import os
 import socketserver
 
 if __name__ == "__main__":
@@ -50,5 +51,9 @@ if __name__ == "__main__":
                 self.wfile.write(str(e).encode("utf-8"))
                 return
 
-    with socketserver.ThreadingTCPServer(("", 8000), tinyFaaSFNHandler) as httpd:
+    port = int(os.environ.get("PORT", "8000"))
+    # an empty host binds to every address
+    host = os.environ.get("HOST", "")
+
+    with socketserver.ThreadingTCPServer((host, port), tinyFaaSFNHandler) as httpd:
         httpd.serve_forever()
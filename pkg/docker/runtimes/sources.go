@@ -0,0 +1,10 @@
+// Package runtimes holds the function handlers of the tinyFaaS runtimes.
+package runtimes
+
+import "embed"
+
+// Sources contains the function handler of each runtime, for backends that
+// run them without building a container image first.
+//
+//go:embed python3/functionhandler.py nodejs/functionhandler.js nodejs/package.json go/functionhandler.go binary/functionhandler.go
+var Sources embed.FS
@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+// Describe returns the image that the containers of dh run.
+func (dh *dockerHandler) Describe() manager.HandlerInfo {
+	return manager.HandlerInfo{
+		Backend: "docker",
+		Image:   dh.uniqueName,
+	}
+}
+
+// Status inspects the containers of dh.
+func (dh *dockerHandler) Status() ([]manager.ReplicaStatus, error) {
+	dh.mu.Lock()
+	containers := make([]string, len(dh.containers))
+	copy(containers, dh.containers)
+	ips := make([]string, len(dh.handlerIPs))
+	copy(ips, dh.handlerIPs)
+	dh.mu.Unlock()
+
+	replicas := make([]manager.ReplicaStatus, 0, len(containers))
+
+	for i, c := range containers {
+		var r manager.ReplicaStatus
+
+		// a container that is still being started has no IP yet
+		if i < len(ips) {
+			r.IP = ips[i]
+		}
+
+		// docker inspect <container>
+		ci, err := dh.client.ContainerInspect(context.Background(), c)
+		if err != nil {
+			return nil, err
+		}
+
+		r.ID = strings.TrimPrefix(ci.Name, "/")
+
+		if ci.State != nil {
+			r.State = ci.State.Status
+
+			if t, err := time.Parse(time.RFC3339Nano, ci.State.StartedAt); err == nil && !t.IsZero() {
+				r.Started = &t
+			}
+		}
+
+		replicas = append(replicas, r)
+	}
+
+	return replicas, nil
+}
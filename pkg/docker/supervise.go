@@ -0,0 +1,268 @@
+package docker
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+const (
+	// restartDelay is how long to wait before restarting a crashed container
+	// for the first time. The delay doubles with every failed attempt, up to
+	// maxRestartDelay.
+	restartDelay    = 1 * time.Second
+	maxRestartDelay = 30 * time.Second
+	// reconcileInterval is how often to look for exited containers whose
+	// die event we missed, e.g., while reconnecting to the event stream.
+	reconcileInterval = 30 * time.Second
+)
+
+// watch follows the Docker events of the containers of this tinyFaaS instance
+// and restarts the containers of live handlers that exit.
+func (db *DockerBackend) watch() {
+	f := filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", string(events.ActionDie)),
+		filters.Arg("label", "tinyFaaS="+db.tinyFaaSID),
+	)
+
+	for {
+		// docker events --filter type=container --filter event=die --filter label=tinyFaaS=<id>
+		msgs, errs := db.client.Events(context.Background(), events.ListOptions{
+			Filters: f,
+		})
+
+	loop:
+		for {
+			select {
+			case m := <-msgs:
+				exitCode, err := strconv.Atoi(m.Actor.Attributes["exitCode"])
+				if err != nil {
+					exitCode = -1
+				}
+
+				db.containerDied(m.Actor.ID, exitCode)
+			case err := <-errs:
+				log.Printf("error watching container events: %s", err)
+				break loop
+			}
+		}
+
+		time.Sleep(restartDelay)
+	}
+}
+
+// reconcile periodically lists the exited containers of this tinyFaaS
+// instance and treats them as if their die event had been received.
+func (db *DockerBackend) reconcile() {
+	f := filters.NewArgs(
+		filters.Arg("label", "tinyFaaS="+db.tinyFaaSID),
+		filters.Arg("status", "exited"),
+		filters.Arg("status", "dead"),
+	)
+
+	for {
+		time.Sleep(reconcileInterval)
+
+		// docker ps -a --filter label=tinyFaaS=<id> --filter status=exited --filter status=dead
+		containers, err := db.client.ContainerList(context.Background(), container.ListOptions{
+			All:     true,
+			Filters: f,
+		})
+		if err != nil {
+			log.Printf("error listing exited containers: %s", err)
+			continue
+		}
+
+		for _, c := range containers {
+			exitCode := -1
+
+			// docker inspect <container>
+			ci, err := db.client.ContainerInspect(context.Background(), c.ID)
+			if err == nil && ci.State != nil {
+				exitCode = ci.State.ExitCode
+			}
+
+			db.containerDied(c.ID, exitCode)
+		}
+	}
+}
+
+// containerDied restarts container c if it belongs to a live handler.
+// Containers that are removed on purpose have already been taken out of their
+// handler at this point.
+func (db *DockerBackend) containerDied(c string, exitCode int) {
+	db.hl.Lock()
+	defer db.hl.Unlock()
+
+	for _, dh := range db.handlers {
+		dh.mu.Lock()
+		owned := dh.index(c) >= 0
+		_, restarting := dh.restarting[c]
+		if owned && !restarting {
+			dh.restarting[c] = struct{}{}
+		}
+		dh.mu.Unlock()
+
+		if !owned {
+			continue
+		}
+
+		log.Printf("container %s of function %s exited with code %d", c, dh.name, exitCode)
+
+		// a container that crashes again while we restart it is taken care
+		// of by the restart that is already in progress
+		if !restarting {
+			go dh.restartContainer(c, exitCode)
+		}
+
+		return
+	}
+}
+
+// index returns the position of container c in the handler's list of
+// containers, or -1 if it is not part of the handler (anymore). The caller
+// must hold dh.mu.
+func (dh *dockerHandler) index(c string) int {
+	for i, hc := range dh.containers {
+		if hc == c {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// restartContainer starts crashed container c again. If that fails, the
+// container is replaced with a new one. Attempts are repeated until the
+// container is running or it is no longer part of the handler.
+func (dh *dockerHandler) restartContainer(c string, exitCode int) {
+	delay := restartDelay
+
+	for {
+		time.Sleep(delay)
+
+		var done bool
+		var err error
+
+		c, done, err = dh.tryRestart(c, exitCode)
+		if done {
+			dh.mu.Lock()
+			delete(dh.restarting, c)
+			dh.mu.Unlock()
+			return
+		}
+
+		log.Printf("error restarting container %s: %s, retrying in %s", c, err, delay)
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// tryRestart makes a single attempt at restarting container c. It returns the
+// container to try again with and whether there is nothing left to do. The
+// handler is only locked to look up and update its containers, not while
+// starting them.
+func (dh *dockerHandler) tryRestart(c string, exitCode int) (string, bool, error) {
+	dh.mu.Lock()
+	owned := dh.index(c) >= 0
+	dh.mu.Unlock()
+
+	if !owned {
+		// removed while we were waiting
+		return c, true, nil
+	}
+
+	n := c
+
+	ip, err := dh.startContainer(c)
+	if err != nil {
+		// the container may be broken beyond repair, replace it
+		dh.mu.Lock()
+		name := dh.nextName()
+		dh.mu.Unlock()
+
+		n, err = dh.createContainer(name)
+		if err != nil {
+			return c, false, err
+		}
+
+		ip, err = dh.startContainer(n)
+	}
+
+	if err == nil {
+		err = dh.waitReady(n, ip)
+	}
+
+	if err != nil {
+		// try again with the old container, which is still in its place
+		if n != c {
+			dh.removeContainer(n)
+		}
+		return c, false, err
+	}
+
+	dh.mu.Lock()
+
+	i := dh.index(c)
+	if i < 0 {
+		// removed while we were restarting it
+		dh.mu.Unlock()
+		if n != c {
+			dh.removeContainer(n)
+		}
+		return c, true, nil
+	}
+
+	dh.containers[i] = n
+
+	// handlerIPs is only filled in once the handler has started
+	if i < len(dh.handlerIPs) {
+		dh.handlerIPs[i] = ip
+	}
+
+	dh.restarts.Count++
+	dh.restarts.LastExitCode = exitCode
+	dh.restarts.LastRestart = time.Now()
+
+	changed := dh.changed
+
+	dh.mu.Unlock()
+
+	if n != c {
+		// the old container is no longer part of the handler
+		dh.removeContainer(c)
+	}
+
+	log.Printf("restarted container %s of function %s as %s with ip %s", c, dh.name, n, ip)
+
+	if changed != nil {
+		changed()
+	}
+
+	return c, true, nil
+}
+
+func (dh *dockerHandler) Supervise(changed func()) {
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	dh.changed = changed
+}
+
+func (dh *dockerHandler) Restarts() manager.Restarts {
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	return dh.restarts
+}
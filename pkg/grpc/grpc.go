@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 
 	"github.com/OpenFogStack/tinyFaaS/pkg/grpc/tinyfaas"
 	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 // GRPCServer is the grpc endpoint for this tinyFaaS instance.
@@ -36,7 +40,22 @@ func (gs *GRPCServer) Request(ctx context.Context, d *tinyfaas.Data) (*tinyfaas.
 		log.Print("failed to extract metadata from context, using empty headers GRPC request")
 	}
 
-	s, res := gs.r.Call(d.FunctionIdentifier, []byte(d.Data), false, headers)
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+
+	if wait, ok := gs.r.Allow(d.FunctionIdentifier, client, headers); !ok {
+		// like Retry-After in HTTP
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(rproxy.RetryAfter(wait))))
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit of function %s exceeded", d.FunctionIdentifier)
+	}
+
+	// the deadline of the client applies to the function, too
+	s, res := gs.r.Call(ctx, d.FunctionIdentifier, []byte(d.Data), false, headers)
 
 	switch s {
 	case rproxy.StatusOK:
@@ -48,7 +67,20 @@ func (gs *GRPCServer) Request(ctx context.Context, d *tinyfaas.Data) (*tinyfaas.
 	case rproxy.StatusNotFound:
 		return nil, fmt.Errorf("function %s not found", d.FunctionIdentifier)
 	case rproxy.StatusError:
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
 		return nil, fmt.Errorf("error calling function %s", d.FunctionIdentifier)
+	case rproxy.StatusUnauthorized:
+		return nil, status.Errorf(codes.Unauthenticated, "no valid credentials for function %s", d.FunctionIdentifier)
+	case rproxy.StatusForbidden:
+		return nil, status.Errorf(codes.PermissionDenied, "access to function %s denied", d.FunctionIdentifier)
+	case rproxy.StatusOverloaded:
+		return nil, status.Errorf(codes.Unavailable, "function %s is overloaded", d.FunctionIdentifier)
+	case rproxy.StatusTimeout:
+		return nil, status.Errorf(codes.DeadlineExceeded, "function %s timed out", d.FunctionIdentifier)
+	case rproxy.StatusCircuitOpen:
+		return nil, status.Errorf(codes.Unavailable, "circuit of function %s is open", d.FunctionIdentifier)
 	}
 	return &tinyfaas.Response{
 		Response: string(res),
@@ -1,9 +1,14 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
 )
@@ -23,6 +28,40 @@ func Start(r *rproxy.RProxy, listenAddr string) {
 
 		log.Printf("have request for path: %s (async: %v)", p, async)
 
+		headers := make(map[string]string)
+		for k, v := range req.Header {
+			headers[k] = v[0]
+		}
+
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+
+		// reject before reading the body
+		if wait, ok := r.Allow(p, client, headers); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(rproxy.RetryAfter(wait)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		// the request is cancelled if the client disconnects or its timeout
+		// passes
+		ctx := req.Context()
+
+		if v := req.Header.Get(rproxy.TimeoutHeader); v != "" {
+			timeout, err := rproxy.ParseTimeout(v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				log.Print(err)
+				return
+			}
+
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
 		req_body, err := io.ReadAll(req.Body)
 
 		if err != nil {
@@ -31,23 +70,65 @@ func Start(r *rproxy.RProxy, listenAddr string) {
 			return
 		}
 
-		headers := make(map[string]string)
-		for k, v := range req.Header {
-			headers[k] = v[0]
-		}
-
-		s, res := r.Call(p, req_body, async, headers)
+		s, res := r.Call(ctx, p, req_body, async, headers)
 
 		switch s {
 		case rproxy.StatusOK:
 			w.WriteHeader(http.StatusOK)
 			w.Write(res)
 		case rproxy.StatusAccepted:
+			// the client polls for the result of the invocation
+			w.Header().Set("Location", rproxy.InvocationPath+string(res))
+			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(struct {
+				ID     string `json:"id"`
+				Status string `json:"status"`
+			}{string(res), rproxy.InvocationQueued})
 		case rproxy.StatusNotFound:
 			w.WriteHeader(http.StatusNotFound)
 		case rproxy.StatusError:
 			w.WriteHeader(http.StatusInternalServerError)
+		case rproxy.StatusUnauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+		case rproxy.StatusForbidden:
+			w.WriteHeader(http.StatusForbidden)
+		case rproxy.StatusOverloaded:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case rproxy.StatusTimeout:
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case rproxy.StatusCircuitOpen:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	// function names are alphanumeric, so this cannot shadow a function
+	mux.HandleFunc(rproxy.InvocationPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(req.URL.Path, rproxy.InvocationPath)
+
+		headers := make(map[string]string)
+		for k, v := range req.Header {
+			headers[k] = v[0]
+		}
+
+		inv, s := r.Invocation(id, headers)
+
+		switch s {
+		case rproxy.StatusOK:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(inv)
+		case rproxy.StatusNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		case rproxy.StatusUnauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+		case rproxy.StatusForbidden:
+			w.WriteHeader(http.StatusForbidden)
 		}
 	})
 
@@ -0,0 +1,302 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
+)
+
+const (
+	// AutoscaleInterval is how often the autoscaler checks the load of
+	// functions.
+	AutoscaleInterval = 1 * time.Second
+	// ScaleDownDelay is how long a function must have needed fewer replicas
+	// before the autoscaler removes some.
+	ScaleDownDelay = 30 * time.Second
+	// TargetInFlight is the number of concurrent requests per replica the
+	// autoscaler aims for.
+	TargetInFlight = 1
+)
+
+// autoscaler periodically adjusts the number of replicas of functions with
+// different minimum and maximum replicas, based on the number of in-flight
+// requests the rproxy reports. Functions with an idle timeout are scaled to
+// zero once they have not been called for that long, and are woken up again
+// by the rproxy when a request arrives.
+type autoscaler struct {
+	ms       *ManagementService
+	lastBusy map[string]time.Time
+	scaling  map[string]bool
+	mu       sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newAutoscaler(ms *ManagementService) *autoscaler {
+	return &autoscaler{
+		ms:       ms,
+		lastBusy: make(map[string]time.Time),
+		scaling:  make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+}
+
+// StartAutoscaler starts scaling functions in the background. This should be
+// called once the rproxy is up.
+func (ms *ManagementService) StartAutoscaler() {
+	go ms.autoscaler.run()
+}
+
+func (a *autoscaler) run() {
+	t := time.NewTicker(AutoscaleInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-t.C:
+			a.check()
+		}
+	}
+}
+
+func (a *autoscaler) stop() {
+	a.once.Do(func() {
+		close(a.done)
+	})
+}
+
+func (a *autoscaler) check() {
+	stats, err := a.ms.rproxyStats()
+	if err != nil {
+		log.Println("autoscaler: error getting stats from rproxy:", err)
+		return
+	}
+
+	type candidate struct {
+		f  Function
+		fh Handler
+	}
+
+	a.ms.functionHandlersMutex.Lock()
+	candidates := make([]candidate, 0, len(a.ms.functions))
+	for name, f := range a.ms.functions {
+		if !f.autoscaled() {
+			continue
+		}
+		candidates = append(candidates, candidate{f: f, fh: a.ms.functionHandlers[name]})
+	}
+	a.ms.functionHandlersMutex.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]struct{}, len(candidates))
+
+	for _, c := range candidates {
+		name := c.f.Name
+		seen[name] = struct{}{}
+
+		if a.scaling[name] {
+			continue
+		}
+
+		st, ok := stats[name]
+		if !ok {
+			// not yet known to the rproxy, still being deployed
+			continue
+		}
+
+		current := len(c.fh.IPs())
+
+		min := c.f.MinReplicas
+		if c.f.IdleTimeout > 0 && min < 1 {
+			// scaling to zero is up to the idle timeout
+			min = 1
+		}
+
+		desired := replicasFor(st.InFlight, min, c.f.MaxReplicas)
+		idle := c.f.IdleTimeout > 0 && st.InFlight == 0 && now.Sub(st.LastRequest) >= time.Duration(c.f.IdleTimeout)*time.Second
+
+		if idle {
+			desired = 0
+		}
+
+		if _, ok := a.lastBusy[name]; !ok || desired >= current {
+			a.lastBusy[name] = now
+		}
+
+		if desired == current {
+			continue
+		}
+
+		if !idle && desired < current && now.Sub(a.lastBusy[name]) < ScaleDownDelay {
+			continue
+		}
+
+		a.scaling[name] = true
+
+		go func(name string, fh Handler, current int, desired int) {
+			log.Printf("autoscaler: scaling function %s from %d to %d replicas", name, current, desired)
+
+			err := a.ms.scaleFunction(name, fh, desired)
+			if err != nil {
+				log.Printf("autoscaler: error scaling function %s: %s", name, err)
+			}
+
+			a.mu.Lock()
+			delete(a.scaling, name)
+			a.lastBusy[name] = time.Now()
+			a.mu.Unlock()
+		}(name, c.fh, current, desired)
+	}
+
+	// forget about deleted functions
+	for name := range a.lastBusy {
+		if _, ok := seen[name]; !ok {
+			delete(a.lastBusy, name)
+		}
+	}
+}
+
+// Wake starts a function that has been scaled to zero. This is called by the
+// rproxy when a request for such a function arrives.
+func (ms *ManagementService) Wake(name string) error {
+	ms.functionHandlersMutex.Lock()
+	f, ok := ms.functions[name]
+	fh := ms.functionHandlers[name]
+	ms.functionHandlersMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("function %s %w", name, ErrNotFound)
+	}
+
+	return ms.autoscaler.wake(f, fh)
+}
+
+func (a *autoscaler) wake(f Function, fh Handler) error {
+	name := f.Name
+
+	a.mu.Lock()
+	if a.scaling[name] {
+		// already on it
+		a.mu.Unlock()
+		return nil
+	}
+
+	if len(fh.IPs()) > 0 {
+		a.mu.Unlock()
+		return nil
+	}
+
+	a.scaling[name] = true
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		delete(a.scaling, name)
+		a.lastBusy[name] = time.Now()
+		a.mu.Unlock()
+	}()
+
+	replicas := f.MinReplicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	log.Printf("autoscaler: waking function %s with %d replicas", name, replicas)
+
+	return a.ms.scaleFunction(name, fh, replicas)
+}
+
+// replicasFor returns how many replicas are needed for the given number of
+// in-flight requests.
+func replicasFor(inflight int64, min int, max int) int {
+	n := int((inflight + TargetInFlight - 1) / TargetInFlight)
+
+	if n < min {
+		n = min
+	}
+
+	if n > max {
+		n = max
+	}
+
+	return n
+}
+
+// scaleFunction changes the number of replicas of handler fh of function
+// name. The rproxy stops sending requests to replicas before they are removed
+// and learns about new replicas once they are ready.
+func (ms *ManagementService) scaleFunction(name string, fh Handler, replicas int) error {
+	s, ok := fh.(Scaler)
+	if !ok {
+		return fmt.Errorf("handler of function %s cannot be scaled", name)
+	}
+
+	ips := fh.IPs()
+
+	if replicas < len(ips) {
+		err := ms.updateRProxyIfCurrent(name, fh, ips[:replicas])
+		if err != nil {
+			return err
+		}
+
+		return s.Scale(replicas)
+	}
+
+	err := s.Scale(replicas)
+	if err != nil {
+		return err
+	}
+
+	return ms.updateRProxyIfCurrent(name, fh, fh.IPs())
+}
+
+// updateRProxyIfCurrent updates the rproxy only if fh is still the handler of
+// function name, i.e., it has not been deleted or replaced in the meantime.
+func (ms *ManagementService) updateRProxyIfCurrent(name string, fh Handler, ips []string) error {
+	ms.rproxyMutex.Lock()
+	defer ms.rproxyMutex.Unlock()
+
+	ms.functionHandlersMutex.Lock()
+
+	if current, ok := ms.functionHandlers[name]; !ok || current != fh {
+		ms.functionHandlersMutex.Unlock()
+		return fmt.Errorf("function %s changed while scaling", name)
+	}
+
+	s := ms.rproxyState(ms.functions[name])
+
+	ms.functionHandlersMutex.Unlock()
+
+	return ms.updateRProxy(s, ips)
+}
+
+// rproxyStats asks the rproxy about the current load of all functions.
+func (ms *ManagementService) rproxyStats() (map[string]rproxy.Stats, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/stats", ms.rproxyConfigAddress, ms.rproxyConfigPort))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
+	}
+
+	var stats map[string]rproxy.Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,223 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/util"
+)
+
+// DefaultCacheSize is how many images the build cache keeps by default.
+const DefaultCacheSize = 10
+
+// ImageCache is implemented by backends that can keep the images they build
+// and reuse them for functions with the same source and runtime. Images are
+// identified by a digest that the manager computes.
+type ImageCache interface {
+	// RuntimeDigest identifies the runtime of env, so that images are built
+	// again when the runtime changes.
+	RuntimeDigest(env string) (string, error)
+	// CreateCached works like Create, but reuses the image cached under
+	// digest if there is one, which is reported by hit. Otherwise, the image
+	// it builds is cached.
+	CreateCached(digest string, name string, env string, threads int, filedir string, envs map[string]string, logs io.Writer) (fh Handler, hit bool, err error)
+	// CachedImages lists all cached images.
+	CachedImages() ([]CachedImage, error)
+	// RemoveCachedImage removes the image cached under digest. Functions
+	// that currently use the image are not affected.
+	RemoveCachedImage(digest string) error
+}
+
+// CachedImage is an image in the build cache. Hits counts how often it was
+// reused since the management service started.
+type CachedImage struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Hits     int       `json:"hits"`
+}
+
+type cacheUsage struct {
+	lastUsed time.Time
+	hits     int
+}
+
+// buildCache keeps track of which cached images were used recently and
+// evicts the least recently used ones once there are more than size.
+type buildCache struct {
+	backend ImageCache
+	size    int
+	usage   map[string]*cacheUsage
+	mu      sync.Mutex
+}
+
+func newBuildCache(backend ImageCache, size int) *buildCache {
+	return &buildCache{
+		backend: backend,
+		size:    size,
+		usage:   make(map[string]*cacheUsage),
+	}
+}
+
+// digest hashes the function source at filedir together with the runtime
+// env it is built for.
+func (c *buildCache) digest(env string, filedir string) (string, error) {
+	runtime, err := c.backend.RuntimeDigest(env)
+	if err != nil {
+		return "", err
+	}
+
+	source, err := util.HashDir(filedir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %s %s", env, runtime, source)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// create creates a handler for function f from the source at filedir,
+// reusing a cached image if possible. Build output is written to logs.
+func (c *buildCache) create(f Function, filedir string, logs io.Writer) (Handler, error) {
+	digest, err := c.digest(f.Env, filedir)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("function", f.Name, "has build digest", digest)
+
+	fh, hit, err := c.backend.CreateCached(digest, f.Name, f.Env, f.Threads, filedir, f.Envs, logs)
+	if err != nil {
+		return nil, err
+	}
+
+	if hit {
+		log.Println("reused cached image", digest, "for function", f.Name)
+	}
+
+	c.mu.Lock()
+	u, ok := c.usage[digest]
+	if !ok {
+		u = &cacheUsage{}
+		c.usage[digest] = u
+	}
+	if hit {
+		u.hits++
+	}
+	u.lastUsed = time.Now()
+	c.mu.Unlock()
+
+	err = c.evict()
+	if err != nil {
+		log.Println("error evicting images from build cache", err)
+	}
+
+	return fh, nil
+}
+
+// list returns all cached images, most recently used first. Images that have
+// not been used since the management service started count as last used when
+// they were built.
+func (c *buildCache) list() ([]CachedImage, error) {
+	images, err := c.backend.CachedImages()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for i := range images {
+		images[i].LastUsed = images[i].Created
+		if u, ok := c.usage[images[i].Digest]; ok {
+			images[i].LastUsed = u.lastUsed
+			images[i].Hits = u.hits
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].LastUsed.After(images[j].LastUsed)
+	})
+
+	return images, nil
+}
+
+// evict removes the least recently used images until at most size are left.
+func (c *buildCache) evict() error {
+	images, err := c.list()
+	if err != nil {
+		return err
+	}
+
+	if len(images) <= c.size {
+		return nil
+	}
+
+	for _, i := range images[c.size:] {
+		log.Println("evicting image", i.Digest, "from build cache")
+
+		err = c.remove(i.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove removes the image cached under digest.
+func (c *buildCache) remove(digest string) error {
+	err := c.backend.RemoveCachedImage(digest)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.usage, digest)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Cache lists the images in the build cache, most recently used first.
+func (ms *ManagementService) Cache() ([]CachedImage, error) {
+	if ms.cache == nil {
+		return nil, fmt.Errorf("backend does not cache images")
+	}
+
+	return ms.cache.list()
+}
+
+// PruneCache removes the image cached under digest from the build cache, or
+// all cached images if digest is empty. Running functions keep their images.
+func (ms *ManagementService) PruneCache(digest string) error {
+	if ms.cache == nil {
+		return fmt.Errorf("backend does not cache images")
+	}
+
+	if digest != "" {
+		return ms.cache.remove(digest)
+	}
+
+	images, err := ms.cache.list()
+	if err != nil {
+		return err
+	}
+
+	for _, i := range images {
+		err = ms.cache.remove(i.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
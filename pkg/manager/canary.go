@@ -0,0 +1,398 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
+	"github.com/OpenFogStack/tinyFaaS/pkg/util"
+)
+
+const (
+	// CanaryGroup is the rproxy group of the handlers of a canary.
+	CanaryGroup = "canary"
+
+	DefaultCanaryStep         = 10
+	DefaultCanaryInterval     = 30
+	DefaultCanaryMaxErrorRate = 0.05
+)
+
+// Canary configures a gradual rollout of a new version of a function. The new
+// version starts out with Step percent of requests, which grows by another
+// Step percent every Interval seconds until it receives all requests and
+// replaces the old version. If more than MaxErrorRate of the requests to the
+// new version fail during a step, the new version is removed again. Without
+// a MaxErrorRate, DefaultCanaryMaxErrorRate applies, while a MaxErrorRate of
+// 0 removes the new version on its first error.
+type Canary struct {
+	Step         int      `json:"step"`
+	Interval     int      `json:"interval"`
+	MaxErrorRate *float64 `json:"max_error_rate"`
+}
+
+// validate checks the configuration of c and fills in defaults.
+func (c *Canary) validate() error {
+	if c.Step == 0 {
+		c.Step = DefaultCanaryStep
+	}
+
+	if c.Interval == 0 {
+		c.Interval = DefaultCanaryInterval
+	}
+
+	if c.MaxErrorRate == nil {
+		rate := DefaultCanaryMaxErrorRate
+		c.MaxErrorRate = &rate
+	}
+
+	if c.Step < 1 || c.Step > 100 {
+		return fmt.Errorf("invalid canary step %d", c.Step)
+	}
+
+	if c.Interval < 1 {
+		return fmt.Errorf("invalid canary interval %d", c.Interval)
+	}
+
+	if *c.MaxErrorRate < 0 || *c.MaxErrorRate > 1 {
+		return fmt.Errorf("invalid canary error rate %f", *c.MaxErrorRate)
+	}
+
+	return nil
+}
+
+// canary is a new version of a function that is being rolled out next to the
+// current version.
+type canary struct {
+	f  Function
+	fh Handler
+	// zipPath is a copy of the archive of f that is stored in the registry
+	// once the canary replaces the current version
+	zipPath string
+	// weight is the percentage of requests the canary receives
+	weight int
+	done   chan struct{}
+	once   sync.Once
+}
+
+// startCanary starts the archive at zipPath as a canary of the existing
+// function f. The canary is rolled out in the background, d only follows
+// starting it.
+func (ms *ManagementService) startCanary(d *deployment, f Function, zipPath string) error {
+	name := f.Name
+
+	fh, err := ms.startHandler(d, f, zipPath)
+	if err != nil {
+		return err
+	}
+
+	uuid, err := uuid.NewRandom()
+	if err != nil {
+		ms.destroyHandler(name, fh)
+		return err
+	}
+
+	c := &canary{
+		f:       f,
+		fh:      fh,
+		zipPath: path.Join(TmpDir, uuid.String()+".zip"),
+		weight:  f.Canary.Step,
+		done:    make(chan struct{}),
+	}
+
+	err = util.CopyFileAtomic(zipPath, c.zipPath)
+	if err != nil {
+		ms.destroyHandler(name, fh)
+		ms.endCanary(c)
+		return err
+	}
+
+	ms.rproxyMutex.Lock()
+	ms.functionHandlersMutex.Lock()
+
+	current, ok := ms.functionHandlers[name]
+	if !ok {
+		ms.functionHandlersMutex.Unlock()
+		ms.rproxyMutex.Unlock()
+		ms.destroyHandler(name, fh)
+		ms.endCanary(c)
+		return fmt.Errorf("function %s %w", name, ErrNotFound)
+	}
+
+	// a new canary replaces any previous one
+	old := ms.takeCanary(name)
+	ms.canaries[name] = c
+
+	s := ms.rproxyState(ms.functions[name])
+
+	ms.functionHandlersMutex.Unlock()
+
+	d.setPhase(PhaseRouting)
+
+	err = ms.updateRProxy(s, current.IPs())
+	if err != nil {
+		ms.functionHandlersMutex.Lock()
+		delete(ms.canaries, name)
+		if old != nil {
+			ms.canaries[name] = old
+		}
+		ms.functionHandlersMutex.Unlock()
+		ms.rproxyMutex.Unlock()
+
+		ms.destroyHandler(name, fh)
+		ms.endCanary(c)
+		return err
+	}
+
+	ms.rproxyMutex.Unlock()
+
+	log.Printf("started canary of function %s with %d%% of requests", name, c.weight)
+
+	if old != nil {
+		ms.drainCanary(name, old)
+	}
+
+	go ms.runCanary(c)
+
+	return nil
+}
+
+// runCanary shifts requests to canary c step by step, as long as it does not
+// fail too many requests.
+func (ms *ManagementService) runCanary(c *canary) {
+	name := c.f.Name
+
+	t := time.NewTicker(time.Duration(c.f.Canary.Interval) * time.Second)
+	defer t.Stop()
+
+	var last rproxy.GroupStats
+
+	stats, err := ms.rproxyStats()
+	if err == nil {
+		last = stats[name].Groups[CanaryGroup]
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		stats, err := ms.rproxyStats()
+		if err != nil {
+			log.Println("error getting stats of canary of function", name, err)
+			continue
+		}
+
+		g := stats[name].Groups[CanaryGroup]
+		requests := g.Requests - last.Requests
+		errors := g.Errors - last.Errors
+		last = g
+
+		if requests > 0 && float64(errors)/float64(requests) > *c.f.Canary.MaxErrorRate {
+			log.Printf("canary of function %s failed %d of %d requests, rolling back", name, errors, requests)
+			ms.abortCanary(c)
+			return
+		}
+
+		ms.rproxyMutex.Lock()
+		ms.functionHandlersMutex.Lock()
+
+		if ms.canaries[name] != c {
+			// replaced or deleted in the meantime
+			ms.functionHandlersMutex.Unlock()
+			ms.rproxyMutex.Unlock()
+			return
+		}
+
+		if c.weight+c.f.Canary.Step >= 100 {
+			ms.functionHandlersMutex.Unlock()
+			ms.rproxyMutex.Unlock()
+			ms.promoteCanary(c)
+			return
+		}
+
+		c.weight += c.f.Canary.Step
+
+		s := ms.rproxyState(ms.functions[name])
+		current := ms.functionHandlers[name]
+
+		ms.functionHandlersMutex.Unlock()
+
+		err = ms.updateRProxy(s, current.IPs())
+
+		ms.rproxyMutex.Unlock()
+
+		if err != nil {
+			log.Println("error updating rproxy for canary of function", name, err)
+			continue
+		}
+
+		log.Printf("canary of function %s now receives %d%% of requests", name, c.weight)
+	}
+}
+
+// abortCanary removes canary c and sends all requests to the current version
+// of the function again.
+func (ms *ManagementService) abortCanary(c *canary) {
+	name := c.f.Name
+
+	ms.rproxyMutex.Lock()
+	ms.functionHandlersMutex.Lock()
+
+	if ms.canaries[name] != c {
+		ms.functionHandlersMutex.Unlock()
+		ms.rproxyMutex.Unlock()
+		return
+	}
+
+	ms.takeCanary(name)
+
+	s := ms.rproxyState(ms.functions[name])
+	current := ms.functionHandlers[name]
+
+	ms.functionHandlersMutex.Unlock()
+
+	err := ms.updateRProxy(s, current.IPs())
+
+	ms.rproxyMutex.Unlock()
+
+	if err != nil {
+		log.Println("error removing canary of function", name, "from rproxy", err)
+	}
+
+	ms.drainCanary(name, c)
+}
+
+// promoteCanary makes canary c the current version of the function.
+func (ms *ManagementService) promoteCanary(c *canary) {
+	name := c.f.Name
+
+	ms.rproxyMutex.Lock()
+	ms.functionHandlersMutex.Lock()
+
+	if ms.canaries[name] != c {
+		ms.functionHandlersMutex.Unlock()
+		ms.rproxyMutex.Unlock()
+		return
+	}
+
+	ms.takeCanary(name)
+
+	oldHandler := ms.functionHandlers[name]
+	oldFunction := ms.functions[name]
+
+	ms.functionHandlers[name] = c.fh
+	ms.functions[name] = c.f
+
+	ms.functionHandlersMutex.Unlock()
+
+	// neither version has a canary anymore
+	err := ms.updateRProxy(rproxyState{f: c.f}, c.fh.IPs())
+	if err != nil {
+		ms.functionHandlersMutex.Lock()
+		ms.functionHandlers[name] = oldHandler
+		ms.functions[name] = oldFunction
+		ms.functionHandlersMutex.Unlock()
+
+		err2 := ms.updateRProxy(rproxyState{f: oldFunction}, oldHandler.IPs())
+		ms.rproxyMutex.Unlock()
+
+		log.Println("error promoting canary of function", name, err, err2)
+
+		ms.drainCanary(name, c)
+		return
+	}
+
+	ms.rproxyMutex.Unlock()
+
+	log.Println("canary of function", name, "is now the current version")
+
+	err = ms.drain(name, DrainTimeout)
+	if err != nil {
+		log.Println("error draining old version of function", name, err)
+	}
+
+	ms.destroyHandler(name, oldHandler)
+
+	if ms.registry != nil {
+		err = ms.registry.Put(c.f, c.zipPath)
+		if err != nil {
+			// the function is running, it just won't survive a restart
+			log.Println("error persisting function", name, err)
+		}
+	}
+
+	ms.endCanary(c)
+}
+
+// takeCanary removes the canary of function name, if any, and returns it.
+// Requests are only sent to the current version of the function again once
+// the rproxy has been updated. The caller must hold
+// ms.functionHandlersMutex.
+func (ms *ManagementService) takeCanary(name string) *canary {
+	c, ok := ms.canaries[name]
+	if !ok {
+		return nil
+	}
+
+	delete(ms.canaries, name)
+
+	return c
+}
+
+// drainCanary waits for the requests to canary c to finish and destroys it.
+func (ms *ManagementService) drainCanary(name string, c *canary) {
+	err := ms.drain(name, DrainTimeout)
+	if err != nil {
+		log.Println("error draining canary of function", name, err)
+	}
+
+	ms.destroyHandler(name, c.fh)
+	ms.endCanary(c)
+}
+
+// endCanary stops rolling out canary c and removes its copy of the archive.
+// Its handler is left alone.
+func (ms *ManagementService) endCanary(c *canary) {
+	c.once.Do(func() {
+		close(c.done)
+	})
+
+	err := os.Remove(c.zipPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("error removing zip", c.zipPath, err)
+	}
+}
+
+// handlerChanged updates the rproxy after the replicas of handler fh of
+// function name have changed, e.g., because one of them was restarted.
+func (ms *ManagementService) handlerChanged(name string, fh Handler) error {
+	ms.rproxyMutex.Lock()
+	defer ms.rproxyMutex.Unlock()
+
+	ms.functionHandlersMutex.Lock()
+
+	current, ok := ms.functionHandlers[name]
+	if !ok {
+		ms.functionHandlersMutex.Unlock()
+		return fmt.Errorf("function %s %w", name, ErrNotFound)
+	}
+
+	if c, ok := ms.canaries[name]; current != fh && (!ok || c.fh != fh) {
+		ms.functionHandlersMutex.Unlock()
+		return fmt.Errorf("handler of function %s is no longer in use", name)
+	}
+
+	s := ms.rproxyState(ms.functions[name])
+
+	ms.functionHandlersMutex.Unlock()
+
+	return ms.updateRProxy(s, current.IPs())
+}
@@ -0,0 +1,48 @@
+package manager
+
+import "testing"
+
+func TestCanaryValidate(t *testing.T) {
+	rate := func(r float64) *float64 {
+		return &r
+	}
+
+	tests := map[string]struct {
+		canary Canary
+		rate   float64
+		err    bool
+	}{
+		"defaults":          {canary: Canary{}, rate: DefaultCanaryMaxErrorRate},
+		"any error aborts":  {canary: Canary{MaxErrorRate: rate(0)}, rate: 0},
+		"custom rate":       {canary: Canary{MaxErrorRate: rate(0.5)}, rate: 0.5},
+		"no errors abort":   {canary: Canary{MaxErrorRate: rate(1)}, rate: 1},
+		"negative rate":     {canary: Canary{MaxErrorRate: rate(-0.1)}, err: true},
+		"rate above 1":      {canary: Canary{MaxErrorRate: rate(1.5)}, err: true},
+		"step above 100":    {canary: Canary{Step: 101}, err: true},
+		"negative step":     {canary: Canary{Step: -1}, err: true},
+		"negative interval": {canary: Canary{Interval: -1}, err: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := tc.canary
+
+			err := c.validate()
+
+			if tc.err {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *c.MaxErrorRate != tc.rate {
+				t.Errorf("got max error rate %f, want %f", *c.MaxErrorRate, tc.rate)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
+)
+
+// waitHealthy blocks until the health endpoints of all handlers at ips
+// report to be ready or the timeout expires.
+func waitHealthy(ips []string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for _, ip := range ips {
+		for {
+			err := checkHealth(client, ip)
+			if err == nil {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("handler %s not healthy after %s: %w", ip, timeout, err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	return nil
+}
+
+// checkHealth asks the health endpoint of the handler at ip once whether it
+// is ready.
+func checkHealth(client *http.Client, ip string) error {
+	addr := ip
+	if _, _, err := net.SplitHostPort(ip); err != nil {
+		addr = net.JoinHostPort(ip, rproxy.DefaultHandlerPort)
+	}
+
+	resp, err := client.Get("http://" + addr + "/health")
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// drain blocks until the rproxy has no more requests in flight to handlers
+// that were removed from function name, or the timeout expires.
+func (ms *ManagementService) drain(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	logged := false
+
+	for {
+		stats, err := ms.rproxyStats()
+		if err != nil {
+			return err
+		}
+
+		s, ok := stats[name]
+		if !ok || s.Draining == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d requests to function %s still in flight after %s", s.Draining, name, timeout)
+		}
+
+		if !logged {
+			log.Printf("waiting for %d requests to old version of function %s", s.Draining, name)
+			logged = true
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,235 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Phases of a deployment, in the order they are passed through.
+const (
+	PhaseUnpacking      = "unpacking"
+	PhaseBuilding       = "building"
+	PhaseStarting       = "starting"
+	PhaseHealthChecking = "health-checking"
+	PhaseRouting        = "routing"
+	PhaseDone           = "done"
+)
+
+// States of a deployment.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+const (
+	// MaxDeploymentLogLines is how many lines of build output are kept per
+	// deployment, older lines are dropped.
+	MaxDeploymentLogLines = 1000
+	// MaxDeployments is how many finished deployments are kept.
+	MaxDeployments = 100
+)
+
+// Deployment describes the progress of deploying a function. Logs has the
+// output of building the function, Result the URLs of the function once it
+// has been deployed.
+type Deployment struct {
+	ID       string     `json:"id"`
+	Function string     `json:"function"`
+	Phase    string     `json:"phase"`
+	Status   string     `json:"status"`
+	Logs     []string   `json:"logs,omitempty"`
+	Result   string     `json:"result,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// deployment tracks a Deployment while it is running. It is an io.Writer
+// that backends write build output to.
+type deployment struct {
+	d   Deployment
+	buf []byte
+	mu  sync.Mutex
+}
+
+// newDeployment starts tracking a deployment of function name.
+func (ms *ManagementService) newDeployment(name string) *deployment {
+	d := &deployment{
+		d: Deployment{
+			ID:       uuid.New().String(),
+			Function: name,
+			Phase:    PhaseUnpacking,
+			Status:   StatusRunning,
+			Created:  time.Now(),
+		},
+	}
+
+	ms.deploymentsMutex.Lock()
+	defer ms.deploymentsMutex.Unlock()
+
+	ms.deployments[d.d.ID] = d
+
+	// forget the oldest finished deployments
+	finished := make([]*deployment, 0, len(ms.deployments))
+	for _, o := range ms.deployments {
+		if o.done() {
+			finished = append(finished, o)
+		}
+	}
+
+	if len(finished) > MaxDeployments {
+		// Created never changes, so it can be read without the lock
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].d.Created.Before(finished[j].d.Created)
+		})
+
+		for _, o := range finished[:len(finished)-MaxDeployments] {
+			delete(ms.deployments, o.d.ID)
+		}
+	}
+
+	return d
+}
+
+// setPhase moves d on to phase p.
+func (d *deployment) setPhase(p string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.d.Phase = p
+}
+
+// Write adds build output to the logs of d, line by line.
+func (d *deployment) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.buf = append(d.buf, p...)
+
+	for {
+		i := bytes.IndexByte(d.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		d.addLine(string(d.buf[:i]))
+		d.buf = d.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// addLine adds a line to the logs of d. The caller must hold d.mu.
+func (d *deployment) addLine(l string) {
+	d.d.Logs = append(d.d.Logs, l)
+
+	if len(d.d.Logs) > MaxDeploymentLogLines {
+		d.d.Logs = d.d.Logs[len(d.d.Logs)-MaxDeploymentLogLines:]
+	}
+}
+
+// finish marks d as done with result res or as failed with err.
+func (d *deployment) finish(res string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.buf) > 0 {
+		d.addLine(string(d.buf))
+		d.buf = nil
+	}
+
+	now := time.Now()
+	d.d.Finished = &now
+
+	if err != nil {
+		d.d.Status = StatusFailed
+		d.d.Error = err.Error()
+		return
+	}
+
+	d.d.Phase = PhaseDone
+	d.d.Status = StatusSucceeded
+	d.d.Result = res
+}
+
+// done reports whether d has finished.
+func (d *deployment) done() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.d.Status != StatusRunning
+}
+
+// snapshot returns the current state of d.
+func (d *deployment) snapshot() Deployment {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.d
+	s.Logs = append([]string(nil), d.d.Logs...)
+
+	return s
+}
+
+// Deployment returns the state of the deployment with the given id.
+func (ms *ManagementService) Deployment(id string) (Deployment, error) {
+	ms.deploymentsMutex.Lock()
+	d, ok := ms.deployments[id]
+	ms.deploymentsMutex.Unlock()
+
+	if !ok {
+		return Deployment{}, fmt.Errorf("deployment %s %w", id, ErrNotFound)
+	}
+
+	return d.snapshot(), nil
+}
+
+// Deployments lists all running and recent deployments, newest first. Their
+// logs are left out.
+func (ms *ManagementService) Deployments() []Deployment {
+	ms.deploymentsMutex.Lock()
+	defer ms.deploymentsMutex.Unlock()
+
+	deployments := make([]Deployment, 0, len(ms.deployments))
+	for _, d := range ms.deployments {
+		s := d.snapshot()
+		s.Logs = nil
+		deployments = append(deployments, s)
+	}
+
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Created.After(deployments[j].Created)
+	})
+
+	return deployments
+}
+
+// lastDeployment returns the most recent deployment of function name, without
+// its logs.
+func (ms *ManagementService) lastDeployment(name string) (Deployment, bool) {
+	ms.deploymentsMutex.Lock()
+	defer ms.deploymentsMutex.Unlock()
+
+	var last Deployment
+	found := false
+
+	for _, d := range ms.deployments {
+		s := d.snapshot()
+		if s.Function != name || (found && !s.Created.After(last.Created)) {
+			continue
+		}
+
+		last = s
+		found = true
+	}
+
+	last.Logs = nil
+
+	return last, found
+}
@@ -0,0 +1,270 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
+)
+
+var (
+	// ErrNotFound is returned for functions and deployments that do not
+	// exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidFunction is returned for functions with an invalid name or
+	// configuration.
+	ErrInvalidFunction = errors.New("invalid function")
+)
+
+// States of a function.
+const (
+	// FunctionReady functions have replicas that serve requests.
+	FunctionReady = "ready"
+	// FunctionScaledToZero functions have no replicas, the next request
+	// starts one.
+	FunctionScaledToZero = "scaled-to-zero"
+)
+
+// Health of a function or of a single replica.
+const (
+	HealthHealthy = "healthy"
+	// HealthDegraded functions have some replicas that are not healthy.
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+	// HealthUnknown functions have no replicas to ask.
+	HealthUnknown = "unknown"
+)
+
+// HealthCheckTimeout is how long a replica has to answer a health check.
+const HealthCheckTimeout = 2 * time.Second
+
+// FunctionInfo describes a deployed function. Only the keys of its
+// environment variables are given, as their values may be secret.
+type FunctionInfo struct {
+	Name        string            `json:"name"`
+	Env         string            `json:"env,omitempty"`
+	Image       string            `json:"image,omitempty"`
+	Status      string            `json:"status"`
+	Replicas    int               `json:"replicas"`
+	MinReplicas int               `json:"min_replicas"`
+	MaxReplicas int               `json:"max_replicas"`
+	IPs         []string          `json:"ips"`
+	Envs        []string          `json:"envs"`
+	URLs        map[string]string `json:"urls"`
+	Created     time.Time         `json:"created"`
+	// CanaryWeight is the percentage of requests that a new version that is
+	// being rolled out receives, 0 if there is none
+	CanaryWeight int `json:"canary_weight,omitempty"`
+	// Auth is the type of the access policy of the function, if any
+	Auth      string            `json:"auth,omitempty"`
+	RateLimit *rproxy.RateLimit `json:"rate_limit,omitempty"`
+}
+
+// Function describes the deployed function name.
+func (ms *ManagementService) Function(name string) (FunctionInfo, error) {
+	ms.functionHandlersMutex.Lock()
+
+	fh, ok := ms.functionHandlers[name]
+	if !ok {
+		ms.functionHandlersMutex.Unlock()
+		return FunctionInfo{}, fmt.Errorf("function %s %w", name, ErrNotFound)
+	}
+
+	s := ms.rproxyState(ms.functions[name])
+
+	ms.functionHandlersMutex.Unlock()
+
+	return ms.info(s, fh), nil
+}
+
+// Functions describes all deployed functions, sorted by name.
+func (ms *ManagementService) Functions() []FunctionInfo {
+	type function struct {
+		s  rproxyState
+		fh Handler
+	}
+
+	ms.functionHandlersMutex.Lock()
+	snapshot := make([]function, 0, len(ms.functionHandlers))
+	for name, fh := range ms.functionHandlers {
+		snapshot = append(snapshot, function{ms.rproxyState(ms.functions[name]), fh})
+	}
+	ms.functionHandlersMutex.Unlock()
+
+	functions := make([]FunctionInfo, 0, len(snapshot))
+	for _, f := range snapshot {
+		functions = append(functions, ms.info(f.s, f.fh))
+	}
+
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name < functions[j].Name
+	})
+
+	return functions
+}
+
+// info describes function s.f with handler fh. The handler is asked for its
+// IPs, so the caller must not hold ms.functionHandlersMutex.
+func (ms *ManagementService) info(s rproxyState, fh Handler) FunctionInfo {
+	f := s.f
+	ips := fh.IPs()
+
+	i := FunctionInfo{
+		Name:        f.Name,
+		Env:         f.Env,
+		Image:       f.Image,
+		Status:      FunctionReady,
+		Replicas:    len(ips),
+		MinReplicas: f.MinReplicas,
+		MaxReplicas: f.MaxReplicas,
+		IPs:         append([]string{}, ips...),
+		Envs:        make([]string, 0, len(f.Envs)),
+		URLs:        make(map[string]string, len(ms.rproxyPort)),
+		Created:     f.Created,
+	}
+
+	if len(ips) == 0 {
+		i.Status = FunctionScaledToZero
+	}
+
+	for k := range f.Envs {
+		i.Envs = append(i.Envs, k)
+	}
+	sort.Strings(i.Envs)
+
+	for prot, port := range ms.rproxyPort {
+		i.URLs[prot] = fmt.Sprintf("%s://%s:%d/%s", prot, ms.rproxyListenAddress, port, f.Name)
+	}
+
+	if s.canary != nil {
+		i.CanaryWeight = s.canaryWeight
+	}
+
+	if f.Auth != nil {
+		i.Auth = f.Auth.Type
+	}
+
+	i.RateLimit = f.RateLimit
+
+	return i
+}
+
+// FunctionStatus describes a function in detail, down to its replicas.
+// Health is checked when the status is requested. LastDeployment is the most
+// recent deployment of the function that the management service knows of,
+// without its logs.
+type FunctionStatus struct {
+	FunctionInfo
+	Health         string          `json:"health"`
+	Handler        *HandlerInfo    `json:"handler,omitempty"`
+	Instances      []ReplicaStatus `json:"instances"`
+	Restarts       *Restarts       `json:"restarts,omitempty"`
+	LastDeployment *Deployment     `json:"last_deployment,omitempty"`
+}
+
+// FunctionStatus describes the deployed function name in detail. Its
+// replicas are asked for their health, which may take up to
+// HealthCheckTimeout.
+func (ms *ManagementService) FunctionStatus(name string) (FunctionStatus, error) {
+	ms.functionHandlersMutex.Lock()
+
+	fh, ok := ms.functionHandlers[name]
+	if !ok {
+		ms.functionHandlersMutex.Unlock()
+		return FunctionStatus{}, fmt.Errorf("function %s %w", name, ErrNotFound)
+	}
+
+	rs := ms.rproxyState(ms.functions[name])
+
+	ms.functionHandlersMutex.Unlock()
+
+	s := FunctionStatus{
+		FunctionInfo: ms.info(rs, fh),
+	}
+
+	// the backend may take a while to answer, so the handler is asked
+	// without holding the lock
+	if d, ok := fh.(Describer); ok {
+		h := d.Describe()
+		s.Handler = &h
+
+		replicas, err := d.Status()
+		if err != nil {
+			log.Println("error getting status of function", name, err)
+		}
+		s.Instances = replicas
+	}
+
+	if s.Instances == nil {
+		s.Instances = make([]ReplicaStatus, 0, len(s.IPs))
+		for _, ip := range s.IPs {
+			s.Instances = append(s.Instances, ReplicaStatus{IP: ip})
+		}
+	}
+
+	if sv, ok := fh.(Supervisor); ok {
+		r := sv.Restarts()
+		s.Restarts = &r
+	}
+
+	s.Health = checkReplicas(s.Instances)
+
+	if d, ok := ms.lastDeployment(name); ok {
+		s.LastDeployment = &d
+	}
+
+	return s, nil
+}
+
+// checkReplicas checks the health of all replicas at once and returns the
+// health of the function.
+func checkReplicas(replicas []ReplicaStatus) string {
+	client := &http.Client{
+		Timeout: HealthCheckTimeout,
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range replicas {
+		replicas[i].Health = HealthUnhealthy
+
+		if replicas[i].IP == "" {
+			// not started yet
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *ReplicaStatus) {
+			defer wg.Done()
+
+			if checkHealth(client, r.IP) == nil {
+				r.Health = HealthHealthy
+			}
+		}(&replicas[i])
+	}
+
+	wg.Wait()
+
+	healthy := 0
+	for _, r := range replicas {
+		if r.Health == HealthHealthy {
+			healthy++
+		}
+	}
+
+	switch {
+	case len(replicas) == 0:
+		return HealthUnknown
+	case healthy == len(replicas):
+		return HealthHealthy
+	case healthy > 0:
+		return HealthDegraded
+	default:
+		return HealthUnhealthy
+	}
+}
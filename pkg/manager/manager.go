@@ -11,28 +11,58 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/OpenFogStack/tinyFaaS/pkg/rproxy"
 	"github.com/OpenFogStack/tinyFaaS/pkg/util"
 	"github.com/google/uuid"
 )
 
 const (
 	TmpDir = "./tmp"
+	// CutoverTimeout is how long the replicas of a new version of a function
+	// have to become healthy before the deployment is aborted.
+	CutoverTimeout = 10 * time.Second
+	// DrainTimeout is how long requests to the old version of a function may
+	// take to finish after the new version has been deployed.
+	DrainTimeout = 30 * time.Second
 )
 
 type ManagementService struct {
 	id                    string
 	backend               Backend
+	registry              Registry
 	functionHandlers      map[string]Handler
+	functions             map[string]Function
 	functionHandlersMutex sync.Mutex
-	rproxyListenAddress   string
-	rproxyPort            map[string]int
-	rproxyConfigPort      int
+	// rproxyMutex keeps updates of the rproxy in order. It is taken before
+	// functionHandlersMutex, which is never held while talking to handlers
+	// or the rproxy.
+	rproxyMutex         sync.Mutex
+	rproxyListenAddress string
+	rproxyPort          map[string]int
+	// rproxyConfigAddress is where the configuration endpoint of the rproxy
+	// listens, which is not reachable from the network
+	rproxyConfigAddress string
+	rproxyConfigPort    int
+	autoscaler          *autoscaler
+	// canaries are new versions of functions that are being rolled out,
+	// guarded by functionHandlersMutex
+	canaries map[string]*canary
+	// cache reuses images for unchanged functions, nil if the backend does
+	// not support that or caching is disabled
+	cache *buildCache
+	// deployments are running and recently finished deployments by ID
+	deployments      map[string]*deployment
+	deploymentsMutex sync.Mutex
 }
 
+// Backend creates handlers for functions. Any output of building a function,
+// e.g., of installing its dependencies, is written to logs.
 type Backend interface {
-	Create(name string, env string, threads int, filedir string, envs map[string]string) (Handler, error)
+	Create(name string, env string, threads int, filedir string, envs map[string]string, logs io.Writer) (Handler, error)
 	Stop() error
 }
 
@@ -43,159 +73,584 @@ type Handler interface {
 	Logs() (io.Reader, error)
 }
 
-func New(id string, rproxyListenAddress string, rproxyPort map[string]int, rproxyConfigPort int, tfBackend Backend) *ManagementService {
+// Scaler is implemented by handlers that can change their number of replicas
+// while running. When scaling down, replicas are removed from the end of
+// IPs().
+type Scaler interface {
+	Scale(replicas int) error
+}
+
+// ImageBackend is implemented by backends that can run pre-built images
+// instead of building them from the source of a function. Such an image must
+// serve the function just like the tinyFaaS runtimes, i.e., with /fn and
+// /health endpoints on port 8000.
+type ImageBackend interface {
+	// LoadImage loads the image tarball at p, e.g., the output of docker
+	// save, and returns a reference to the image.
+	LoadImage(p string, logs io.Writer) (string, error)
+	// CreateFromImage creates a handler that runs image, which is pulled
+	// first if necessary.
+	CreateFromImage(name string, image string, threads int, envs map[string]string, logs io.Writer) (Handler, error)
+}
+
+// Supervisor is implemented by handlers that restart replicas that crashed.
+// Once a crashed replica is running again, changed is called so that the
+// rproxy can learn about its new IP.
+type Supervisor interface {
+	Supervise(changed func())
+	Restarts() Restarts
+}
+
+// Describer is implemented by handlers that can tell what they run and how
+// each of their replicas is doing, e.g., to diagnose a function without
+// access to the backend.
+type Describer interface {
+	Describe() HandlerInfo
+	// Status lists the replicas of the handler, in the same order as IPs().
+	Status() ([]ReplicaStatus, error)
+}
+
+// HandlerInfo describes what a handler runs: the image of its containers
+// or the command of its processes.
+type HandlerInfo struct {
+	Backend string   `json:"backend"`
+	Image   string   `json:"image,omitempty"`
+	Command []string `json:"command,omitempty"`
+}
+
+// ReplicaStatus is the state of a single replica as reported by the backend,
+// e.g., "running" or "exited". Health is filled in by the management service.
+type ReplicaStatus struct {
+	ID      string     `json:"id,omitempty"`
+	IP      string     `json:"ip"`
+	State   string     `json:"state,omitempty"`
+	Started *time.Time `json:"started,omitempty"`
+	Health  string     `json:"health"`
+}
+
+// Restarts counts how often the replicas of a handler were restarted after
+// they crashed.
+type Restarts struct {
+	Count        int       `json:"restarts"`
+	LastExitCode int       `json:"last_exit_code"`
+	LastRestart  time.Time `json:"last_restart"`
+}
+
+// Function is everything we need to know to deploy a function again, e.g.,
+// after the management service has been restarted.
+type Function struct {
+	Name          string            `json:"name"`
+	Env           string            `json:"env"`
+	Threads       int               `json:"threads"`
+	MinReplicas   int               `json:"min_replicas"`
+	MaxReplicas   int               `json:"max_replicas"`
+	IdleTimeout   int               `json:"idle_timeout"`
+	Envs          map[string]string `json:"envs"`
+	SubfolderPath string            `json:"subfolder_path"`
+	Created       time.Time         `json:"created"`
+	Version       int               `json:"version"`
+	// Image, if set, is a pre-built image that is run instead of building
+	// the function from its source
+	Image string `json:"image,omitempty"`
+	// Canary, if set, rolls out new versions of the function gradually
+	Canary *Canary `json:"canary,omitempty"`
+	// how the rproxy handles requests to this function
+	rproxy.Config
+}
+
+// validate checks the configuration of f and fills in defaults. If neither
+// minimum nor maximum replicas are set, the function is not autoscaled and
+// keeps Threads replicas. Otherwise, Threads is the initial number of
+// replicas.
+func (f *Function) validate() error {
+	if f.MinReplicas == 0 && f.MaxReplicas == 0 {
+		f.MinReplicas = f.Threads
+		f.MaxReplicas = f.Threads
+	}
+
+	if f.MinReplicas < 0 || f.MaxReplicas < 1 || f.MinReplicas > f.MaxReplicas {
+		return fmt.Errorf("invalid replicas for function %s: min %d, max %d", f.Name, f.MinReplicas, f.MaxReplicas)
+	}
+
+	if f.Threads < f.MinReplicas {
+		f.Threads = f.MinReplicas
+	}
+
+	if f.Threads > f.MaxReplicas {
+		f.Threads = f.MaxReplicas
+	}
+
+	if f.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle timeout for function %s: %d", f.Name, f.IdleTimeout)
+	}
+
+	_, err := rproxy.NewBalancer(f.Balancer, f.BalancerHeader)
+	if err != nil {
+		return fmt.Errorf("invalid balancer for function %s: %w", f.Name, err)
+	}
+
+	if f.Canary != nil {
+		err = f.Canary.validate()
+		if err != nil {
+			return fmt.Errorf("invalid canary for function %s: %w", f.Name, err)
+		}
+	}
+
+	if f.Auth != nil {
+		// API keys are only stored as hashes
+		f.Auth.HashKeys()
+
+		err = f.Auth.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid auth for function %s: %w", f.Name, err)
+		}
+	}
+
+	err = f.Config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid limits for function %s: %w", f.Name, err)
+	}
+
+	if f.RateLimit != nil {
+		err = f.RateLimit.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid rate limit for function %s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// autoscaled returns whether the number of replicas of f may change.
+func (f *Function) autoscaled() bool {
+	return f.MinReplicas != f.MaxReplicas || f.IdleTimeout > 0
+}
+
+// Registry persists deployed functions along with their source archive.
+// A nil Registry means functions are only kept in memory.
+type Registry interface {
+	// Put stores f as a new version of the function and assigns its
+	// Version.
+	Put(f Function, archivePath string) error
+	// Get returns the current version of a function.
+	Get(name string) (Function, string, error)
+	// GetVersion returns a previous version of a function.
+	GetVersion(name string, version int) (Function, string, error)
+	// Versions returns all stored versions of a function, newest first.
+	Versions(name string) ([]Function, error)
+	Delete(name string) error
+	List() ([]Function, error)
+}
+
+func New(id string, rproxyListenAddress string, rproxyPort map[string]int, rproxyConfigAddress string, rproxyConfigPort int, tfBackend Backend, tfRegistry Registry, cacheSize int) *ManagementService {
 
 	ms := &ManagementService{
 		id:                  id,
 		backend:             tfBackend,
+		registry:            tfRegistry,
 		functionHandlers:    make(map[string]Handler),
+		functions:           make(map[string]Function),
+		canaries:            make(map[string]*canary),
+		deployments:         make(map[string]*deployment),
 		rproxyListenAddress: rproxyListenAddress,
 		rproxyPort:          rproxyPort,
+		rproxyConfigAddress: rproxyConfigAddress,
 		rproxyConfigPort:    rproxyConfigPort,
 	}
 
+	ms.autoscaler = newAutoscaler(ms)
+
+	if ic, ok := tfBackend.(ImageCache); ok && cacheSize > 0 {
+		ms.cache = newBuildCache(ic, cacheSize)
+	}
+
 	return ms
 }
 
-func (ms *ManagementService) createFunction(name string, env string, threads int, funczip []byte, subfolderPath string, envs map[string]string) (string, error) {
+// createFunction deploys function f from the archive read from funczip. The
+// archive is written to a temporary file as it is read, so that it never has
+// to be held in memory as a whole. If async is set, createFunction returns
+// once the archive has been received and the function is deployed in the
+// background, otherwise it waits for the deployment to finish.
+func (ms *ManagementService) createFunction(f Function, funczip io.Reader, async bool) (Deployment, error) {
+
+	name := f.Name
 
 	// only allow alphanumeric characters
 	if !util.IsAlphaNumeric(name) {
-		return "", fmt.Errorf("function name %s contains non-alphanumeric characters", name)
+		return Deployment{}, fmt.Errorf("%w: function name %s contains non-alphanumeric characters", ErrInvalidFunction, name)
 	}
 
-	// make a uuidv4 for the function
-	uuid, err := uuid.NewRandom()
+	err := f.validate()
 	if err != nil {
-		return "", err
+		return Deployment{}, fmt.Errorf("%w: %w", ErrInvalidFunction, err)
 	}
 
-	log.Println("creating function", name, "with uuid", uuid.String())
+	d := ms.newDeployment(name)
 
-	// create a new function handler
+	zipPath, err := receiveZip(funczip)
+	if err != nil {
+		d.finish("", err)
+		return d.snapshot(), err
+	}
 
-	p := path.Join(TmpDir, uuid.String())
+	deploy := func() (string, error) {
+		defer func() {
+			err := os.Remove(zipPath)
+			if err != nil {
+				log.Println("error removing zip", zipPath, err)
+			}
 
-	err = os.MkdirAll(p, 0777)
+			log.Println("removed zip", zipPath)
+		}()
+
+		f.Created = time.Now()
+
+		ms.functionHandlersMutex.Lock()
+		_, exists := ms.functionHandlers[name]
+		ms.functionHandlersMutex.Unlock()
+
+		// the canary is stored in the registry once it replaces the current
+		// version
+		if f.Canary != nil && exists {
+			err := ms.startCanary(d, f, zipPath)
+			if err != nil {
+				return "", err
+			}
+
+			return ms.urls(name), nil
+		}
+
+		err := ms.deployFunction(d, f, zipPath)
+
+		if err != nil {
+			return "", err
+		}
 
+		if ms.registry != nil {
+			err = ms.registry.Put(f, zipPath)
+			if err != nil {
+				// the function is running, it just won't survive a restart
+				log.Println("error persisting function", name, err)
+			}
+		}
+
+		return ms.urls(name), nil
+	}
+
+	if async {
+		go func() {
+			res, err := deploy()
+			if err != nil {
+				log.Println("error deploying function", name, err)
+			}
+			d.finish(res, err)
+		}()
+
+		return d.snapshot(), nil
+	}
+
+	res, err := deploy()
+	d.finish(res, err)
+
+	return d.snapshot(), err
+}
+
+// receiveZip writes the archive read from r to a new file in TmpDir and
+// returns its path.
+func receiveZip(r io.Reader) (string, error) {
+	// make a uuidv4 for the function
+	uuid, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
 
-	log.Println("created folder", p)
+	err = os.MkdirAll(TmpDir, 0777)
+
+	if err != nil {
+		return "", err
+	}
 
 	// write zip to file
 	zipPath := path.Join(TmpDir, uuid.String()+".zip")
-	err = os.WriteFile(zipPath, funczip, 0777)
+	zipFile, err := os.OpenFile(zipPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0777)
 
 	if err != nil {
 		return "", err
 	}
 
-	err = util.Unzip(zipPath, p)
+	n, err := io.Copy(zipFile, r)
+	if err2 := zipFile.Close(); err == nil {
+		err = err2
+	}
 
 	if err != nil {
+		os.Remove(zipPath)
 		return "", err
 	}
 
-	defer func() {
-		// remove folder
-		err = os.RemoveAll(p)
-		if err != nil {
-			log.Println("error removing folder", p, err)
-		}
+	log.Println("received zip", zipPath, "with", n, "bytes")
 
-		err = os.Remove(zipPath)
-		if err != nil {
-			log.Println("error removing zip", zipPath, err)
-		}
-
-		log.Println("removed folder", p)
-		log.Println("removed zip", zipPath)
-	}()
+	return zipPath, nil
+}
 
-	if subfolderPath != "" {
-		p = path.Join(p, subfolderPath)
+// urls lists where function name can be called, one URL per line.
+func (ms *ManagementService) urls(name string) string {
+	r := ""
+	for prot, port := range ms.rproxyPort {
+		r += fmt.Sprintf("%s://%s:%d/%s\n", prot, ms.rproxyListenAddress, port, name)
 	}
 
-	// if function already exists, keep it while deploying the new version
-	var oldHandler Handler
-	if existingHandler, ok := ms.functionHandlers[name]; ok {
-		oldHandler = existingHandler
+	return r
+}
+
+// deployFunction unpacks the archive at zipPath and deploys it as function f,
+// replacing any existing version of f. The new version is only switched to
+// once all of its replicas are healthy, and the old version is only destroyed
+// after requests to it have finished. If anything goes wrong before the
+// switch, the old version keeps serving requests. Progress is reported to d.
+func (ms *ManagementService) deployFunction(d *deployment, f Function, zipPath string) error {
+
+	name := f.Name
+
+	fh, err := ms.startHandler(d, f, zipPath)
+	if err != nil {
+		return err
 	}
 
-	// create new function handler
+	d.setPhase(PhaseRouting)
+
+	ms.rproxyMutex.Lock()
 	ms.functionHandlersMutex.Lock()
-	defer ms.functionHandlersMutex.Unlock()
 
-	fh, err := ms.backend.Create(name, env, threads, p, envs)
+	oldHandler, hadOld := ms.functionHandlers[name]
+	oldFunction := ms.functions[name]
+
+	ms.functionHandlers[name] = fh
+	ms.functions[name] = f
+
+	// a full deployment replaces any canary of the function
+	c := ms.takeCanary(name)
+
+	s := ms.rproxyState(f)
 
+	ms.functionHandlersMutex.Unlock()
+
+	// tell rproxy about the new function, this switches all new requests
+	// to the new version at once
+	err = ms.updateRProxy(s, fh.IPs())
 	if err != nil {
-		return "", err
+		ms.functionHandlersMutex.Lock()
+		if hadOld {
+			ms.functionHandlers[name] = oldHandler
+			ms.functions[name] = oldFunction
+		} else {
+			delete(ms.functionHandlers, name)
+			delete(ms.functions, name)
+		}
+		if c != nil {
+			ms.canaries[name] = c
+		}
+		ms.functionHandlersMutex.Unlock()
+		ms.rproxyMutex.Unlock()
+
+		ms.destroyHandler(name, fh)
+		return err
 	}
 
-	ms.functionHandlers[name] = fh
+	ms.rproxyMutex.Unlock()
 
-	err = ms.functionHandlers[name].Start()
+	if !hadOld {
+		return nil
+	}
 
+	// let the old version finish its requests before destroying it
+	err = ms.drain(name, DrainTimeout)
 	if err != nil {
-		// container did not start properly...
-		return "", err
+		log.Println("error draining old version of function", name, err)
 	}
 
-	// tell rproxy about the new function
-	// curl -X POST http://localhost:80/add -d '{"name": "<name>", "ips": ["<ip1>", "<ip2>"]}'
-	d := struct {
-		FunctionName string   `json:"name"`
-		FunctionIPs  []string `json:"ips"`
-	}{
-		FunctionName: name,
-		FunctionIPs:  fh.IPs(),
+	// the new version is live, so anything that is left of the old one is
+	// only logged
+	ms.destroyHandler(name, oldHandler)
+
+	if c != nil {
+		ms.destroyHandler(name, c.fh)
+		ms.endCanary(c)
 	}
 
-	b, err := json.Marshal(d)
+	return nil
+}
+
+// startHandler unpacks the archive at zipPath and starts a new handler for
+// function f. The handler is only returned once all of its replicas are
+// healthy, otherwise it is destroyed. Any existing version of the function
+// keeps running in the meantime.
+func (ms *ManagementService) startHandler(d *deployment, f Function, zipPath string) (Handler, error) {
+
+	name := f.Name
+
+	fh, err := ms.createHandler(d, f, zipPath)
+
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	log.Println("telling rproxy about new function", name, "with ips", fh.IPs(), ":", d)
+	if _, ok := fh.(Scaler); f.autoscaled() && !ok {
+		fh.Destroy()
+		return nil, fmt.Errorf("backend does not support autoscaling function %s", name)
+	}
 
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d", ms.rproxyListenAddress, ms.rproxyConfigPort), "application/json", bytes.NewBuffer(b))
-	if err != nil && !errors.Is(err, io.EOF) {
-		log.Println("error telling rproxy about new function", name, err)
-		return "", err
+	if s, ok := fh.(Supervisor); ok {
+		s.Supervise(func() {
+			err := ms.handlerChanged(name, fh)
+			if err != nil {
+				log.Println("error updating rproxy after restart of function", name, err)
+			}
+		})
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
+	d.setPhase(PhaseStarting)
+
+	err = fh.Start()
+
+	if err == nil {
+		d.setPhase(PhaseHealthChecking)
+		err = waitHealthy(fh.IPs(), CutoverTimeout)
 	}
 
-	defer resp.Body.Close()
+	if err != nil {
+		// container did not start properly...
+		log.Println("new version of function", name, "is not healthy, keeping the old version", err)
+		ms.destroyHandler(name, fh)
+		return nil, err
+	}
 
-	r, err := io.ReadAll(resp.Body)
+	return fh, nil
+}
+
+// createHandler creates a handler for function f, either from its source in
+// the archive at zipPath or from an image. The image is f.Image if set, or
+// the archive itself if it is an image tarball.
+func (ms *ManagementService) createHandler(d *deployment, f Function, zipPath string) (Handler, error) {
+
+	name := f.Name
+
+	d.setPhase(PhaseUnpacking)
+
+	format := util.FormatUnknown
+
+	if f.Image == "" {
+		// detecting an image may mean reading the whole archive, so this is
+		// only done once
+		var err error
+		format, err = util.DetectArchive(zipPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f.Image != "" || format == util.FormatImage {
+		ib, ok := ms.backend.(ImageBackend)
+		if !ok {
+			return nil, fmt.Errorf("backend does not support images for function %s", name)
+		}
+
+		d.setPhase(PhaseBuilding)
+
+		image := f.Image
+
+		if image == "" {
+			var err error
+			image, err = ib.LoadImage(zipPath, d)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		log.Println("creating function", name, "from image", image)
+
+		return ib.CreateFromImage(name, image, f.Threads, f.Envs, d)
+	}
+
+	// make a uuidv4 for the function
+	uuid, err := uuid.NewRandom()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	log.Println("rproxy response:", string(r))
+	log.Println("creating function", name, "with uuid", uuid.String())
+
+	// create a new function handler
+
+	p := path.Join(TmpDir, uuid.String())
+
+	err = os.MkdirAll(p, 0777)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("created folder", p)
 
-	// destroy the old handler if it exists
-	if oldHandler != nil {
-		err = oldHandler.Destroy()
+	defer func() {
+		// remove folder
+		err := os.RemoveAll(p)
 		if err != nil {
-			return "", err
+			log.Println("error removing folder", p, err)
 		}
+
+		log.Println("removed folder", p)
+	}()
+
+	err = util.Extract(zipPath, format, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.SubfolderPath != "" {
+		p = path.Join(p, f.SubfolderPath)
+	}
+
+	d.setPhase(PhaseBuilding)
+
+	if ms.cache != nil {
+		return ms.cache.create(f, p, d)
 	}
 
-	return name, nil
+	// create new function handler
+	return ms.backend.Create(name, f.Env, f.Threads, p, f.Envs, d)
+}
+
+// destroyHandler destroys handler fh of function name and logs any error.
+func (ms *ManagementService) destroyHandler(name string, fh Handler) {
+	err := fh.Destroy()
+	if err != nil {
+		log.Println("error destroying handler of function", name, err)
+	}
+}
+
+// handlers returns a snapshot of the handlers of all functions, so that slow
+// handler methods can be called without holding functionHandlersMutex.
+func (ms *ManagementService) handlers() map[string]Handler {
+	ms.functionHandlersMutex.Lock()
+	defer ms.functionHandlersMutex.Unlock()
+
+	handlers := make(map[string]Handler, len(ms.functionHandlers))
+	for name, fh := range ms.functionHandlers {
+		handlers[name] = fh
+	}
+
+	return handlers
 }
 
 func (ms *ManagementService) Logs() (io.Reader, error) {
 
 	var logs bytes.Buffer
 
-	for name := range ms.functionHandlers {
-		l, err := ms.LogsFunction(name)
+	for _, fh := range ms.handlers() {
+		l, err := fh.Logs()
 		if err != nil {
 			return nil, err
 		}
@@ -213,15 +668,21 @@ func (ms *ManagementService) Logs() (io.Reader, error) {
 
 func (ms *ManagementService) LogsFunction(name string) (io.Reader, error) {
 
+	ms.functionHandlersMutex.Lock()
 	fh, ok := ms.functionHandlers[name]
+	ms.functionHandlersMutex.Unlock()
+
 	if !ok {
-		return nil, fmt.Errorf("function %s not found", name)
+		return nil, fmt.Errorf("function %s %w", name, ErrNotFound)
 	}
 
 	return fh.Logs()
 }
 
 func (ms *ManagementService) List() []string {
+	ms.functionHandlersMutex.Lock()
+	defer ms.functionHandlersMutex.Unlock()
+
 	list := make([]string, 0, len(ms.functionHandlers))
 	for name := range ms.functionHandlers {
 		list = append(list, name)
@@ -230,8 +691,26 @@ func (ms *ManagementService) List() []string {
 	return list
 }
 
+// Restarts returns how often the replicas of each function were restarted
+// after they crashed. Functions whose backend does not restart replicas are
+// left out.
+func (ms *ManagementService) Restarts() map[string]Restarts {
+	handlers := ms.handlers()
+
+	restarts := make(map[string]Restarts, len(handlers))
+	for name, fh := range handlers {
+		if s, ok := fh.(Supervisor); ok {
+			restarts[name] = s.Restarts()
+		}
+	}
+
+	return restarts
+}
+
 func (ms *ManagementService) Wipe() error {
-	for name := range ms.functionHandlers {
+	// Delete changes the map, so it must not be called while ranging over
+	// it
+	for name := range ms.handlers() {
 		log.Println("destroying function", name)
 		ms.Delete(name)
 	}
@@ -240,133 +719,356 @@ func (ms *ManagementService) Wipe() error {
 }
 func (ms *ManagementService) Delete(name string) error {
 
+	// the handler cannot be replaced while we hold rproxyMutex
+	ms.rproxyMutex.Lock()
+
+	ms.functionHandlersMutex.Lock()
 	fh, ok := ms.functionHandlers[name]
+	ms.functionHandlersMutex.Unlock()
+
 	if !ok {
-		return fmt.Errorf("function %s not found", name)
+		ms.rproxyMutex.Unlock()
+		return fmt.Errorf("function %s %w", name, ErrNotFound)
 	}
 
 	log.Println("destroying function", name)
 
-	ms.functionHandlersMutex.Lock()
-	defer ms.functionHandlersMutex.Unlock()
-
-	err := fh.Destroy()
+	// tell rproxy about the delete function, so that no more requests are
+	// sent to its handler
+	err := ms.removeFromRProxy(name)
 	if err != nil {
+		ms.rproxyMutex.Unlock()
 		return err
 	}
 
-	// tell rproxy about the delete function
-	// curl -X POST http://localhost:80 -d '{"name": "<name>"}'
-	d := struct {
-		FunctionName string `json:"name"`
-	}{
-		FunctionName: name,
+	ms.functionHandlersMutex.Lock()
+	delete(ms.functionHandlers, name)
+	delete(ms.functions, name)
+	c := ms.takeCanary(name)
+	ms.functionHandlersMutex.Unlock()
+
+	ms.rproxyMutex.Unlock()
+
+	if c != nil {
+		ms.destroyHandler(name, c.fh)
+		ms.endCanary(c)
 	}
 
-	b, err := json.Marshal(d)
+	err = fh.Destroy()
 	if err != nil {
 		return err
 	}
 
-	log.Println("telling rproxy about deleted function", name)
+	if ms.registry != nil {
+		err = ms.registry.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
 
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d", ms.rproxyListenAddress, ms.rproxyConfigPort), "application/json", bytes.NewBuffer(b))
+	return nil
+}
 
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
-	}
+// Upload deploys function f from a base64 encoded zip. If async is set, it
+// returns as soon as the zip has been decoded, and the deployment can be
+// followed with Deployment.
+func (ms *ManagementService) Upload(f Function, zipped string, async bool) (Deployment, error) {
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
-	}
+	// b64 decode zip while writing it to disk
+	zip := base64.NewDecoder(base64.StdEncoding, strings.NewReader(zipped))
 
-	defer resp.Body.Close()
+	// create function handler
+	d, err := ms.createFunction(f, zip, async)
 
-	r, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		// w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return d, err
 	}
 
-	log.Println("rproxy response:", string(r))
-
-	delete(ms.functionHandlers, name)
-
-	return nil
+	return d, nil
 }
 
-func (ms *ManagementService) Upload(name string, env string, threads int, zipped string, envs map[string]string) (string, error) {
+// UrlUpload deploys function f from an archive that is downloaded from
+// funcurl, like Upload.
+func (ms *ManagementService) UrlUpload(f Function, funcurl string, async bool) (Deployment, error) {
 
-	// b64 decode zip
-	zip, err := base64.StdEncoding.DecodeString(zipped)
+	// download url
+	resp, err := http.Get(funcurl)
 	if err != nil {
 		// w.WriteHeader(http.StatusBadRequest)
 		log.Println(err)
-		return "", err
+		return Deployment{}, err
 	}
+	defer resp.Body.Close()
 
-	// create function handler
-	n, err := ms.createFunction(name, env, threads, zip, "", envs)
+	// create function handler, the body is streamed to disk
+	d, err := ms.createFunction(f, resp.Body, async)
 
 	if err != nil {
 		// w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
-		return "", err
+		return d, err
 	}
 
-	// return success
-	// w.WriteHeader(http.StatusOK)
-	r := ""
-	for prot, port := range ms.rproxyPort {
-		r += fmt.Sprintf("%s://%s:%d/%s\n", prot, ms.rproxyListenAddress, port, n)
+	return d, nil
+}
+
+// UploadStream deploys function f from an archive that is read from r, e.g.,
+// the body of an HTTP request. In contrast to Upload, the archive is streamed
+// to disk and not decoded in memory.
+func (ms *ManagementService) UploadStream(f Function, r io.Reader, async bool) (Deployment, error) {
+
+	d, err := ms.createFunction(f, r, async)
+
+	if err != nil {
+		log.Println(err)
+		return d, err
 	}
 
-	return r, nil
+	return d, nil
 }
 
-func (ms *ManagementService) UrlUpload(name string, env string, threads int, funcurl string, subfolder string, envs map[string]string) (string, error) {
+// Versions returns all versions of a function that can be rolled back to,
+// newest first. Secrets of their access policies and the values of their
+// envs are redacted.
+func (ms *ManagementService) Versions(name string) ([]Function, error) {
+	// the name ends up in a path
+	if !util.IsAlphaNumeric(name) {
+		return nil, fmt.Errorf("%w: function name %s contains non-alphanumeric characters", ErrInvalidFunction, name)
+	}
 
-	// download url
-	resp, err := http.Get(funcurl)
+	if ms.registry == nil {
+		return nil, fmt.Errorf("versions are only kept with a registry")
+	}
+
+	versions, err := ms.registry.Versions(name)
 	if err != nil {
-		// w.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
-		return "", err
+		return nil, err
+	}
+
+	for i := range versions {
+		if versions[i].Auth != nil {
+			versions[i].Auth = versions[i].Auth.Redacted()
+		}
+
+		// like FunctionInfo, only the names of envs are shown
+		for k := range versions[i].Envs {
+			versions[i].Envs[k] = "redacted"
+		}
 	}
 
-	// reading body to memory
-	// not the smartest thing
-	zip, err := io.ReadAll(resp.Body)
+	return versions, nil
+}
 
+// Rollback deploys a previous version of a function from the registry. The
+// rollback is deployed like any other upload and becomes the newest version
+// of the function.
+func (ms *ManagementService) Rollback(name string, version int) (string, error) {
+	// the name ends up in a path
+	if !util.IsAlphaNumeric(name) {
+		return "", fmt.Errorf("%w: function name %s contains non-alphanumeric characters", ErrInvalidFunction, name)
+	}
+
+	if ms.registry == nil {
+		return "", fmt.Errorf("versions are only kept with a registry")
+	}
+
+	f, archivePath, err := ms.registry.GetVersion(name, version)
 	if err != nil {
-		// w.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
 		return "", err
 	}
 
-	// create function handler
-	n, err := ms.createFunction(name, env, threads, zip, subfolder, envs)
+	zip, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer zip.Close()
+
+	// a rollback should take effect right away
+	f.Canary = nil
 
+	log.Println("rolling back function", name, "to version", version)
+
+	d, err := ms.createFunction(f, zip, false)
 	if err != nil {
-		// w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
 		return "", err
 	}
 
-	// return success
-	// w.WriteHeader(http.StatusOK)
-	r := ""
-	for prot, port := range ms.rproxyPort {
-		r += fmt.Sprintf("%s://%s:%d/%s\n", prot, ms.rproxyListenAddress, port, n)
+	return d.Result, nil
+}
+
+// Restore deploys all functions found in the registry again. This should be
+// called once the rproxy is up. Functions that fail to deploy are logged and
+// skipped but stay in the registry.
+func (ms *ManagementService) Restore() error {
+	if ms.registry == nil {
+		return nil
+	}
+
+	functions, err := ms.registry.List()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range functions {
+		log.Println("restoring function", f.Name)
+
+		err = f.validate()
+		if err != nil {
+			log.Println("error restoring function", f.Name, err)
+			continue
+		}
+
+		_, archivePath, err := ms.registry.Get(f.Name)
+		if err != nil {
+			log.Println("error restoring function", f.Name, err)
+			continue
+		}
+
+		d := ms.newDeployment(f.Name)
+
+		err = ms.deployFunction(d, f, archivePath)
+		d.finish(ms.urls(f.Name), err)
+		if err != nil {
+			log.Println("error restoring function", f.Name, err)
+			continue
+		}
+
+		log.Println("restored function", f.Name)
 	}
 
-	return r, nil
+	return nil
 }
 
+// Stop destroys all function handlers. In contrast to Wipe, functions are
+// kept in the registry so that they can be restored on the next start.
 func (ms *ManagementService) Stop() error {
-	err := ms.Wipe()
+	ms.autoscaler.stop()
+
+	ms.functionHandlersMutex.Lock()
+	handlers := ms.functionHandlers
+	canaries := ms.canaries
+	ms.functionHandlers = make(map[string]Handler)
+	ms.functions = make(map[string]Function)
+	ms.canaries = make(map[string]*canary)
+	ms.functionHandlersMutex.Unlock()
+
+	for name, fh := range handlers {
+		log.Println("destroying function", name)
+		err := fh.Destroy()
+		if err != nil {
+			log.Println("error destroying function", name, err)
+		}
+	}
+
+	for name, c := range canaries {
+		ms.destroyHandler(name, c.fh)
+		ms.endCanary(c)
+	}
+
+	return ms.backend.Stop()
+}
+
+// rproxyState is what the rproxy is told about a function besides the IPs of
+// its handler: its configuration and its canary, if any.
+type rproxyState struct {
+	f            Function
+	canary       Handler
+	canaryWeight int
+}
+
+// rproxyState returns what the rproxy needs to know about function f. The
+// caller must hold ms.functionHandlersMutex.
+func (ms *ManagementService) rproxyState(f Function) rproxyState {
+	s := rproxyState{f: f}
+
+	if c, ok := ms.canaries[f.Name]; ok {
+		s.canary = c.fh
+		s.canaryWeight = c.weight
+	}
+
+	return s
+}
+
+// updateRProxy tells the rproxy about function s.f, whose handler has the
+// given ips. An empty list of ips means the function is scaled to zero. If
+// the function has a canary, its handlers are sent along as a group of their
+// own. The caller must hold ms.rproxyMutex but not
+// ms.functionHandlersMutex.
+func (ms *ManagementService) updateRProxy(s rproxyState, ips []string) error {
+	f := s.f
+
+	// curl -X POST http://localhost:8081 -d '{"name": "<name>", "ips": ["<ip1>", "<ip2>"]}'
+	d := struct {
+		FunctionName   string         `json:"name"`
+		FunctionIPs    []string       `json:"ips"`
+		FunctionGroups []rproxy.Group `json:"groups,omitempty"`
+		rproxy.Config
+	}{
+		FunctionName: f.Name,
+		FunctionIPs:  ips,
+		Config:       f.Config,
+	}
+
+	if s.canary != nil {
+		d.FunctionGroups = []rproxy.Group{
+			{Name: rproxy.DefaultGroup, IPs: ips, Weight: 100 - s.canaryWeight},
+			{Name: CanaryGroup, IPs: s.canary.IPs(), Weight: s.canaryWeight},
+		}
+	}
+
+	log.Println("telling rproxy about function", f.Name, "with ips", ips)
+
+	return ms.callRProxy(http.MethodPost, "/", d)
+}
+
+// removeFromRProxy tells the rproxy that a function no longer exists.
+func (ms *ManagementService) removeFromRProxy(name string) error {
+	// curl -X DELETE http://localhost:8081 -d '{"name": "<name>"}'
+	d := struct {
+		FunctionName string `json:"name"`
+	}{
+		FunctionName: name,
+	}
+
+	log.Println("telling rproxy about deleted function", name)
+
+	return ms.callRProxy(http.MethodDelete, "/", d)
+}
+
+func (ms *ManagementService) callRProxy(method string, p string, d any) error {
+	b, err := json.Marshal(d)
 	if err != nil {
 		return err
 	}
 
-	return ms.backend.Stop()
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", ms.rproxyConfigAddress, ms.rproxyConfigPort, p), bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Println("error calling rproxy", err)
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rproxy returned status code %d", resp.StatusCode)
+	}
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	log.Println("rproxy response:", string(r))
+
+	return nil
 }
@@ -0,0 +1,231 @@
+package manager_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+	"github.com/OpenFogStack/tinyFaaS/pkg/registry"
+)
+
+// fakeBackend creates handlers that only answer health checks and remembers
+// what each of them was created from.
+type fakeBackend struct {
+	health string
+	mu     sync.Mutex
+	// sources holds the content of fn.txt of every handler created so far
+	sources []string
+	envs    []map[string]string
+}
+
+func (b *fakeBackend) Create(name string, env string, threads int, filedir string, envs map[string]string, logs io.Writer) (manager.Handler, error) {
+	src, err := os.ReadFile(filepath.Join(filedir, "fn.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sources = append(b.sources, string(src))
+	b.envs = append(b.envs, envs)
+
+	return &fakeHandler{ip: b.health}, nil
+}
+
+func (b *fakeBackend) Stop() error {
+	return nil
+}
+
+// last returns what the newest handler was created from.
+func (b *fakeBackend) last() (string, map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.sources[len(b.sources)-1], b.envs[len(b.envs)-1]
+}
+
+type fakeHandler struct {
+	ip string
+}
+
+func (h *fakeHandler) IPs() []string            { return []string{h.ip} }
+func (h *fakeHandler) Start() error             { return nil }
+func (h *fakeHandler) Destroy() error           { return nil }
+func (h *fakeHandler) Logs() (io.Reader, error) { return strings.NewReader(""), nil }
+
+// source returns a zip archive of a function whose fn.txt holds content.
+func source(t *testing.T, content string) io.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	f, err := w.Create("fn.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+// newTestService returns a management service with a file registry, a fake
+// backend and a fake rproxy.
+func newTestService(t *testing.T) (*manager.ManagementService, *fakeBackend, *registry.FileRegistry) {
+	t.Helper()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	// archives are unpacked in TmpDir, relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	t.Cleanup(health.Close)
+
+	// the rproxy accepts any function and has no requests in flight
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stats" {
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(rp.Close)
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(rp.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpPort, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := registry.NewFileRegistry(filepath.Join(t.TempDir(), "registry"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBackend{health: strings.TrimPrefix(health.URL, "http://")}
+
+	ms := manager.New("test", "localhost", map[string]int{"http": 8000}, host, rpPort, b, reg, 0)
+
+	return ms, b, reg
+}
+
+func TestRollback(t *testing.T) {
+	ms, b, reg := newTestService(t)
+
+	for _, v := range []string{"v1", "v2"} {
+		f := manager.Function{Name: "fn", Env: "python3", Threads: 1, Envs: map[string]string{"VERSION": v}}
+
+		_, err := ms.UploadStream(f, source(t, v), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := ms.Rollback("fn", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous archive runs with the previous configuration
+	src, envs := b.last()
+	if src != "v1" || envs["VERSION"] != "v1" {
+		t.Errorf("rollback runs %s with envs %v, want v1", src, envs)
+	}
+
+	// and is the newest version in the registry
+	f, _, err := reg.Get("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Version != 3 || f.Envs["VERSION"] != "v1" {
+		t.Errorf("registry has version %d with envs %v, want version 3 of v1", f.Version, f.Envs)
+	}
+
+	versions, err := ms.Versions("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 3 {
+		t.Errorf("got %d versions, want 3", len(versions))
+	}
+
+	// the values of envs are not shown
+	for _, v := range versions {
+		if v.Envs["VERSION"] != "redacted" {
+			t.Errorf("version %d shows env %s", v.Version, v.Envs["VERSION"])
+		}
+	}
+}
+
+func TestRollbackNotFound(t *testing.T) {
+	ms, b, _ := newTestService(t)
+
+	_, err := ms.UploadStream(manager.Function{Name: "fn", Env: "python3", Threads: 1}, source(t, "v1"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		name    string
+		version int
+	}{
+		"unknown version":  {name: "fn", version: 2},
+		"unknown function": {name: "nope", version: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ms.Rollback(tc.name, tc.version)
+			if !errors.Is(err, manager.ErrNotFound) {
+				t.Errorf("got %v, want %v", err, manager.ErrNotFound)
+			}
+		})
+	}
+
+	// the current version keeps running
+	if src, _ := b.last(); src != "v1" {
+		t.Errorf("running %s after failed rollbacks, want v1", src)
+	}
+}
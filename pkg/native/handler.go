@@ -0,0 +1,540 @@
+package native
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+const (
+	TmpDir      = "./tmp"
+	stopTimeout = 1 * time.Second
+	listenHost  = "127.0.0.1"
+)
+
+// hostEnvs are the environment variables of the management service that are
+// passed on to function handlers, as any others may be secrets of the host.
+var hostEnvs = []string{"PATH", "HOME", "LANG", "TZ"}
+
+// replica is a single function handler process.
+type replica struct {
+	name    string
+	cmd     *exec.Cmd
+	port    int
+	logFile string
+	exited  chan struct{}
+	// started is when the process was started, zero if it was not
+	started time.Time
+}
+
+type nativeHandler struct {
+	backend    *NativeBackend
+	name       string
+	env        string
+	threads    int
+	uniqueName string
+	filePath   string
+	cmd        []string
+	envs       []string
+	replicas   []*replica
+	handlerIPs []string
+	// next is the index of the next replica to create
+	next int
+	// changed is called when a crashed replica has been restarted
+	changed  func()
+	restarts manager.Restarts
+	// mu guards the fields above and is never held while starting or
+	// stopping processes, which may take seconds
+	mu sync.Mutex
+	// ops serializes Start, Scale, and Destroy
+	ops sync.Mutex
+}
+
+// NativeBackend runs function handlers as plain processes on the host,
+// without any container runtime. Each replica listens on its own port on
+// localhost.
+type NativeBackend struct {
+	tinyFaaSID string
+	handlers   map[string]*nativeHandler
+	hl         sync.Mutex
+}
+
+func New(tinyFaaSID string) *NativeBackend {
+	return &NativeBackend{
+		tinyFaaSID: tinyFaaSID,
+		handlers:   make(map[string]*nativeHandler),
+	}
+}
+
+func (nb *NativeBackend) Stop() error {
+	nb.hl.Lock()
+	handlers := make([]*nativeHandler, 0, len(nb.handlers))
+	for _, nh := range nb.handlers {
+		handlers = append(handlers, nh)
+	}
+	nb.hl.Unlock()
+
+	// make sure we do not leave any processes behind
+	for _, nh := range handlers {
+		err := nh.Destroy()
+		if err != nil {
+			log.Printf("error destroying function %s: %s", nh.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (nb *NativeBackend) Create(name string, env string, threads int, filedir string, envs map[string]string, logs io.Writer) (manager.Handler, error) {
+
+	rt, ok := nativeRuntimes[env]
+	if !ok {
+		return nil, fmt.Errorf("unsupported environment %s for native backend", env)
+	}
+
+	// make a unique function name by appending uuid string to function name
+	uuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	nh := &nativeHandler{
+		backend:    nb,
+		name:       name,
+		env:        env,
+		threads:    threads,
+		replicas:   make([]*replica, 0, threads),
+		handlerIPs: make([]string, 0, threads),
+	}
+
+	nh.uniqueName = name + "-" + uuid.String()
+	log.Println("creating function", name, "with unique name", nh.uniqueName)
+
+	// the folder is kept as long as the function exists, the handler
+	// processes run in it
+	err = os.MkdirAll(TmpDir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := os.MkdirTemp(TmpDir, nh.uniqueName)
+	if err != nil {
+		return nil, err
+	}
+
+	// we need an absolute path as commands are run in that folder
+	nh.filePath, err = filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rt.prepare(filedir, nh.filePath, logs)
+	if err != nil {
+		os.RemoveAll(nh.filePath)
+		return nil, err
+	}
+
+	log.Println("prepared function", name, "in", nh.filePath)
+
+	nh.cmd = rt.cmd
+	nh.envs = append(nh.envs, rt.env...)
+	for k, v := range envs {
+		nh.envs = append(nh.envs, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	for i := 0; i < nh.threads; i++ {
+		r, err := nh.newReplica(nh.nextName())
+		if err != nil {
+			os.RemoveAll(nh.filePath)
+			return nil, err
+		}
+
+		nh.replicas = append(nh.replicas, r)
+	}
+
+	nb.hl.Lock()
+	nb.handlers[nh.uniqueName] = nh
+	nb.hl.Unlock()
+
+	return nh, nil
+}
+
+// nextName returns the name of the next replica of the function. The caller
+// must hold nh.mu.
+func (nh *nativeHandler) nextName() string {
+	name := fmt.Sprintf("%s-%d", nh.uniqueName, nh.next)
+	nh.next++
+
+	return name
+}
+
+// newReplica prepares a handler process with the given name on a free port.
+func (nh *nativeHandler) newReplica(name string) (*replica, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	c := exec.Command(nh.cmd[0], nh.cmd[1:]...)
+	c.Dir = nh.filePath
+
+	for _, k := range hostEnvs {
+		if v, ok := os.LookupEnv(k); ok {
+			c.Env = append(c.Env, k+"="+v)
+		}
+	}
+
+	c.Env = append(c.Env, nh.envs...)
+	// the handler must only be reachable through the reverse proxy
+	c.Env = append(c.Env, fmt.Sprintf("PORT=%d", port), "HOST="+listenHost)
+
+	// the handler and anything it starts get a process group of their own,
+	// so that they can be stopped together
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	return &replica{
+		name:    name,
+		cmd:     c,
+		port:    port,
+		logFile: path.Join(nh.filePath, "."+name+".log"),
+		exited:  make(chan struct{}),
+	}, nil
+}
+
+func (nh *nativeHandler) IPs() []string {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	ips := make([]string, len(nh.handlerIPs))
+	copy(ips, nh.handlerIPs)
+
+	return ips
+}
+
+func (nh *nativeHandler) Start() error {
+	nh.ops.Lock()
+	defer nh.ops.Unlock()
+
+	nh.mu.Lock()
+	replicas := make([]*replica, len(nh.replicas))
+	copy(replicas, nh.replicas)
+	nh.mu.Unlock()
+
+	ips := make([]string, 0, len(replicas))
+
+	for _, r := range replicas {
+		err := r.start()
+		if err != nil {
+			return err
+		}
+
+		log.Println("started handler", r.cmd.Path, "with pid", r.cmd.Process.Pid, "on port", r.port)
+
+		ips = append(ips, r.addr())
+	}
+
+	// wait for the handlers to be ready
+	for _, r := range replicas {
+		err := nh.waitReady(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	nh.mu.Lock()
+	nh.handlerIPs = ips
+	nh.mu.Unlock()
+
+	// replicas are only restarted once they have been ready
+	for _, r := range replicas {
+		go nh.watch(r)
+	}
+
+	return nil
+}
+
+// Scale adds or removes handler processes so that the function has the given
+// number of replicas. New processes are only added once they are ready.
+func (nh *nativeHandler) Scale(replicas int) error {
+	nh.ops.Lock()
+	defer nh.ops.Unlock()
+
+	nh.mu.Lock()
+	var removed []*replica
+	if len(nh.replicas) > replicas {
+		removed = append(removed, nh.replicas[replicas:]...)
+		nh.replicas = nh.replicas[:replicas]
+		nh.handlerIPs = nh.handlerIPs[:replicas]
+	}
+	missing := replicas - len(nh.replicas)
+	nh.mu.Unlock()
+
+	// the removed replicas are no longer part of the handler, so their exit
+	// does not trigger a restart
+	for _, r := range removed {
+		r.stop()
+	}
+
+	for ; missing > 0; missing-- {
+		nh.mu.Lock()
+		name := nh.nextName()
+		nh.mu.Unlock()
+
+		r, err := nh.newReplica(name)
+		if err != nil {
+			return err
+		}
+
+		err = r.start()
+		if err == nil {
+			err = nh.waitReady(r)
+		}
+
+		if err != nil {
+			r.stop()
+			return err
+		}
+
+		nh.mu.Lock()
+		nh.replicas = append(nh.replicas, r)
+		nh.handlerIPs = append(nh.handlerIPs, r.addr())
+		nh.mu.Unlock()
+
+		go nh.watch(r)
+	}
+
+	return nil
+}
+
+// waitReady polls the health endpoint of replica r until it reports to be
+// ready.
+func (nh *nativeHandler) waitReady(r *replica) error {
+	// curl http://<ip>:<port>/health
+	ip := r.addr()
+	log.Println("waiting for handler", ip, "to be ready")
+
+	maxRetries := 10
+	for {
+		maxRetries--
+		if maxRetries == 0 {
+			logs, err := nh.getReplicaLogs(r)
+			if err == nil {
+				log.Println(logs)
+			}
+
+			return fmt.Errorf("handler %s not ready after 10 retries", ip)
+		}
+
+		select {
+		case <-r.exited:
+			logs, err := nh.getReplicaLogs(r)
+			if err == nil {
+				log.Println(logs)
+			}
+
+			return fmt.Errorf("handler %s exited: %s", ip, r.cmd.ProcessState)
+		default:
+		}
+
+		client := http.Client{
+			Timeout: 3 * time.Second,
+		}
+
+		resp, err := client.Get("http://" + ip + "/health")
+		if err != nil {
+			log.Println(err)
+			log.Println("retrying in 1 second")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			log.Println("handler", ip, "is ready")
+			return nil
+		}
+		log.Println("handler", ip, "is not ready yet, retrying in 1 second")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (nh *nativeHandler) Destroy() error {
+	log.Println("destroying function", nh.name)
+
+	nh.backend.hl.Lock()
+	delete(nh.backend.handlers, nh.uniqueName)
+	nh.backend.hl.Unlock()
+
+	nh.ops.Lock()
+	defer nh.ops.Unlock()
+
+	// the replicas exit on purpose, they must not be restarted
+	nh.mu.Lock()
+	replicas := nh.replicas
+	nh.replicas = nil
+	nh.handlerIPs = nil
+	nh.mu.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, r := range replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			r.stop()
+		}(r)
+	}
+	wg.Wait()
+
+	err := os.RemoveAll(nh.filePath)
+	if err != nil {
+		return err
+	}
+
+	log.Println("removed folder", nh.filePath)
+
+	return nil
+}
+
+func (nh *nativeHandler) getReplicaLogs(r *replica) (string, error) {
+	logs := ""
+
+	f, err := os.Open(r.logFile)
+	if err != nil {
+		return logs, err
+	}
+	defer f.Close()
+
+	// add a prefix to each line
+	// function=<function> handler=<handler> <line>
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		logs += fmt.Sprintf("function=%s handler=%s %s\n", nh.name, r.name, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return logs, err
+	}
+
+	return logs, nil
+}
+
+func (nh *nativeHandler) Logs() (io.Reader, error) {
+	nh.mu.Lock()
+	replicas := make([]*replica, len(nh.replicas))
+	copy(replicas, nh.replicas)
+	nh.mu.Unlock()
+
+	var logs bytes.Buffer
+
+	for _, r := range replicas {
+		l, err := nh.getReplicaLogs(r)
+		if err != nil {
+			return nil, err
+		}
+
+		logs.WriteString(l)
+	}
+
+	return &logs, nil
+}
+
+// start runs the replica's process with its output going to its log file.
+func (r *replica) start() error {
+	f, err := os.OpenFile(r.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.cmd.Stdout = f
+	r.cmd.Stderr = f
+
+	err = r.cmd.Start()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.started = time.Now()
+
+	go func() {
+		r.cmd.Wait()
+		// processes the handler started must not outlive it
+		r.killGroup()
+		f.Close()
+		close(r.exited)
+	}()
+
+	return nil
+}
+
+func (r *replica) addr() string {
+	return net.JoinHostPort(listenHost, strconv.Itoa(r.port))
+}
+
+// stop asks the replica's process to terminate and kills it if it does not
+// exit within stopTimeout.
+func (r *replica) stop() {
+	if r.cmd.Process == nil {
+		// never started
+		return
+	}
+
+	select {
+	case <-r.exited:
+		return
+	default:
+	}
+
+	// the process group has the ID of the handler process
+	err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGTERM)
+	if err != nil {
+		log.Printf("error stopping process %d: %s", r.cmd.Process.Pid, err)
+	}
+
+	select {
+	case <-r.exited:
+	case <-time.After(stopTimeout):
+		log.Printf("process %d did not stop after %s, killing it", r.cmd.Process.Pid, stopTimeout)
+		r.cmd.Process.Kill()
+		<-r.exited
+	}
+
+	log.Println("stopped process", r.cmd.Process.Pid)
+}
+
+// killGroup kills all processes that are left in the process group of the
+// replica.
+func (r *replica) killGroup() {
+	err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		log.Printf("error killing process group %d: %s", r.cmd.Process.Pid, err)
+	}
+}
+
+// freePort asks the operating system for a port that is currently unused.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(listenHost, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,330 @@
+package native
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fnScript echoes its input along with an env of the function and one of the
+// host, or starts a process in the background and prints its PID.
+const fnScript = `#!/bin/sh
+input=$(cat)
+if [ "$input" = "spawn" ]; then
+	sleep 300 >/dev/null 2>&1 &
+	echo $!
+	exit 0
+fi
+echo "$GREETING $input secret=$TF_TEST_SECRET"
+`
+
+// newTestHandler creates a binary function with threads replicas in a
+// temporary directory. The handler is destroyed when the test ends.
+func newTestHandler(t *testing.T, threads int) *nativeHandler {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("builds a function handler")
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is needed to build the binary runtime")
+	}
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	// function handlers must not see the environment of the host
+	t.Setenv("TF_TEST_SECRET", "s3cret")
+
+	// the backend keeps its files in TmpDir, relative to the working
+	// directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+
+	fndir := t.TempDir()
+
+	err = os.WriteFile(filepath.Join(fndir, "fn.sh"), []byte(fnScript), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nb := New("test")
+
+	h, err := nb.Create("echo", "binary", threads, fndir, map[string]string{"GREETING": "hello"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nh := h.(*nativeHandler)
+
+	t.Cleanup(func() {
+		nh.Destroy()
+	})
+
+	return nh
+}
+
+// call sends input to the function handler at addr and returns its answer.
+func call(t *testing.T, addr string, input string) string {
+	t.Helper()
+
+	resp, err := http.Post("http://"+addr+"/fn", "text/plain", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("handler %s returned %d: %s", addr, resp.StatusCode, b)
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// closed reports whether nothing listens on addr anymore.
+func closed(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return true
+	}
+
+	c.Close()
+	return false
+}
+
+// gone waits for process pid to exit.
+func gone(pid int) bool {
+	for i := 0; i < 50; i++ {
+		if errors.Is(syscall.Kill(pid, 0), syscall.ESRCH) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestHandler(t *testing.T) {
+	nh := newTestHandler(t, 2)
+
+	if len(nh.IPs()) != 0 {
+		t.Errorf("handler has IPs before it was started: %v", nh.IPs())
+	}
+
+	err := nh.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := nh.IPs()
+	if len(ips) != 2 {
+		t.Fatalf("got %d IPs, want 2", len(ips))
+	}
+
+	for _, ip := range ips {
+		host, _, err := net.SplitHostPort(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if host != listenHost {
+			t.Errorf("handler listens on %s, want %s", host, listenHost)
+		}
+
+		if got, want := call(t, ip, "world"), "hello world secret="; got != want {
+			t.Errorf("handler %s answered %q, want %q", ip, got, want)
+		}
+	}
+
+	// a handler listens on localhost only
+	if ext := externalIP(t); ext != "" {
+		for _, r := range nh.replicas {
+			if !closed(net.JoinHostPort(ext, strconv.Itoa(r.port))) {
+				t.Errorf("replica %s is reachable from the network", r.name)
+			}
+		}
+	}
+
+	logs, err := nh.Logs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range nh.replicas {
+		if !strings.Contains(string(b), "function=echo handler="+r.name+" ") {
+			t.Errorf("logs have no lines of replica %s:\n%s", r.name, b)
+		}
+	}
+
+	err = nh.Scale(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scaled := nh.IPs()
+	if len(scaled) != 3 || scaled[0] != ips[0] || scaled[1] != ips[1] {
+		t.Fatalf("got IPs %v after scaling up from %v", scaled, ips)
+	}
+
+	call(t, scaled[2], "again")
+
+	err = nh.Scale(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := nh.IPs(); len(got) != 1 || got[0] != ips[0] {
+		t.Fatalf("got IPs %v after scaling down, want %v", got, ips[:1])
+	}
+
+	for _, ip := range scaled[1:] {
+		if !closed(ip) {
+			t.Errorf("removed replica %s still listens", ip)
+		}
+	}
+
+	dir := nh.filePath
+
+	err = nh.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nh.IPs()) != 0 {
+		t.Errorf("destroyed handler still has IPs %v", nh.IPs())
+	}
+
+	if !closed(ips[0]) {
+		t.Errorf("replica %s still listens after destroying the handler", ips[0])
+	}
+
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("folder %s of destroyed handler still exists: %v", dir, err)
+	}
+}
+
+func TestDestroyStopsProcessGroup(t *testing.T) {
+	nh := newTestHandler(t, 1)
+
+	err := nh.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid, err := strconv.Atoi(call(t, nh.IPs()[0], "spawn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if syscall.Kill(pid, 0) != nil {
+		t.Fatalf("background process %d exited early", pid)
+	}
+
+	err = nh.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !gone(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("background process %d survived destroying the handler", pid)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	nh := newTestHandler(t, 1)
+
+	err := nh.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{}, 1)
+	nh.Supervise(func() {
+		changed <- struct{}{}
+	})
+
+	before := nh.IPs()[0]
+
+	pid, err := strconv.Atoi(call(t, before, "spawn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash the handler, the process it started goes with it
+	nh.mu.Lock()
+	nh.replicas[0].cmd.Process.Kill()
+	nh.mu.Unlock()
+
+	select {
+	case <-changed:
+	case <-time.After(20 * time.Second):
+		t.Fatal("crashed replica was not restarted")
+	}
+
+	if !gone(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("background process %d survived the crash of its handler", pid)
+	}
+
+	after := nh.IPs()[0]
+	call(t, after, "back")
+
+	r := nh.Restarts()
+	if r.Count != 1 || r.LastExitCode != -1 {
+		t.Errorf("got restarts %+v, want one after a kill", r)
+	}
+}
+
+// externalIP returns an address of the host other than localhost, if there
+// is one.
+func externalIP(t *testing.T) string {
+	t.Helper()
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP.String()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,200 @@
+package native
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/docker/runtimes"
+	"github.com/OpenFogStack/tinyFaaS/pkg/util"
+)
+
+// runtime describes how to run the function handler of an environment as a
+// plain process. prepare is called once per function to set up dir with the
+// function code from fndir and writes the output of any setup commands to
+// logs, cmd is then started in dir for every replica.
+type runtime struct {
+	prepare func(fndir string, dir string, logs io.Writer) error
+	cmd     []string
+	env     []string
+}
+
+var nativeRuntimes = map[string]runtime{
+	"python3": {
+		prepare: preparePython3,
+		cmd:     []string{"python3", "functionhandler.py"},
+		env:     []string{"PYTHONPATH=.deps", "PYTHONUNBUFFERED=1"},
+	},
+	"nodejs": {
+		prepare: prepareNodeJS,
+		cmd:     []string{"node", "functionhandler.js"},
+	},
+	"go": {
+		prepare: prepareGo,
+		cmd:     []string{"./handler"},
+	},
+	"binary": {
+		prepare: prepareBinary,
+		cmd:     []string{"./handler.bin"},
+	},
+}
+
+// copyHandler copies a function handler file from the embedded runtimes into
+// dir.
+func copyHandler(env string, file string, dir string) error {
+	b, err := fs.ReadFile(runtimes.Sources, path.Join(env, file))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(dir, file), b, 0644)
+}
+
+// run executes a setup command in dir and logs its output, which is also
+// written to logs.
+func run(logs io.Writer, dir string, env []string, name string, args ...string) error {
+	log.Println("running", name, args, "in", dir)
+
+	fmt.Fprintln(logs, "running", name, strings.Join(args, " "))
+
+	var out bytes.Buffer
+
+	c := exec.Command(name, args...)
+	c.Dir = dir
+	c.Env = append(os.Environ(), env...)
+	c.Stdout = io.MultiWriter(&out, logs)
+	c.Stderr = c.Stdout
+
+	err := c.Run()
+	log.Println(out.String())
+
+	if err != nil {
+		return fmt.Errorf("error running %s %v: %w", name, args, err)
+	}
+
+	return nil
+}
+
+// python3: fn.py next to functionhandler.py, dependencies are installed into
+// a folder of their own that is added to the PYTHONPATH
+func preparePython3(fndir string, dir string, logs io.Writer) error {
+	err := util.CopyAll(fndir, dir)
+	if err != nil {
+		return err
+	}
+
+	err = copyHandler("python3", "functionhandler.py", dir)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path.Join(dir, "requirements.txt"))
+	if err == nil {
+		err = run(logs, dir, nil, "python3", "-m", "pip", "install", "-r", "requirements.txt", "--target", ".deps")
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// nodejs: function as the "fn" module in a subfolder
+func prepareNodeJS(fndir string, dir string, logs io.Writer) error {
+	err := os.MkdirAll(path.Join(dir, "fn"), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = util.CopyAll(fndir, path.Join(dir, "fn"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{"functionhandler.js", "package.json"} {
+		err = copyHandler("nodejs", f, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = run(logs, dir, nil, "npm", "install", "express", "body-parser")
+	if err != nil {
+		return err
+	}
+
+	err = run(logs, dir, nil, "npm", "install", "./fn")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// go: function code is compiled together with the function handler
+func prepareGo(fndir string, dir string, logs io.Writer) error {
+	err := util.CopyAll(fndir, dir)
+	if err != nil {
+		return err
+	}
+
+	err = copyHandler("go", "functionhandler.go", dir)
+	if err != nil {
+		return err
+	}
+
+	err = run(logs, dir, nil, "go", "mod", "tidy")
+	if err != nil {
+		return err
+	}
+
+	err = run(logs, dir, []string{"CGO_ENABLED=0"}, "go", "build", "-o", "handler", ".")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// binary: the function handler calls fn.sh for every request
+func prepareBinary(fndir string, dir string, logs io.Writer) error {
+	err := util.CopyAll(fndir, dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path.Join(dir, "fn.sh"), 0755)
+	if err != nil {
+		return err
+	}
+
+	// build the handler in a folder of its own so that it does not pick up
+	// any Go files that are part of the function
+	build := path.Join(dir, ".handler")
+
+	err = os.MkdirAll(build, 0777)
+	if err != nil {
+		return err
+	}
+
+	err = copyHandler("binary", "functionhandler.go", build)
+	if err != nil {
+		return err
+	}
+
+	err = run(logs, build, []string{"GO111MODULE=off", "CGO_ENABLED=0"}, "go", "build", "-o", path.Join("..", "handler.bin"), ".")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package native
+
+import (
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+// Describe returns the command that the processes of nh run.
+func (nh *nativeHandler) Describe() manager.HandlerInfo {
+	return manager.HandlerInfo{
+		Backend: "native",
+		Command: nh.cmd,
+	}
+}
+
+// Status reports whether the processes of nh are running.
+func (nh *nativeHandler) Status() ([]manager.ReplicaStatus, error) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	replicas := make([]manager.ReplicaStatus, 0, len(nh.replicas))
+
+	for i, r := range nh.replicas {
+		s := manager.ReplicaStatus{
+			ID:    r.name,
+			State: "created",
+		}
+
+		// handlerIPs is only filled in once the handler has started
+		if i < len(nh.handlerIPs) {
+			s.IP = nh.handlerIPs[i]
+		}
+
+		if !r.started.IsZero() {
+			started := r.started
+			s.Started = &started
+
+			s.State = "running"
+			select {
+			case <-r.exited:
+				s.State = "exited"
+			default:
+			}
+		}
+
+		replicas = append(replicas, s)
+	}
+
+	return replicas, nil
+}
@@ -0,0 +1,144 @@
+package native
+
+import (
+	"log"
+	"time"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+const (
+	// restartDelay is how long to wait before restarting a crashed replica
+	// for the first time. The delay doubles with every failed attempt, up to
+	// maxRestartDelay.
+	restartDelay    = 1 * time.Second
+	maxRestartDelay = 30 * time.Second
+)
+
+// watch waits for replica r to exit and restarts it if it is still part of
+// the handler, i.e., it has not been stopped on purpose.
+func (nh *nativeHandler) watch(r *replica) {
+	<-r.exited
+
+	exitCode := r.cmd.ProcessState.ExitCode()
+
+	delay := restartDelay
+
+	for {
+		nh.mu.Lock()
+		i := nh.index(r)
+		nh.mu.Unlock()
+
+		if i < 0 {
+			return
+		}
+
+		log.Printf("replica %s of function %s exited with code %d, restarting it in %s", r.name, nh.name, exitCode, delay)
+
+		time.Sleep(delay)
+
+		done, err := nh.tryRestart(r, exitCode)
+		if done {
+			return
+		}
+
+		log.Printf("error restarting replica %s: %s", r.name, err)
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// index returns the position of replica r in the handler's list of replicas,
+// or -1 if it is not part of the handler (anymore). The caller must hold
+// nh.mu.
+func (nh *nativeHandler) index(r *replica) int {
+	for i, hr := range nh.replicas {
+		if hr == r {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// tryRestart makes a single attempt at replacing crashed replica r with a new
+// process. It returns true if there is nothing left to do. The handler is only
+// locked to look up and swap its replicas, not while the new process starts.
+func (nh *nativeHandler) tryRestart(r *replica, exitCode int) (bool, error) {
+	nh.mu.Lock()
+	owned := nh.index(r) >= 0
+	nh.mu.Unlock()
+
+	if !owned {
+		// removed while we were waiting
+		return true, nil
+	}
+
+	// the port may not be free anymore, so the new process gets a new one
+	n, err := nh.newReplica(r.name)
+	if err != nil {
+		return false, err
+	}
+
+	err = n.start()
+	if err == nil {
+		err = nh.waitReady(n)
+	}
+
+	if err != nil {
+		n.stop()
+		return false, err
+	}
+
+	nh.mu.Lock()
+
+	i := nh.index(r)
+	if i < 0 {
+		// removed while we were restarting it
+		nh.mu.Unlock()
+		n.stop()
+		return true, nil
+	}
+
+	nh.replicas[i] = n
+
+	// handlerIPs is only filled in once the handler has started
+	if i < len(nh.handlerIPs) {
+		nh.handlerIPs[i] = n.addr()
+	}
+
+	nh.restarts.Count++
+	nh.restarts.LastExitCode = exitCode
+	nh.restarts.LastRestart = time.Now()
+
+	changed := nh.changed
+
+	nh.mu.Unlock()
+
+	log.Printf("restarted replica %s of function %s on port %d", n.name, nh.name, n.port)
+
+	go nh.watch(n)
+
+	if changed != nil {
+		changed()
+	}
+
+	return true, nil
+}
+
+func (nh *nativeHandler) Supervise(changed func()) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	nh.changed = changed
+}
+
+func (nh *nativeHandler) Restarts() manager.Restarts {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	return nh.restarts
+}
@@ -0,0 +1,289 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+	"github.com/OpenFogStack/tinyFaaS/pkg/util"
+)
+
+const (
+	functionFile = "function.json"
+	archiveFile  = "function.zip"
+	versionsDir  = "versions"
+)
+
+// FileRegistry stores functions as JSON documents next to their source
+// archive, one folder per version of a function:
+// <dir>/<name>/versions/<version>/function.json and
+// <dir>/<name>/versions/<version>/function.zip. The newest version is the
+// current one. Entries may hold secrets, e.g., envs and access policies, so
+// they are only readable by the owner.
+type FileRegistry struct {
+	dir string
+	// versions is the number of versions kept per function, including the
+	// current one
+	versions int
+	mu       sync.Mutex
+}
+
+func NewFileRegistry(dir string, versions int) (*FileRegistry, error) {
+	if versions < 1 {
+		return nil, fmt.Errorf("invalid number of versions %d", versions)
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("using function registry in", dir, "keeping", versions, "versions")
+
+	return &FileRegistry{
+		dir:      dir,
+		versions: versions,
+	}, nil
+}
+
+// Put stores f as the new current version of the function and removes the
+// oldest versions.
+func (fr *FileRegistry) Put(f manager.Function, archivePath string) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	p := path.Join(fr.dir, f.Name, versionsDir)
+
+	err := os.MkdirAll(p, 0700)
+	if err != nil {
+		return err
+	}
+
+	versions, err := fr.archived(f.Name)
+	if err != nil {
+		return err
+	}
+
+	f.Version = 1
+	if len(versions) > 0 {
+		f.Version = versions[0] + 1
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the version is written to a temporary folder that is only renamed
+	// once it is complete, so a crash never leaves us with an archive that
+	// does not match its metadata
+	tmp, err := os.MkdirTemp(p, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = util.CopyFileAtomic(archivePath, path.Join(tmp, archiveFile))
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteFileAtomic(path.Join(tmp, functionFile), b, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path.Join(p, strconv.Itoa(f.Version)))
+	if err != nil {
+		return err
+	}
+
+	return fr.prune(f.Name)
+}
+
+// prune removes the oldest versions of a function so that at most
+// fr.versions versions are kept, as well as anything left over from a crash
+// while storing a version.
+func (fr *FileRegistry) prune(name string) error {
+	p := path.Join(fr.dir, name, versionsDir)
+
+	leftovers, err := filepath.Glob(path.Join(p, ".tmp-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, l := range leftovers {
+		err = os.RemoveAll(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	versions, err := fr.archived(name)
+	if err != nil {
+		return err
+	}
+
+	for len(versions) > fr.versions {
+		oldest := versions[len(versions)-1]
+		versions = versions[:len(versions)-1]
+
+		log.Println("removing version", oldest, "of function", name, "from registry")
+
+		err = os.RemoveAll(path.Join(p, strconv.Itoa(oldest)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archived returns the numbers of all stored versions of a function, newest
+// first.
+func (fr *FileRegistry) archived(name string) ([]int, error) {
+	entries, err := os.ReadDir(path.Join(fr.dir, name, versionsDir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	versions := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		v, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		versions = append(versions, v)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	return versions, nil
+}
+
+func (fr *FileRegistry) Get(name string) (manager.Function, string, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	return fr.get(name)
+}
+
+func (fr *FileRegistry) get(name string) (manager.Function, string, error) {
+	versions, err := fr.archived(name)
+	if err != nil {
+		return manager.Function{}, "", err
+	}
+
+	if len(versions) == 0 {
+		return manager.Function{}, "", fmt.Errorf("function %s %w in registry", name, manager.ErrNotFound)
+	}
+
+	return fr.read(name, versions[0])
+}
+
+// read loads the given version of function name.
+func (fr *FileRegistry) read(name string, version int) (manager.Function, string, error) {
+	var f manager.Function
+
+	p := path.Join(fr.dir, name, versionsDir, strconv.Itoa(version))
+
+	b, err := os.ReadFile(path.Join(p, functionFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return f, "", fmt.Errorf("version %d of function %s %w in registry", version, name, manager.ErrNotFound)
+		}
+		return f, "", err
+	}
+
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return f, "", err
+	}
+
+	return f, path.Join(p, archiveFile), nil
+}
+
+// GetVersion returns the given version of a function along with the path to
+// its archive.
+func (fr *FileRegistry) GetVersion(name string, version int) (manager.Function, string, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	return fr.read(name, version)
+}
+
+// Versions returns all stored versions of a function, newest first.
+func (fr *FileRegistry) Versions(name string) ([]manager.Function, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	versions, err := fr.archived(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("function %s %w in registry", name, manager.ErrNotFound)
+	}
+
+	list := make([]manager.Function, 0, len(versions))
+
+	for _, v := range versions {
+		f, _, err := fr.read(name, v)
+		if err != nil {
+			log.Printf("skipping version %d of function %s: %s", v, name, err)
+			continue
+		}
+
+		list = append(list, f)
+	}
+
+	return list, nil
+}
+
+func (fr *FileRegistry) Delete(name string) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	return os.RemoveAll(path.Join(fr.dir, name))
+}
+
+func (fr *FileRegistry) List() ([]manager.Function, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	entries, err := os.ReadDir(fr.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]manager.Function, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		f, _, err := fr.get(entry.Name())
+		if err != nil {
+			log.Printf("skipping registry entry %s: %s", entry.Name(), err)
+			continue
+		}
+
+		list = append(list, f)
+	}
+
+	return list, nil
+}
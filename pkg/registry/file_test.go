@@ -0,0 +1,233 @@
+package registry
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/OpenFogStack/tinyFaaS/pkg/manager"
+)
+
+func quiet(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+// put stores a version of function name whose archive holds content.
+func put(t *testing.T, fr *FileRegistry, name string, env string, content string) {
+	t.Helper()
+
+	archive := path.Join(t.TempDir(), "function.zip")
+
+	err := os.WriteFile(archive, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fr.Put(manager.Function{Name: name, Env: env, Envs: map[string]string{"SECRET": content}}, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check fails unless f is version of function name with the given env and
+// its archive at archive holds content.
+func check(t *testing.T, f manager.Function, archive string, version int, env string, content string) {
+	t.Helper()
+
+	if f.Version != version {
+		t.Errorf("got version %d, want %d", f.Version, version)
+	}
+
+	if f.Env != env || f.Envs["SECRET"] != content {
+		t.Errorf("version %d has env %s and envs %v, want %s and %s", version, f.Env, f.Envs, env, content)
+	}
+
+	b, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != content {
+		t.Errorf("version %d has archive %q, want %q", version, b, content)
+	}
+}
+
+func TestFileRegistryVersions(t *testing.T) {
+	quiet(t)
+
+	fr, err := NewFileRegistry(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put(t, fr, "fn", "python3", "v1")
+	put(t, fr, "fn", "nodejs", "v2")
+	put(t, fr, "other", "go", "other")
+
+	// Put keeps the previous version and makes the new one current
+	f, archive, err := fr.Get("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, f, archive, 2, "nodejs", "v2")
+
+	f, archive, err = fr.GetVersion("fn", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, f, archive, 1, "python3", "v1")
+
+	// versions are listed newest first and each function has its own
+	versions, err := fr.Versions("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 1 {
+		t.Fatalf("got versions %v, want 2 and 1", versions)
+	}
+
+	// a rollback stores the previous version as the newest one
+	f, archive, err = fr.GetVersion("fn", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fr.Put(f, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, archive, err = fr.Get("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, f, archive, 3, "python3", "v1")
+
+	// the oldest versions are removed
+	put(t, fr, "fn", "go", "v4")
+
+	versions, err = fr.Versions("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 3 || versions[0].Version != 4 || versions[2].Version != 2 {
+		t.Fatalf("got %d versions, want 4, 3 and 2", len(versions))
+	}
+
+	_, _, err = fr.GetVersion("fn", 1)
+	if !errors.Is(err, manager.ErrNotFound) {
+		t.Errorf("got %v for removed version, want %v", err, manager.ErrNotFound)
+	}
+
+	// the other function is left alone
+	f, archive, err = fr.Get("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, f, archive, 1, "go", "other")
+}
+
+func TestFileRegistryNotFound(t *testing.T) {
+	quiet(t)
+
+	fr, err := NewFileRegistry(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put(t, fr, "fn", "python3", "v1")
+
+	tests := map[string]func() error{
+		"unknown version": func() error {
+			_, _, err := fr.GetVersion("fn", 2)
+			return err
+		},
+		"unknown function": func() error {
+			_, _, err := fr.Get("nope")
+			return err
+		},
+		"versions of unknown function": func() error {
+			_, err := fr.Versions("nope")
+			return err
+		},
+		"version of unknown function": func() error {
+			_, _, err := fr.GetVersion("nope", 1)
+			return err
+		},
+	}
+
+	for name, get := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := get()
+			if !errors.Is(err, manager.ErrNotFound) {
+				t.Errorf("got %v, want %v", err, manager.ErrNotFound)
+			}
+		})
+	}
+
+	// after a delete, nothing is left
+	err = fr.Delete("fn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = fr.Get("fn")
+	if !errors.Is(err, manager.ErrNotFound) {
+		t.Errorf("got %v for deleted function, want %v", err, manager.ErrNotFound)
+	}
+
+	list, err := fr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 0 {
+		t.Errorf("got %d functions after delete, want none", len(list))
+	}
+}
+
+func TestFileRegistryPermissions(t *testing.T) {
+	quiet(t)
+
+	dir := t.TempDir()
+
+	fr, err := NewFileRegistry(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put(t, fr, "fn", "python3", "v1")
+
+	for p, want := range map[string]os.FileMode{
+		path.Join(dir, "fn"):                                 0700,
+		path.Join(dir, "fn", versionsDir, "1"):               0700,
+		path.Join(dir, "fn", versionsDir, "1", functionFile): 0600,
+	} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s has mode %s, want %s", p, fi.Mode().Perm(), want)
+		}
+	}
+
+	// nothing is left over from storing the version
+	entries, err := os.ReadDir(path.Join(dir, "fn", versionsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("got %d entries in versions, want 1", len(entries))
+	}
+}
@@ -0,0 +1,313 @@
+package rproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of AuthPolicy.
+const (
+	AuthAPIKey = "api-key"
+	AuthHMAC   = "hmac"
+	AuthJWT    = "jwt"
+)
+
+const (
+	// APIKeyHeader carries the key of a request to a function with an
+	// AuthAPIKey policy.
+	APIKeyHeader = "X-API-Key"
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of a request to a
+	// function with an AuthHMAC policy, see AuthPolicy.
+	SignatureHeader = "X-tinyFaaS-Signature"
+	// TimestampHeader carries the time a request was signed at, in seconds
+	// since the epoch.
+	TimestampHeader = "X-tinyFaaS-Timestamp"
+	// AuthorizationHeader carries the JWT of a request to a function with an
+	// AuthJWT policy as "Bearer <token>".
+	AuthorizationHeader = "Authorization"
+	// MaxClockSkew is how far the timestamp of a signed request and the
+	// validity of a JWT may be off from the current time.
+	MaxClockSkew = 5 * time.Minute
+)
+
+var (
+	// ErrUnauthenticated means that a request has no credentials or that
+	// they could not be verified.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden means that a request has valid credentials that do not
+	// grant access to the function.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// AuthPolicy restricts who may call a function. Requests must carry one of
+// APIKeys in the X-API-Key header (AuthAPIKey), be signed with Secret
+// (AuthHMAC), or carry a JWT that is signed by one of the keys in JWKSFile
+// (AuthJWT).
+//
+// A signed request has the current time in the X-tinyFaaS-Timestamp header
+// and the hex encoded HMAC-SHA256 of "<timestamp>.<body>" in the
+// X-tinyFaaS-Signature header.
+type AuthPolicy struct {
+	Type string `json:"type"`
+	// APIKeys are accepted in plain text, the management service replaces
+	// them with their SHA-256 in APIKeyHashes before storing the function
+	APIKeys      []string `json:"api_keys,omitempty"`
+	APIKeyHashes []string `json:"api_key_hashes,omitempty"`
+	// Secret is the shared secret of AuthHMAC
+	Secret string `json:"secret,omitempty"`
+	// JWKSFile is a JSON Web Key Set on the host of the rproxy. It is read
+	// again whenever it changes, so keys can be rotated without deploying
+	// the function again.
+	JWKSFile string `json:"jwks_file,omitempty"`
+	// Issuer and Audience, if set, must match the iss and aud claims
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	// Scopes must all be in the scope claim, otherwise the request is
+	// forbidden
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// HashKeys replaces the plain text APIKeys of p with their SHA-256.
+func (p *AuthPolicy) HashKeys() {
+	for _, k := range p.APIKeys {
+		h := sha256.Sum256([]byte(k))
+		p.APIKeyHashes = append(p.APIKeyHashes, hex.EncodeToString(h[:]))
+	}
+
+	p.APIKeys = nil
+}
+
+// Redacted returns a copy of p without its secret, e.g., to show it to
+// clients.
+func (p *AuthPolicy) Redacted() *AuthPolicy {
+	c := *p
+
+	if c.Secret != "" {
+		c.Secret = "redacted"
+	}
+
+	c.APIKeys = nil
+
+	return &c
+}
+
+// Validate checks that p is complete and, for AuthJWT, that its key set can
+// be read.
+func (p *AuthPolicy) Validate() error {
+	_, err := newAuthorizer(p)
+	return err
+}
+
+// authorizer checks requests against an AuthPolicy.
+type authorizer struct {
+	policy AuthPolicy
+	// keys are the SHA-256 of all API keys
+	keys [][sha256.Size]byte
+	jwks *jwks
+}
+
+func newAuthorizer(p *AuthPolicy) (*authorizer, error) {
+	a := &authorizer{
+		policy: *p,
+	}
+
+	switch p.Type {
+	case AuthAPIKey:
+		for _, k := range p.APIKeys {
+			a.keys = append(a.keys, sha256.Sum256([]byte(k)))
+		}
+
+		for _, k := range p.APIKeyHashes {
+			b, err := hex.DecodeString(k)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid api key hash %s", k)
+			}
+
+			a.keys = append(a.keys, [sha256.Size]byte(b))
+		}
+
+		if len(a.keys) == 0 {
+			return nil, fmt.Errorf("auth %s needs at least one api key", p.Type)
+		}
+	case AuthHMAC:
+		if p.Secret == "" {
+			return nil, fmt.Errorf("auth %s needs a secret", p.Type)
+		}
+	case AuthJWT:
+		if p.JWKSFile == "" {
+			return nil, fmt.Errorf("auth %s needs a jwks_file", p.Type)
+		}
+
+		a.jwks = &jwks{path: p.JWKSFile}
+
+		_, err := a.jwks.get()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth %s", p.Type)
+	}
+
+	return a, nil
+}
+
+// check returns nil if a request with payload and headers may call the
+// function. Otherwise, the error wraps ErrUnauthenticated or ErrForbidden.
+func (a *authorizer) check(payload []byte, headers map[string]string) error {
+	switch a.policy.Type {
+	case AuthAPIKey:
+		return a.checkAPIKey(headers)
+	case AuthHMAC:
+		return a.checkSignature(payload, headers)
+	case AuthJWT:
+		return a.checkJWT(headers)
+	}
+
+	return fmt.Errorf("%w: unknown auth %s", ErrUnauthenticated, a.policy.Type)
+}
+
+func (a *authorizer) checkAPIKey(headers map[string]string) error {
+	k, ok := lookupHeader(headers, APIKeyHeader)
+	if !ok || k == "" {
+		return fmt.Errorf("%w: missing %s", ErrUnauthenticated, APIKeyHeader)
+	}
+
+	h := sha256.Sum256([]byte(k))
+
+	// compare against every key so that the time taken does not tell which
+	// key was close
+	found := 0
+	for _, key := range a.keys {
+		found |= subtle.ConstantTimeCompare(h[:], key[:])
+	}
+
+	if found != 1 {
+		return fmt.Errorf("%w: invalid api key", ErrUnauthenticated)
+	}
+
+	return nil
+}
+
+func (a *authorizer) checkSignature(payload []byte, headers map[string]string) error {
+	sig, ok := lookupHeader(headers, SignatureHeader)
+	if !ok || sig == "" {
+		return fmt.Errorf("%w: missing %s", ErrUnauthenticated, SignatureHeader)
+	}
+
+	ts, ok := lookupHeader(headers, TimestampHeader)
+	if !ok || ts == "" {
+		return fmt.Errorf("%w: missing %s", ErrUnauthenticated, TimestampHeader)
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %s", ErrUnauthenticated, ts)
+	}
+
+	// an old signature may have been captured and replayed
+	if d := time.Since(time.Unix(sec, 0)); d > MaxClockSkew || d < -MaxClockSkew {
+		return fmt.Errorf("%w: timestamp %s is too far off", ErrUnauthenticated, ts)
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.policy.Secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+
+	return nil
+}
+
+func (a *authorizer) checkJWT(headers map[string]string) error {
+	v, _ := lookupHeader(headers, AuthorizationHeader)
+
+	token, ok := strings.CutPrefix(v, "Bearer ")
+	if !ok || token == "" {
+		return fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+
+	keys, err := a.jwks.get()
+	if err != nil {
+		// the key set was readable when the function was added, so keep
+		// going with what we have if possible
+		log.Printf("error reading %s: %s", a.jwks.path, err)
+		if keys == nil {
+			return fmt.Errorf("%w: no keys to verify token", ErrUnauthenticated)
+		}
+	}
+
+	c, err := verifyJWT(strings.TrimSpace(token), keys)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+
+	now := time.Now()
+
+	if c.Expires != nil && now.After(time.Unix(int64(*c.Expires), 0).Add(MaxClockSkew)) {
+		return fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	}
+
+	if c.NotBefore != nil && now.Before(time.Unix(int64(*c.NotBefore), 0).Add(-MaxClockSkew)) {
+		return fmt.Errorf("%w: token not valid yet", ErrUnauthenticated)
+	}
+
+	if a.policy.Issuer != "" && c.Issuer != a.policy.Issuer {
+		return fmt.Errorf("%w: token issued by %q", ErrUnauthenticated, c.Issuer)
+	}
+
+	if a.policy.Audience != "" && !c.hasAudience(a.policy.Audience) {
+		return fmt.Errorf("%w: token not meant for %q", ErrUnauthenticated, a.policy.Audience)
+	}
+
+	scopes := strings.Fields(c.Scope)
+	for _, s := range a.policy.Scopes {
+		found := false
+		for _, have := range scopes {
+			if have == s {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%w: token of %q lacks scope %s", ErrForbidden, c.Subject, s)
+		}
+	}
+
+	return nil
+}
+
+// withoutCredentials returns headers without those that carry credentials,
+// so that they are not kept after a request has been authorized.
+func withoutCredentials(headers map[string]string) map[string]string {
+	rest := make(map[string]string, len(headers))
+
+	for k, v := range headers {
+		switch {
+		case strings.EqualFold(k, APIKeyHeader),
+			strings.EqualFold(k, SignatureHeader),
+			strings.EqualFold(k, TimestampHeader),
+			strings.EqualFold(k, AuthorizationHeader):
+			continue
+		}
+		rest[k] = v
+	}
+
+	return rest
+}
@@ -0,0 +1,179 @@
+package rproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// quiet discards log output for the duration of a test.
+func quiet(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func TestAPIKey(t *testing.T) {
+	quiet(t)
+
+	hashed := &AuthPolicy{Type: AuthAPIKey, APIKeys: []string{"hashed-key"}}
+	hashed.HashKeys()
+
+	if len(hashed.APIKeys) != 0 || len(hashed.APIKeyHashes) != 1 {
+		t.Fatalf("HashKeys left %d plain and %d hashed keys, want 0 and 1", len(hashed.APIKeys), len(hashed.APIKeyHashes))
+	}
+
+	tests := map[string]struct {
+		policy  *AuthPolicy
+		headers map[string]string
+		err     error
+	}{
+		"plain key":      {&AuthPolicy{Type: AuthAPIKey, APIKeys: []string{"a", "b"}}, map[string]string{APIKeyHeader: "b"}, nil},
+		"hashed key":     {hashed, map[string]string{APIKeyHeader: "hashed-key"}, nil},
+		"canonical name": {hashed, map[string]string{"X-Api-Key": "hashed-key"}, nil},
+		"hash as key":    {hashed, map[string]string{APIKeyHeader: hashed.APIKeyHashes[0]}, ErrUnauthenticated},
+		"wrong key":      {hashed, map[string]string{APIKeyHeader: "other"}, ErrUnauthenticated},
+		"empty key":      {hashed, map[string]string{APIKeyHeader: ""}, ErrUnauthenticated},
+		"missing key":    {hashed, map[string]string{}, ErrUnauthenticated},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, err := newAuthorizer(tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = a.check(nil, tc.headers)
+			if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestAuthPolicyValidate(t *testing.T) {
+	tests := map[string]*AuthPolicy{
+		"unknown type":      {Type: "basic"},
+		"no api keys":       {Type: AuthAPIKey},
+		"invalid hash":      {Type: AuthAPIKey, APIKeyHashes: []string{"not-hex"}},
+		"short hash":        {Type: AuthAPIKey, APIKeyHashes: []string{"abcd"}},
+		"no secret":         {Type: AuthHMAC},
+		"no jwks":           {Type: AuthJWT},
+		"missing jwks":      {Type: AuthJWT, JWKSFile: "/nonexistent/jwks.json"},
+		"empty key set":     {Type: AuthJWT, JWKSFile: writeFile(t, `{"keys": []}`)},
+		"invalid key set":   {Type: AuthJWT, JWKSFile: writeFile(t, `{"keys": [{"kty": "RSA", "n": "!", "e": "AQAB"}]}`)},
+		"unsupported kty":   {Type: AuthJWT, JWKSFile: writeFile(t, `{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`)},
+		"point off curve":   {Type: AuthJWT, JWKSFile: writeFile(t, `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`)},
+		"unsupported curve": {Type: AuthJWT, JWKSFile: writeFile(t, `{"keys": [{"kty": "EC", "crv": "secp256k1", "x": "AQ", "y": "AQ"}]}`)},
+	}
+
+	for name, p := range tests {
+		t.Run(name, func(t *testing.T) {
+			if p.Validate() == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	p := &AuthPolicy{Type: AuthHMAC, Secret: "s3cret", APIKeys: []string{"key"}}
+
+	r := p.Redacted()
+	if r.Secret == p.Secret || len(r.APIKeys) != 0 {
+		t.Errorf("redacted policy still has secrets: %+v", r)
+	}
+
+	if p.Secret != "s3cret" || len(p.APIKeys) != 1 {
+		t.Errorf("Redacted changed the original policy: %+v", p)
+	}
+}
+
+// sign returns the signature headers of a request with body at time ts.
+func sign(secret string, ts time.Time, body string) map[string]string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "." + body))
+
+	return map[string]string{
+		TimestampHeader: t,
+		SignatureHeader: hex.EncodeToString(mac.Sum(nil)),
+	}
+}
+
+func TestSignature(t *testing.T) {
+	quiet(t)
+
+	a, err := newAuthorizer(&AuthPolicy{Type: AuthHMAC, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	// a signature captured earlier, replayed with a fresh timestamp
+	replayed := sign("s3cret", now.Add(-time.Minute), "body")
+	replayed[TimestampHeader] = strconv.FormatInt(now.Unix(), 10)
+
+	prefixed := sign("s3cret", now, "body")
+	prefixed[SignatureHeader] = "sha256=" + prefixed[SignatureHeader]
+
+	tests := map[string]struct {
+		body    string
+		headers map[string]string
+		err     error
+	}{
+		"valid":             {"body", sign("s3cret", now, "body"), nil},
+		"empty body":        {"", sign("s3cret", now, ""), nil},
+		"prefixed":          {"body", prefixed, nil},
+		"within skew":       {"body", sign("s3cret", now.Add(-MaxClockSkew+time.Minute), "body"), nil},
+		"old timestamp":     {"body", sign("s3cret", now.Add(-MaxClockSkew-time.Minute), "body"), ErrUnauthenticated},
+		"future timestamp":  {"body", sign("s3cret", now.Add(MaxClockSkew+time.Minute), "body"), ErrUnauthenticated},
+		"changed body":      {"other body", sign("s3cret", now, "body"), ErrUnauthenticated},
+		"replayed":          {"body", replayed, ErrUnauthenticated},
+		"wrong secret":      {"body", sign("other", now, "body"), ErrUnauthenticated},
+		"missing signature": {"body", map[string]string{TimestampHeader: strconv.FormatInt(now.Unix(), 10)}, ErrUnauthenticated},
+		"missing timestamp": {"body", map[string]string{SignatureHeader: sign("s3cret", now, "body")[SignatureHeader]}, ErrUnauthenticated},
+		"invalid timestamp": {"body", map[string]string{TimestampHeader: "yesterday", SignatureHeader: "00"}, ErrUnauthenticated},
+		"invalid signature": {"body", map[string]string{TimestampHeader: strconv.FormatInt(now.Unix(), 10), SignatureHeader: "xyz"}, ErrUnauthenticated},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := a.check([]byte(tc.body), tc.headers)
+			if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestWithoutCredentials(t *testing.T) {
+	headers := map[string]string{
+		"Authorization":        "Bearer token",
+		"X-Api-Key":            "key",
+		"X-Tinyfaas-Signature": "00",
+		"X-Tinyfaas-Timestamp": "0",
+		"Content-Type":         "text/plain",
+	}
+
+	rest := withoutCredentials(headers)
+
+	if len(rest) != 1 || rest["Content-Type"] != "text/plain" {
+		t.Errorf("got %v, want only Content-Type", rest)
+	}
+
+	if len(headers) != 5 {
+		t.Errorf("withoutCredentials changed its input")
+	}
+}
@@ -0,0 +1,157 @@
+package rproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BalancerRandom           = "random"
+	BalancerRoundRobin       = "round-robin"
+	BalancerLeastOutstanding = "least-outstanding"
+	BalancerConsistentHash   = "consistent-hash"
+)
+
+// Balancer chooses which handler of a function a request is sent to.
+type Balancer interface {
+	// Pick chooses one of handlers for a request with the given headers.
+	// handlers is never empty.
+	Pick(handlers []string, headers map[string]string) string
+	// Done is called once a request to handler h has finished.
+	Done(h string)
+}
+
+// NewBalancer creates a balancer for the given strategy. header is only used
+// for consistent hashing and names the request header to hash on. An empty
+// strategy selects random balancing.
+func NewBalancer(strategy string, header string) (Balancer, error) {
+	switch strategy {
+	case "", BalancerRandom:
+		return &randomBalancer{}, nil
+	case BalancerRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalancerLeastOutstanding:
+		return &leastOutstandingBalancer{
+			outstanding: make(map[string]int),
+		}, nil
+	case BalancerConsistentHash:
+		if header == "" {
+			return nil, fmt.Errorf("balancer %s needs a header to hash on", strategy)
+		}
+		return &consistentHashBalancer{
+			header: header,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancer %s", strategy)
+	}
+}
+
+// randomBalancer picks a random handler for every request.
+type randomBalancer struct{}
+
+func (b *randomBalancer) Pick(handlers []string, _ map[string]string) string {
+	return handlers[rand.Intn(len(handlers))]
+}
+
+func (b *randomBalancer) Done(string) {}
+
+// roundRobinBalancer cycles through all handlers.
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Pick(handlers []string, _ map[string]string) string {
+	n := b.next.Add(1) - 1
+	return handlers[n%uint64(len(handlers))]
+}
+
+func (b *roundRobinBalancer) Done(string) {}
+
+// leastOutstandingBalancer picks the handler with the fewest requests in
+// flight. Ties are broken randomly so that idle handlers share the load.
+type leastOutstandingBalancer struct {
+	outstanding map[string]int
+	mu          sync.Mutex
+}
+
+func (b *leastOutstandingBalancer) Pick(handlers []string, _ map[string]string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	offset := rand.Intn(len(handlers))
+	best := handlers[offset]
+
+	for i := range handlers {
+		h := handlers[(offset+i)%len(handlers)]
+		if b.outstanding[h] < b.outstanding[best] {
+			best = h
+		}
+	}
+
+	b.outstanding[best]++
+
+	return best
+}
+
+func (b *leastOutstandingBalancer) Done(h string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.outstanding[h]--
+
+	// forget about handlers that are idle, they may have been removed
+	if b.outstanding[h] <= 0 {
+		delete(b.outstanding, h)
+	}
+}
+
+// consistentHashBalancer sends all requests with the same value for header
+// to the same handler, as long as that handler exists. It uses rendezvous
+// hashing, so only requests for a removed handler move when handlers change.
+// Requests without the header are balanced randomly.
+type consistentHashBalancer struct {
+	header string
+}
+
+func (b *consistentHashBalancer) Pick(handlers []string, headers map[string]string) string {
+	key, ok := lookupHeader(headers, b.header)
+	if !ok {
+		return handlers[rand.Intn(len(handlers))]
+	}
+
+	var best string
+	var bestScore uint64
+
+	for _, h := range handlers {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(h))
+
+		score := hash.Sum64()
+		if best == "" || score > bestScore {
+			best = h
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+func (b *consistentHashBalancer) Done(string) {}
+
+// lookupHeader finds a header regardless of its case, as HTTP canonicalizes
+// header names and gRPC metadata keys are lowercase.
+func lookupHeader(headers map[string]string, name string) (string, bool) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+
+	return "", false
+}
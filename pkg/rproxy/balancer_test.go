@@ -0,0 +1,119 @@
+package rproxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewBalancer(t *testing.T) {
+	tests := map[string]struct {
+		strategy string
+		header   string
+		want     string
+		err      bool
+	}{
+		"default":                    {strategy: "", want: "*rproxy.randomBalancer"},
+		"random":                     {strategy: BalancerRandom, want: "*rproxy.randomBalancer"},
+		"round robin":                {strategy: BalancerRoundRobin, want: "*rproxy.roundRobinBalancer"},
+		"least outstanding":          {strategy: BalancerLeastOutstanding, want: "*rproxy.leastOutstandingBalancer"},
+		"consistent hash":            {strategy: BalancerConsistentHash, header: "X-User", want: "*rproxy.consistentHashBalancer"},
+		"consistent hash w/o header": {strategy: BalancerConsistentHash, err: true},
+		"unknown":                    {strategy: "fastest", err: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := NewBalancer(tc.strategy, tc.header)
+
+			if tc.err {
+				if err == nil {
+					t.Fatalf("got balancer %T, want an error", b)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprintf("%T", b); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b, _ := NewBalancer(BalancerRoundRobin, "")
+	handlers := []string{"a", "b", "c"}
+
+	for i := 0; i < 2*len(handlers); i++ {
+		if h := b.Pick(handlers, nil); h != handlers[i%len(handlers)] {
+			t.Fatalf("request %d went to %s, want %s", i, h, handlers[i%len(handlers)])
+		}
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	b, _ := NewBalancer(BalancerLeastOutstanding, "")
+	handlers := []string{"a", "b", "c"}
+
+	// requests that are in flight spread over all handlers
+	seen := make(map[string]bool)
+	for range handlers {
+		seen[b.Pick(handlers, nil)] = true
+	}
+
+	if len(seen) != len(handlers) {
+		t.Fatalf("requests in flight went to %d of %d handlers", len(seen), len(handlers))
+	}
+
+	// the handler that finished its request first gets the next one
+	b.Done("b")
+
+	for i := 0; i < 10; i++ {
+		h := b.Pick(handlers, nil)
+		if h != "b" {
+			t.Fatalf("request went to busy handler %s instead of idle b", h)
+		}
+		b.Done(h)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	b, _ := NewBalancer(BalancerConsistentHash, "X-User")
+	handlers := []string{"a", "b", "c", "d"}
+
+	picks := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		picks[user] = b.Pick(handlers, map[string]string{"X-User": user})
+	}
+
+	for user, h := range picks {
+		// the header name is matched regardless of its case
+		if got := b.Pick(handlers, map[string]string{"x-user": user}); got != h {
+			t.Fatalf("%s moved from %s to %s", user, h, got)
+		}
+	}
+
+	// only requests for a removed handler move
+	rest := []string{"a", "b", "d"}
+
+	moved := 0
+	for user, h := range picks {
+		got := b.Pick(rest, map[string]string{"X-User": user})
+
+		if h != "c" && got != h {
+			t.Errorf("%s moved from %s to %s although c was removed", user, h, got)
+		}
+
+		if h == "c" {
+			moved++
+		}
+	}
+
+	if moved == 0 || moved == len(picks) {
+		t.Errorf("%d of %d users were on c", moved, len(picks))
+	}
+}
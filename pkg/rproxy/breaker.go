@@ -0,0 +1,183 @@
+package rproxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+const (
+	// DefaultCircuitFailures is the number of failed requests in a row that
+	// open a circuit, unless the function sets its own.
+	DefaultCircuitFailures = 5
+	// DefaultCircuitCooldown is how long a circuit stays open, unless the
+	// function sets its own.
+	DefaultCircuitCooldown = 30 * time.Second
+)
+
+// CircuitBreaker makes requests to a function fail fast once Failures
+// requests in a row have failed, i.e., the handler could not be reached, the
+// request timed out, or the function returned a server error. After Cooldown
+// seconds, a single request is let through: if it succeeds, the circuit
+// closes again, otherwise it stays open for another Cooldown.
+type CircuitBreaker struct {
+	Failures int `json:"failures,omitempty"`
+	Cooldown int `json:"cooldown,omitempty"`
+}
+
+// Validate checks that c is complete.
+func (c *CircuitBreaker) Validate() error {
+	if c.Failures < 0 {
+		return fmt.Errorf("invalid failures %d", c.Failures)
+	}
+
+	if c.Cooldown < 0 {
+		return fmt.Errorf("invalid cooldown %d", c.Cooldown)
+	}
+
+	return nil
+}
+
+// outcome is what a request tells a circuit breaker.
+type outcome int
+
+const (
+	// outcomeNone is a request that says nothing about the function, e.g.,
+	// because its client went away or it was shed
+	outcomeNone outcome = iota
+	outcomeSuccess
+	outcomeFailure
+)
+
+// breaker enforces a CircuitBreaker. A nil breaker lets all requests
+// through.
+type breaker struct {
+	config   CircuitBreaker
+	failures int
+	cooldown time.Duration
+	mu       sync.Mutex
+	state    string
+	// consecutive failed requests
+	failed   int
+	openedAt time.Time
+	// trial is set while a request tests a half-open circuit
+	trial bool
+}
+
+func newBreaker(c *CircuitBreaker) *breaker {
+	b := &breaker{
+		config:   *c,
+		failures: c.Failures,
+		cooldown: time.Duration(c.Cooldown) * time.Second,
+		state:    CircuitClosed,
+	}
+
+	if b.failures == 0 {
+		b.failures = DefaultCircuitFailures
+	}
+
+	if b.cooldown == 0 {
+		b.cooldown = DefaultCircuitCooldown
+	}
+
+	return b
+}
+
+// allow reports whether a request may be sent. Every allowed request must
+// be followed by a call to record.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.trial = false
+		fallthrough
+	case CircuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the circuit with the outcome of a request.
+func (b *breaker) record(name string, o outcome) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitHalfOpen:
+		if !b.trial {
+			return
+		}
+
+		b.trial = false
+
+		switch o {
+		case outcomeSuccess:
+			log.Printf("circuit of function %s closed", name)
+			b.state = CircuitClosed
+			b.failed = 0
+		case outcomeFailure:
+			log.Printf("circuit of function %s opened again", name)
+			b.state = CircuitOpen
+			b.openedAt = time.Now()
+		}
+
+	case CircuitClosed:
+		switch o {
+		case outcomeSuccess:
+			b.failed = 0
+		case outcomeFailure:
+			b.failed++
+			if b.failed >= b.failures {
+				log.Printf("function %s failed %d times in a row, opening circuit for %s", name, b.failed, b.cooldown)
+				b.state = CircuitOpen
+				b.openedAt = time.Now()
+			}
+		}
+	}
+
+	// requests that were sent before the circuit opened do not matter
+}
+
+// current returns the state of the circuit.
+func (b *breaker) current() string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// an open circuit whose cooldown has passed lets the next request through
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+
+	return b.state
+}
@@ -0,0 +1,132 @@
+package rproxy
+
+import (
+	"testing"
+	"time"
+)
+
+// cool lets the cooldown of an open circuit pass.
+func cool(b *breaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.openedAt = time.Now().Add(-b.cooldown)
+}
+
+func TestBreaker(t *testing.T) {
+	quiet(t)
+
+	b := newBreaker(&CircuitBreaker{Failures: 3, Cooldown: 60})
+
+	if s := b.current(); s != CircuitClosed {
+		t.Fatalf("new circuit is %s", s)
+	}
+
+	// a success resets the count of failures in a row
+	for _, o := range []outcome{outcomeFailure, outcomeFailure, outcomeSuccess, outcomeFailure, outcomeFailure} {
+		if !b.allow() {
+			t.Fatal("closed circuit rejected a request")
+		}
+		b.record("fn", o)
+	}
+
+	if s := b.current(); s != CircuitClosed {
+		t.Fatalf("circuit is %s after two failures in a row", s)
+	}
+
+	b.allow()
+	b.record("fn", outcomeFailure)
+
+	if s := b.current(); s != CircuitOpen {
+		t.Fatalf("circuit is %s after three failures in a row", s)
+	}
+
+	if b.allow() {
+		t.Fatal("open circuit let a request through")
+	}
+
+	// after the cooldown, a single trial request is let through
+	cool(b)
+
+	if s := b.current(); s != CircuitHalfOpen {
+		t.Fatalf("circuit is %s after the cooldown", s)
+	}
+
+	if !b.allow() {
+		t.Fatal("half-open circuit rejected the trial request")
+	}
+
+	if b.allow() {
+		t.Fatal("half-open circuit let a second request through")
+	}
+
+	// a failed trial opens the circuit for another cooldown
+	b.record("fn", outcomeFailure)
+
+	if s := b.current(); s != CircuitOpen {
+		t.Fatalf("circuit is %s after a failed trial", s)
+	}
+
+	if b.allow() {
+		t.Fatal("reopened circuit let a request through")
+	}
+
+	// a trial that says nothing about the function lets the next one through
+	cool(b)
+
+	if !b.allow() {
+		t.Fatal("half-open circuit rejected the trial request")
+	}
+
+	b.record("fn", outcomeNone)
+
+	if s := b.current(); s != CircuitHalfOpen {
+		t.Fatalf("circuit is %s after a trial without outcome", s)
+	}
+
+	if !b.allow() {
+		t.Fatal("half-open circuit rejected the next trial request")
+	}
+
+	// a successful trial closes the circuit
+	b.record("fn", outcomeSuccess)
+
+	if s := b.current(); s != CircuitClosed {
+		t.Fatalf("circuit is %s after a successful trial", s)
+	}
+
+	// it takes failures in a row to open it again
+	b.allow()
+	b.record("fn", outcomeFailure)
+
+	if !b.allow() {
+		t.Fatal("closed circuit rejected a request after a single failure")
+	}
+	b.record("fn", outcomeSuccess)
+}
+
+func TestBreakerDefaults(t *testing.T) {
+	b := newBreaker(&CircuitBreaker{})
+
+	if b.failures != DefaultCircuitFailures {
+		t.Errorf("got %d failures, want %d", b.failures, DefaultCircuitFailures)
+	}
+
+	if b.cooldown != DefaultCircuitCooldown {
+		t.Errorf("got cooldown %s, want %s", b.cooldown, DefaultCircuitCooldown)
+	}
+
+	// without a circuit breaker, all requests are let through
+	var nb *breaker
+
+	for i := 0; i < 10; i++ {
+		if !nb.allow() {
+			t.Fatal("nil breaker rejected a request")
+		}
+		nb.record("fn", outcomeFailure)
+	}
+
+	if s := nb.current(); s != "" {
+		t.Errorf("nil breaker is %s", s)
+	}
+}
@@ -0,0 +1,96 @@
+package rproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// DefaultGroup is the name of the group of handlers of a function that is
+// added without any groups.
+const DefaultGroup = "default"
+
+// Group is a named set of handlers of a function, e.g., the handlers of one
+// version of the function. Each group receives a share of the requests to the
+// function according to its weight relative to the other groups.
+type Group struct {
+	Name   string   `json:"name"`
+	IPs    []string `json:"ips"`
+	Weight int      `json:"weight"`
+}
+
+// GroupStats describes the requests a group has received so far. Errors
+// counts requests that could not be delivered or that the function handler
+// answered with a server error.
+type GroupStats struct {
+	Weight   int   `json:"weight"`
+	Handlers int   `json:"handlers"`
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+}
+
+type group struct {
+	name     string
+	weight   int
+	handlers []string
+	balancer Balancer
+	requests atomic.Int64
+	errors   atomic.Int64
+}
+
+// validateGroups checks that groups have distinct names and valid weights.
+func validateGroups(groups []Group) error {
+	seen := make(map[string]struct{}, len(groups))
+
+	for _, g := range groups {
+		if g.Name == "" {
+			return fmt.Errorf("group without a name")
+		}
+
+		if _, ok := seen[g.Name]; ok {
+			return fmt.Errorf("duplicate group %s", g.Name)
+		}
+		seen[g.Name] = struct{}{}
+
+		if g.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for group %s", g.Weight, g.Name)
+		}
+	}
+
+	return nil
+}
+
+// pickGroup chooses a group for a request, weighted by the groups' weights.
+// Groups without handlers are skipped. If all groups with handlers have a
+// weight of zero, one of them is chosen at random. The caller must hold r.hl.
+func (f *function) pickGroup() *group {
+	candidates := make([]*group, 0, len(f.groups))
+	total := 0
+
+	for _, g := range f.groups {
+		if len(g.handlers) == 0 {
+			continue
+		}
+		candidates = append(candidates, g)
+		total += g.weight
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	n := rand.Intn(total)
+	for _, g := range candidates {
+		if n < g.weight {
+			return g
+		}
+		n -= g.weight
+	}
+
+	// not reached
+	return candidates[len(candidates)-1]
+}
@@ -0,0 +1,104 @@
+package rproxy
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidateGroups(t *testing.T) {
+	tests := map[string]struct {
+		groups []Group
+		err    bool
+	}{
+		"none":         {groups: nil},
+		"single":       {groups: []Group{{Name: "v1", IPs: []string{"10.0.0.1"}, Weight: 1}}},
+		"zero weights": {groups: []Group{{Name: "v1", Weight: 0}, {Name: "v2", Weight: 0}}},
+		"no name":      {groups: []Group{{Name: "", Weight: 1}}, err: true},
+		"duplicate":    {groups: []Group{{Name: "v1", Weight: 1}, {Name: "v1", Weight: 2}}, err: true},
+		"negative":     {groups: []Group{{Name: "v1", Weight: -1}}, err: true},
+		"canary":       {groups: []Group{{Name: "v1", Weight: 90}, {Name: "v2", Weight: 10}}},
+		"no ips":       {groups: []Group{{Name: "v1", IPs: []string{}, Weight: 1}}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validateGroups(tc.groups)
+
+			if tc.err && err == nil {
+				t.Error("got no error")
+			}
+
+			if !tc.err && err != nil {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestPickGroup(t *testing.T) {
+	type g struct {
+		handlers int
+		weight   int
+	}
+
+	tests := map[string]struct {
+		groups []g
+		// share of requests each group receives, or -1 if no group is picked
+		want []float64
+	}{
+		"weighted":       {groups: []g{{1, 3}, {1, 1}}, want: []float64{0.75, 0.25}},
+		"single":         {groups: []g{{2, 1}}, want: []float64{1}},
+		"zero weight":    {groups: []g{{1, 1}, {1, 0}}, want: []float64{1, 0}},
+		"all zero":       {groups: []g{{1, 0}, {1, 0}}, want: []float64{0.5, 0.5}},
+		"no handlers":    {groups: []g{{0, 3}, {1, 1}}, want: []float64{0, 1}},
+		"none available": {groups: []g{{0, 1}, {0, 1}}, want: []float64{-1}},
+		"no groups":      {groups: nil, want: []float64{-1}},
+	}
+
+	const n = 10000
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := &function{}
+			index := make(map[*group]int)
+
+			for i, c := range tc.groups {
+				gr := &group{weight: c.weight}
+				for j := 0; j < c.handlers; j++ {
+					gr.handlers = append(gr.handlers, "h")
+				}
+				f.groups = append(f.groups, gr)
+				index[gr] = i
+			}
+
+			counts := make([]int, len(tc.groups))
+			for i := 0; i < n; i++ {
+				gr := f.pickGroup()
+
+				if gr == nil {
+					if tc.want[0] != -1 {
+						t.Fatal("no group was picked")
+					}
+					continue
+				}
+
+				if tc.want[0] == -1 {
+					t.Fatal("picked a group without handlers")
+				}
+
+				counts[index[gr]]++
+			}
+
+			if tc.want[0] == -1 {
+				return
+			}
+
+			for i, want := range tc.want {
+				got := float64(counts[i]) / n
+				if math.Abs(got-want) > 0.03 {
+					t.Errorf("group %d got %.2f of the requests, want %.2f", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package rproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HealthCheckInterval is how often the health of each handler is
+	// checked.
+	HealthCheckInterval = 5 * time.Second
+	// HealthCheckTimeout is how long a handler has to answer a health check.
+	HealthCheckTimeout = 2 * time.Second
+	// UnhealthyThreshold is the number of consecutive failures (health checks
+	// or requests) after which a handler no longer receives requests.
+	UnhealthyThreshold = 3
+)
+
+// ReplicaState describes the health of a single handler of a function.
+type ReplicaState struct {
+	Address   string    `json:"address"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// replicaHealth tracks the health of a handler. New handlers are considered
+// healthy, as the manager only adds them once they are ready.
+type replicaHealth struct {
+	healthy   bool
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// updateHealth keeps the health of handlers that remain and starts tracking
+// new ones. The caller must hold r.hl.
+func (f *function) updateHealth(handlers []string) {
+	f.hm.Lock()
+	defer f.hm.Unlock()
+
+	health := make(map[string]*replicaHealth, len(handlers))
+	for _, h := range handlers {
+		if rh, ok := f.health[h]; ok {
+			health[h] = rh
+			continue
+		}
+		health[h] = &replicaHealth{
+			healthy: true,
+		}
+	}
+
+	f.health = health
+}
+
+// healthy returns the handlers that currently receive requests. If all
+// handlers are unhealthy, all of them are returned, as failing some requests
+// is better than failing all of them.
+func (f *function) healthy(handlers []string) []string {
+	f.hm.Lock()
+	defer f.hm.Unlock()
+
+	healthy := make([]string, 0, len(handlers))
+	for _, h := range handlers {
+		if rh, ok := f.health[h]; !ok || rh.healthy {
+			healthy = append(healthy, h)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return handlers
+	}
+
+	return healthy
+}
+
+// reportSuccess marks a handler as healthy.
+func (f *function) reportSuccess(h string) {
+	f.hm.Lock()
+	defer f.hm.Unlock()
+
+	rh, ok := f.health[h]
+	if !ok {
+		return
+	}
+
+	if !rh.healthy {
+		log.Printf("handler %s is healthy again", h)
+	}
+
+	rh.healthy = true
+	rh.failures = 0
+	rh.lastError = ""
+}
+
+// reportFailure counts a failed health check or request for a handler and
+// ejects it once it has failed too often in a row.
+func (f *function) reportFailure(h string, err error) {
+	f.hm.Lock()
+	defer f.hm.Unlock()
+
+	rh, ok := f.health[h]
+	if !ok {
+		return
+	}
+
+	rh.failures++
+	rh.lastError = err.Error()
+
+	if rh.healthy && rh.failures >= UnhealthyThreshold {
+		log.Printf("handler %s failed %d times in a row, ejecting it: %s", h, rh.failures, err)
+		rh.healthy = false
+	}
+}
+
+// reportCallFailure counts a failed request for a handler, unless it failed
+// because it was cancelled or ran out of time, as a slow function or a client
+// that went away says nothing about whether the handler can be reached.
+func (f *function) reportCallFailure(ctx context.Context, h string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	f.reportFailure(h, err)
+}
+
+// Replicas returns the health of all handlers of all functions.
+func (r *RProxy) Replicas() map[string][]ReplicaState {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	replicas := make(map[string][]ReplicaState, len(r.hosts))
+	for name, f := range r.hosts {
+		f.hm.Lock()
+		states := make([]ReplicaState, 0, len(f.handlers))
+		for _, h := range f.handlers {
+			rh, ok := f.health[h]
+			if !ok {
+				continue
+			}
+			states = append(states, ReplicaState{
+				Address:   h,
+				Healthy:   rh.healthy,
+				Failures:  rh.failures,
+				LastCheck: rh.lastCheck,
+				LastError: rh.lastError,
+			})
+		}
+		f.hm.Unlock()
+
+		replicas[name] = states
+	}
+
+	return replicas
+}
+
+// checkHealth periodically calls the health endpoint of every handler.
+func (r *RProxy) checkHealth() {
+	client := &http.Client{
+		Timeout: HealthCheckTimeout,
+	}
+
+	t := time.NewTicker(HealthCheckInterval)
+	defer t.Stop()
+
+	for range t.C {
+		type target struct {
+			f *function
+			h string
+		}
+
+		r.hl.RLock()
+		targets := make([]target, 0, len(r.hosts))
+		for _, f := range r.hosts {
+			for _, h := range f.handlers {
+				targets = append(targets, target{f: f, h: h})
+			}
+		}
+		r.hl.RUnlock()
+
+		wg := sync.WaitGroup{}
+		for _, t := range targets {
+			wg.Add(1)
+			go func(f *function, h string) {
+				defer wg.Done()
+
+				err := probe(client, h)
+
+				f.hm.Lock()
+				if rh, ok := f.health[h]; ok {
+					rh.lastCheck = time.Now()
+				}
+				f.hm.Unlock()
+
+				if err != nil {
+					f.reportFailure(h, err)
+					return
+				}
+
+				f.reportSuccess(h)
+			}(t.f, t.h)
+		}
+		wg.Wait()
+	}
+}
+
+// probe calls the health endpoint of handler h.
+func probe(client *http.Client, h string) error {
+	resp, err := client.Get(fmt.Sprintf("http://%s/health", h))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,545 @@
+package rproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// States of an asynchronous invocation.
+const (
+	InvocationQueued    = "queued"
+	InvocationRunning   = "running"
+	InvocationSucceeded = "succeeded"
+	// InvocationDead means the invocation failed too often and was moved to
+	// the dead-letter queue.
+	InvocationDead = "dead"
+)
+
+const (
+	// InvocationWorkers is the number of asynchronous invocations that run
+	// at the same time.
+	InvocationWorkers = 16
+	// MaxPendingInvocations is the number of asynchronous invocations that
+	// may wait to be run. Further asynchronous requests are shed.
+	MaxPendingInvocations = 10000
+	// InvocationAttempts is how often an asynchronous invocation is tried
+	// before it is moved to the dead-letter queue.
+	InvocationAttempts = 5
+	// InvocationBackoff is how long to wait before the first retry of an
+	// asynchronous invocation. The wait doubles with every retry.
+	InvocationBackoff = time.Second
+	// InvocationRetention is how long the results of asynchronous
+	// invocations are kept. Dead letters are kept until they are deleted.
+	InvocationRetention = 24 * time.Hour
+	// InvocationStartupGrace is how long after the rproxy starts requests to
+	// unknown functions do not count as attempts, as the management service
+	// may still be restoring them.
+	InvocationStartupGrace = 5 * time.Minute
+	// InvocationPath is the path under which the HTTP endpoint reports on
+	// asynchronous invocations.
+	InvocationPath = "/_invocations/"
+)
+
+// ErrInvocationNotFound is returned for unknown invocation IDs.
+var ErrInvocationNotFound = errors.New("invocation not found")
+
+// Invocation is an asynchronous request to a function. Result is the
+// response of the function once it has succeeded.
+type Invocation struct {
+	ID       string    `json:"id"`
+	Function string    `json:"function"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	// Code is the status code the function answered with
+	Code   int    `json:"code,omitempty"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// invocation is an Invocation along with its request, as it is stored on
+// disk. The request is dropped once the invocation has succeeded.
+type invocation struct {
+	Invocation
+	Payload []byte            `json:"payload,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// invocations runs asynchronous requests. Every invocation is written to a
+// file in dir before it is accepted and whenever its state changes, so that
+// invocations that were pending when the rproxy stopped are run once it is
+// started again. Without a dir, invocations are only kept in memory.
+type invocations struct {
+	r       *RProxy
+	dir     string
+	started time.Time
+	all     map[string]*invocation
+	mu      sync.Mutex
+	pending chan string
+}
+
+// newInvocations loads the invocations in dir and starts the workers.
+func newInvocations(r *RProxy, dir string) *invocations {
+	q := &invocations{
+		r:       r,
+		dir:     dir,
+		started: time.Now(),
+		all:     make(map[string]*invocation),
+		pending: make(chan string, MaxPendingInvocations),
+	}
+
+	var recovered []string
+
+	if dir != "" {
+		err := os.MkdirAll(filepath.Join(dir, InvocationDead), 0700)
+		if err != nil {
+			log.Printf("error creating invocation directory %s, keeping invocations in memory only: %s", dir, err)
+			q.dir = ""
+		}
+	}
+
+	if q.dir != "" {
+		recovered = q.load()
+	}
+
+	for i := 0; i < InvocationWorkers; i++ {
+		go q.work()
+	}
+
+	// there may be more recovered invocations than fit in the queue
+	go func() {
+		for _, id := range recovered {
+			for !q.enqueue(id) {
+				time.Sleep(InvocationBackoff)
+			}
+		}
+	}()
+
+	go q.expire()
+
+	return q
+}
+
+// load reads all stored invocations and returns the IDs of those that have
+// not finished, oldest first.
+func (q *invocations) load() []string {
+	var files []string
+	for _, pattern := range []string{"*.json", filepath.Join(InvocationDead, "*.json")} {
+		f, err := filepath.Glob(filepath.Join(q.dir, pattern))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		files = append(files, f...)
+	}
+
+	var recovered []*invocation
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		var inv invocation
+
+		err = json.Unmarshal(b, &inv)
+		if err != nil || inv.ID == "" {
+			log.Printf("ignoring invalid invocation %s: %v", file, err)
+			continue
+		}
+
+		q.all[inv.ID] = &inv
+
+		// whatever was running when the rproxy stopped is run again
+		if inv.Status == InvocationQueued || inv.Status == InvocationRunning {
+			inv.Status = InvocationQueued
+			recovered = append(recovered, &inv)
+		}
+	}
+
+	sort.Slice(recovered, func(i, j int) bool {
+		return recovered[i].Created.Before(recovered[j].Created)
+	})
+
+	ids := make([]string, len(recovered))
+	for i, inv := range recovered {
+		ids[i] = inv.ID
+	}
+
+	log.Printf("loaded %d invocations from %s, %d still pending", len(q.all), q.dir, len(ids))
+
+	return ids
+}
+
+// path returns the file an invocation is stored in.
+func (q *invocations) path(inv *invocation) string {
+	if inv.Status == InvocationDead {
+		return filepath.Join(q.dir, InvocationDead, inv.ID+".json")
+	}
+
+	return filepath.Join(q.dir, inv.ID+".json")
+}
+
+// store writes an invocation to disk, replacing the previous version
+// atomically. The caller must hold q.mu.
+func (q *invocations) store(inv *invocation) error {
+	if q.dir == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	p := q.path(inv)
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".invocation-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if err == nil {
+		// an accepted invocation must survive a crash
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// remove deletes the file of an invocation. The caller must hold q.mu.
+func (q *invocations) remove(inv *invocation) {
+	if q.dir == "" {
+		return
+	}
+
+	err := os.Remove(q.path(inv))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Print(err)
+	}
+}
+
+// submit stores a new invocation and queues it.
+func (q *invocations) submit(name string, payload []byte, headers map[string]string) (string, Status) {
+	now := time.Now()
+
+	inv := &invocation{
+		Invocation: Invocation{
+			ID:       uuid.New().String(),
+			Function: name,
+			Status:   InvocationQueued,
+			Created:  now,
+			Updated:  now,
+		},
+		Payload: payload,
+		// credentials are not stored, as the request has already been
+		// authorized
+		Headers: withoutCredentials(headers),
+	}
+
+	// spare storing an invocation that is shed anyway
+	if len(q.pending) >= cap(q.pending) {
+		log.Printf("too many pending invocations, shedding request to %s", name)
+		return "", StatusOverloaded
+	}
+
+	q.mu.Lock()
+	err := q.store(inv)
+	if err == nil {
+		q.all[inv.ID] = inv
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		log.Printf("error storing invocation of %s: %s", name, err)
+		return "", StatusError
+	}
+
+	if !q.enqueue(inv.ID) {
+		log.Printf("too many pending invocations, shedding request to %s", name)
+
+		q.mu.Lock()
+		q.remove(inv)
+		delete(q.all, inv.ID)
+		q.mu.Unlock()
+
+		return "", StatusOverloaded
+	}
+
+	return inv.ID, StatusAccepted
+}
+
+// enqueue hands an invocation to the workers and reports whether there was
+// room for it. It never blocks, so it may be called while holding q.mu.
+func (q *invocations) enqueue(id string) bool {
+	select {
+	case q.pending <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueAfter hands an invocation to the workers after wait. While there is
+// no room for it, it tries again every InvocationBackoff.
+func (q *invocations) enqueueAfter(id string, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		if !q.enqueue(id) {
+			q.enqueueAfter(id, InvocationBackoff)
+		}
+	})
+}
+
+// work runs pending invocations.
+func (q *invocations) work() {
+	for id := range q.pending {
+		q.run(id)
+	}
+}
+
+// run tries an invocation once and schedules a retry if it fails.
+func (q *invocations) run(id string) {
+	q.mu.Lock()
+	inv, ok := q.all[id]
+	if !ok || inv.Status != InvocationQueued {
+		q.mu.Unlock()
+		return
+	}
+
+	inv.Status = InvocationRunning
+	inv.Attempts++
+	inv.Updated = time.Now()
+	q.storeLocked(inv)
+	name, payload, headers := inv.Function, inv.Payload, inv.Headers
+	q.mu.Unlock()
+
+	status, code, body := q.r.invoke(context.Background(), name, payload, headers)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// the invocation may have been deleted in the meantime
+	if _, ok := q.all[id]; !ok {
+		return
+	}
+
+	inv.Updated = time.Now()
+
+	if status == StatusOK && code < http.StatusInternalServerError {
+		inv.Status = InvocationSucceeded
+		inv.Code = code
+		inv.Result = string(body)
+		inv.Error = ""
+		// the request is no longer needed
+		inv.Payload = nil
+		inv.Headers = nil
+		q.storeLocked(inv)
+		return
+	}
+
+	inv.Error = invocationError(status, code, body)
+
+	// functions may not be known yet right after the rproxy has started
+	if status == StatusNotFound && time.Since(q.started) < InvocationStartupGrace {
+		inv.Attempts--
+	}
+
+	if inv.Attempts >= InvocationAttempts {
+		log.Printf("invocation %s of %s failed %d times, moving it to the dead-letter queue: %s", id, name, inv.Attempts, inv.Error)
+		q.remove(inv)
+		inv.Status = InvocationDead
+		q.storeLocked(inv)
+		return
+	}
+
+	inv.Status = InvocationQueued
+	q.storeLocked(inv)
+
+	wait := InvocationBackoff << min(max(inv.Attempts-1, 0), 10)
+	log.Printf("invocation %s of %s failed, retrying in %s: %s", id, name, wait, inv.Error)
+
+	q.enqueueAfter(id, wait)
+}
+
+// storeLocked stores inv and logs errors, as the invocation goes on either
+// way. The caller must hold q.mu.
+func (q *invocations) storeLocked(inv *invocation) {
+	err := q.store(inv)
+	if err != nil {
+		log.Printf("error storing invocation %s: %s", inv.ID, err)
+	}
+}
+
+// invocationError describes why an attempt of an invocation failed.
+func invocationError(status Status, code int, body []byte) string {
+	switch status {
+	case StatusOK:
+		return fmt.Sprintf("function returned status %d: %s", code, strings.TrimSpace(string(body)))
+	case StatusNotFound:
+		return "function not found"
+	case StatusOverloaded:
+		return "function overloaded"
+	case StatusTimeout:
+		return "function timed out"
+	case StatusCircuitOpen:
+		return "circuit of function open"
+	default:
+		return "error calling function"
+	}
+}
+
+// expire drops the results of invocations that finished longer than
+// InvocationRetention ago.
+func (q *invocations) expire() {
+	for range time.Tick(time.Minute) {
+		q.mu.Lock()
+		for id, inv := range q.all {
+			if inv.Status == InvocationSucceeded && time.Since(inv.Updated) > InvocationRetention {
+				q.remove(inv)
+				delete(q.all, id)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// get returns an invocation.
+func (q *invocations) get(id string) (Invocation, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	inv, ok := q.all[id]
+	if !ok {
+		return Invocation{}, false
+	}
+
+	return inv.Invocation, true
+}
+
+// Invocation returns the state of an asynchronous invocation. If the function
+// has an access policy, the request for it must satisfy that policy, too.
+func (r *RProxy) Invocation(id string, headers map[string]string) (Invocation, Status) {
+	inv, ok := r.invocations.get(id)
+	if !ok {
+		return Invocation{}, StatusNotFound
+	}
+
+	r.hl.RLock()
+	var auth *authorizer
+	if f, ok := r.hosts[inv.Function]; ok {
+		auth = f.auth
+	}
+	r.hl.RUnlock()
+
+	if auth != nil {
+		err := auth.check(nil, headers)
+		if err != nil {
+			log.Printf("rejected request for invocation %s of %s: %s", id, inv.Function, err)
+			if errors.Is(err, ErrForbidden) {
+				return Invocation{}, StatusForbidden
+			}
+			return Invocation{}, StatusUnauthorized
+		}
+	}
+
+	return inv, StatusOK
+}
+
+// DeadLetters returns all invocations in the dead-letter queue, oldest
+// first.
+func (r *RProxy) DeadLetters() []Invocation {
+	q := r.invocations
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dead := make([]Invocation, 0)
+	for _, inv := range q.all {
+		if inv.Status == InvocationDead {
+			dead = append(dead, inv.Invocation)
+		}
+	}
+
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].Created.Before(dead[j].Created)
+	})
+
+	return dead
+}
+
+// Requeue takes an invocation out of the dead-letter queue and tries it
+// again, with a fresh count of attempts.
+func (r *RProxy) Requeue(id string) error {
+	q := r.invocations
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	inv, ok := q.all[id]
+	if !ok || inv.Status != InvocationDead {
+		return ErrInvocationNotFound
+	}
+
+	if len(q.pending) >= cap(q.pending) {
+		return fmt.Errorf("too many pending invocations")
+	}
+
+	q.remove(inv)
+	inv.Status = InvocationQueued
+	inv.Attempts = 0
+	inv.Updated = time.Now()
+
+	err := q.store(inv)
+	if err != nil {
+		return err
+	}
+
+	// the queue may have filled up since, the invocation is run later then
+	if !q.enqueue(id) {
+		q.enqueueAfter(id, InvocationBackoff)
+	}
+
+	return nil
+}
+
+// DeleteDeadLetter removes an invocation from the dead-letter queue for
+// good.
+func (r *RProxy) DeleteDeadLetter(id string) error {
+	q := r.invocations
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	inv, ok := q.all[id]
+	if !ok || inv.Status != InvocationDead {
+		return ErrInvocationNotFound
+	}
+
+	q.remove(inv)
+	delete(q.all, id)
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package rproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to a temporary file and returns its path.
+func writeFile(t testing.TB, content string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "file")
+
+	err := os.WriteFile(p, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// testKeys are the signing keys of the tests, by kid.
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	p256  *ecdsa.PrivateKey
+	p384  *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	jwks  string
+	keyOf map[string]crypto.Signer
+}
+
+func newTestKeys(t testing.TB) *testKeys {
+	t.Helper()
+
+	k := &testKeys{}
+
+	var err error
+
+	k.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, k.ed, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.keyOf = map[string]crypto.Signer{
+		"rsa":  k.rsa,
+		"p256": k.p256,
+		"p384": k.p384,
+		"ed":   k.ed,
+	}
+
+	ecJWK := func(kid string, crv string, key *ecdsa.PrivateKey) map[string]string {
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"kid": kid,
+			"crv": crv,
+			"x":   b64(key.X.FillBytes(make([]byte, size))),
+			"y":   b64(key.Y.FillBytes(make([]byte, size))),
+		}
+	}
+
+	set := map[string]any{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				// the key may only be used with RS256
+				"alg": "RS256",
+				"n":   b64(k.rsa.N.Bytes()),
+				"e":   b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+			},
+			ecJWK("p256", "P-256", k.p256),
+			ecJWK("p384", "P-384", k.p384),
+			{
+				"kty": "OKP",
+				"kid": "ed",
+				"crv": "Ed25519",
+				"x":   b64(k.ed.Public().(ed25519.PublicKey)),
+			},
+			// encryption keys are ignored
+			{
+				"kty": "OKP",
+				"kid": "enc",
+				"use": "enc",
+				"crv": "X25519",
+				"x":   b64(make([]byte, 32)),
+			},
+		},
+	}
+
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.jwks = writeFile(t, string(b))
+
+	return k
+}
+
+// token signs claims with the key kid for alg. The header names headerKid,
+// which may differ from kid.
+func (k *testKeys) token(t testing.TB, alg string, kid string, headerKid string, c map[string]any) string {
+	t.Helper()
+
+	h, err := json.Marshal(map[string]string{"alg": alg, "kid": headerKid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := b64(h) + "." + b64(p)
+
+	var hash crypto.Hash
+	var digest []byte
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+		d := sha256.Sum256([]byte(signed))
+		digest = d[:]
+	case "384":
+		hash = crypto.SHA384
+		d := sha512.Sum384([]byte(signed))
+		digest = d[:]
+	}
+
+	var sig []byte
+
+	switch key := k.keyOf[kid].(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, key, hash, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestJWT(t *testing.T) {
+	quiet(t)
+
+	keys := newTestKeys(t)
+
+	a, err := newAuthorizer(&AuthPolicy{
+		Type:     AuthJWT,
+		JWKSFile: keys.jwks,
+		Issuer:   "issuer",
+		Audience: "tinyfaas",
+		Scopes:   []string{"invoke"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	// claims returns valid claims with changes applied
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   "issuer",
+			"sub":   "client",
+			"aud":   "tinyfaas",
+			"exp":   now.Add(time.Hour).Unix(),
+			"nbf":   now.Add(-time.Minute).Unix(),
+			"scope": "read invoke",
+		}
+
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+
+		return c
+	}
+
+	valid := keys.token(t, "ES256", "p256", "p256", claims(nil))
+
+	// HS256 with the public key of the RSA key as the secret, for libraries
+	// that confuse the two
+	pub, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsHeader := b64([]byte(`{"alg":"HS256","kid":"rsa"}`)) + "." + b64([]byte(`{"iss":"issuer","aud":"tinyfaas","scope":"invoke"}`))
+	mac := hmac.New(sha256.New, pub)
+	mac.Write([]byte(hsHeader))
+	hs := hsHeader + "." + b64(mac.Sum(nil))
+
+	parts := strings.Split(valid, ".")
+	none := b64([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	tampered := parts[0] + "." + b64([]byte(`{"iss":"issuer","aud":"tinyfaas","scope":"invoke admin"}`)) + "." + parts[2]
+
+	tests := map[string]struct {
+		token string
+		err   error
+	}{
+		"RS256":           {keys.token(t, "RS256", "rsa", "rsa", claims(nil)), nil},
+		"ES256":           {valid, nil},
+		"ES384":           {keys.token(t, "ES384", "p384", "p384", claims(nil)), nil},
+		"EdDSA":           {keys.token(t, "EdDSA", "ed", "ed", claims(nil)), nil},
+		"no kid":          {keys.token(t, "EdDSA", "ed", "", claims(nil)), nil},
+		"audience list":   {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"aud": []string{"other", "tinyfaas"}})), nil},
+		"no exp or nbf":   {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"exp": nil, "nbf": nil})), nil},
+		"expired in skew": {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), nil},
+		"alg none":        {none, ErrUnauthenticated},
+		"HS256":           {hs, ErrUnauthenticated},
+		"tampered claims": {tampered, ErrUnauthenticated},
+		"kid mismatch":    {keys.token(t, "ES256", "p256", "ed", claims(nil)), ErrUnauthenticated},
+		"unknown kid":     {keys.token(t, "ES256", "p256", "other", claims(nil)), ErrUnauthenticated},
+		"alg of key":      {keys.token(t, "PS256", "rsa", "rsa", claims(nil)), ErrUnauthenticated},
+		"ES256 on P-384":  {keys.token(t, "ES256", "p384", "p384", claims(nil)), ErrUnauthenticated},
+		"ES384 on P-256":  {keys.token(t, "ES384", "p256", "p256", claims(nil)), ErrUnauthenticated},
+		"EdDSA as ES256":  {keys.token(t, "ES256", "ed", "ed", claims(nil)), ErrUnauthenticated},
+		"expired":         {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"exp": now.Add(-MaxClockSkew - time.Minute).Unix()})), ErrUnauthenticated},
+		"not yet valid":   {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"nbf": now.Add(MaxClockSkew + time.Minute).Unix()})), ErrUnauthenticated},
+		"wrong issuer":    {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"iss": "other"})), ErrUnauthenticated},
+		"no issuer":       {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"iss": nil})), ErrUnauthenticated},
+		"wrong audience":  {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"aud": "other"})), ErrUnauthenticated},
+		"no audience":     {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"aud": nil})), ErrUnauthenticated},
+		"missing scope":   {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"scope": "read"})), ErrForbidden},
+		"scope prefix":    {keys.token(t, "ES256", "p256", "p256", claims(map[string]any{"scope": "invoker"})), ErrForbidden},
+		"malformed":       {"not.a.jwt", ErrUnauthenticated},
+		"too many parts":  {valid + ".x", ErrUnauthenticated},
+		"empty":           {"", ErrUnauthenticated},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := a.check(nil, map[string]string{AuthorizationHeader: "Bearer " + tc.token})
+			if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	t.Run("no bearer", func(t *testing.T) {
+		err := a.check(nil, map[string]string{AuthorizationHeader: "Basic " + valid})
+		if !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("got %v, want %v", err, ErrUnauthenticated)
+		}
+	})
+}
+
+func TestJWKSRotation(t *testing.T) {
+	quiet(t)
+
+	keys := newTestKeys(t)
+	other := newTestKeys(t)
+
+	a, err := newAuthorizer(&AuthPolicy{Type: AuthJWT, JWKSFile: keys.jwks})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := other.token(t, "EdDSA", "ed", "ed", map[string]any{"sub": "client"})
+	headers := map[string]string{AuthorizationHeader: "Bearer " + token}
+
+	if err := a.check(nil, headers); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("token of unknown key: got %v, want %v", err, ErrUnauthenticated)
+	}
+
+	b, err := os.ReadFile(other.jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(keys.jwks, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the change is noticed on file systems with coarse times
+	future := time.Now().Add(time.Minute)
+	err = os.Chtimes(keys.jwks, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.check(nil, headers); err != nil {
+		t.Errorf("token of rotated key: got %v", err)
+	}
+
+	// a broken key set does not lock everyone out
+	err = os.WriteFile(keys.jwks, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future = future.Add(time.Minute)
+	err = os.Chtimes(keys.jwks, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.check(nil, headers); err != nil {
+		t.Errorf("token after broken key set: got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package rproxy
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultQueueSize is the maximum number of requests that wait for a
+	// free handler of a function with a concurrency limit, unless the
+	// function sets its own.
+	DefaultQueueSize = 100
+	// DefaultQueueTimeout is how long a request waits for a free handler,
+	// unless the function sets its own.
+	DefaultQueueTimeout = 10 * time.Second
+)
+
+// waiter is a request that waits for a free handler.
+type waiter struct {
+	group    *group
+	handlers []string
+	balancer Balancer
+	headers  map[string]string
+	// exclude are handlers the request must not be sent to
+	exclude map[string]bool
+	// ready receives the handler the request is sent to
+	ready chan string
+}
+
+// acquire chooses one of handlers of group g for a request and counts it as
+// in flight on that handler. If the function limits how many requests each
+// handler serves at once and all handlers are busy, the request is queued
+// until a handler is free. acquire returns the group and balancer that chose
+// the handler, which may differ from g and balancer if the handlers changed
+// while the request was queued. If the queue is full or the request has
+// waited for timeout, the request is shed. A request also stops waiting when
+// ctx is done. Handlers in exclude are never chosen, and if there are no
+// others, acquire fails right away.
+func (f *function) acquire(ctx context.Context, g *group, handlers []string, exclude map[string]bool, balancer Balancer, headers map[string]string, queueSize int, timeout time.Duration) (*group, string, Balancer, bool) {
+	f.am.Lock()
+
+	if len(without(handlers, exclude)) == 0 {
+		f.am.Unlock()
+		return nil, "", nil, false
+	}
+
+	// requests that arrive later must not overtake queued ones
+	if len(f.queue) == 0 {
+		if h, ok := f.pickFree(handlers, exclude, balancer, headers); ok {
+			f.am.Unlock()
+			return g, h, balancer, true
+		}
+	}
+
+	if len(f.queue) >= queueSize {
+		f.am.Unlock()
+		f.shed.Add(1)
+		return nil, "", nil, false
+	}
+
+	w := &waiter{
+		group:    g,
+		handlers: handlers,
+		balancer: balancer,
+		headers:  headers,
+		exclude:  exclude,
+		ready:    make(chan string, 1),
+	}
+	f.queue = append(f.queue, w)
+	f.am.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case h := <-w.ready:
+		return w.group, h, w.balancer, true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	f.am.Lock()
+	defer f.am.Unlock()
+
+	// a handler may have been handed to the request just now
+	select {
+	case h := <-w.ready:
+		return w.group, h, w.balancer, true
+	default:
+	}
+
+	for i, q := range f.queue {
+		if q == w {
+			f.queue = append(f.queue[:i], f.queue[i+1:]...)
+			break
+		}
+	}
+
+	if ctx.Err() == nil {
+		f.shed.Add(1)
+	}
+
+	return nil, "", nil, false
+}
+
+// release records that a request to handler h has finished and hands h to
+// a queued request if there is one.
+func (f *function) release(h string) {
+	f.am.Lock()
+	defer f.am.Unlock()
+
+	f.active[h]--
+
+	if f.active[h] <= 0 {
+		delete(f.active, h)
+	}
+
+	f.dispatch()
+}
+
+// pickFree lets balancer choose one of the healthy handlers that are below
+// the concurrency limit and not in exclude, and counts the request as in
+// flight on it. The caller must hold f.am.
+func (f *function) pickFree(handlers []string, exclude map[string]bool, balancer Balancer, headers map[string]string) (string, bool) {
+	free := f.healthy(without(handlers, exclude))
+
+	if f.maxConcurrency > 0 {
+		available := make([]string, 0, len(free))
+		for _, h := range free {
+			if f.active[h] < int64(f.maxConcurrency) {
+				available = append(available, h)
+			}
+		}
+		free = available
+	}
+
+	if len(free) == 0 {
+		return "", false
+	}
+
+	h := balancer.Pick(free, headers)
+	f.active[h]++
+
+	return h, true
+}
+
+// dispatch hands free handlers to queued requests, oldest first. A request
+// whose handlers are all busy does not hold up requests to other groups of
+// handlers. The caller must hold f.am.
+func (f *function) dispatch() {
+	if len(f.queue) == 0 {
+		return
+	}
+
+	remaining := f.queue[:0]
+	for _, w := range f.queue {
+		if h, ok := f.pickFree(w.handlers, w.exclude, w.balancer, w.headers); ok {
+			w.ready <- h
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+
+	clear(f.queue[len(remaining):])
+	f.queue = remaining
+}
+
+// updateQueue applies a new concurrency limit and gives queued requests the
+// current handlers of their group, e.g., after the function was scaled up.
+// The caller must hold r.hl for writing.
+func (f *function) updateQueue(maxConcurrency int) {
+	f.am.Lock()
+	defer f.am.Unlock()
+
+	f.maxConcurrency = maxConcurrency
+
+	for _, w := range f.queue {
+		found := false
+		for _, g := range f.groups {
+			if g == w.group {
+				found = true
+				break
+			}
+		}
+
+		// the group of the request is gone, so it goes to any group
+		if !found {
+			g, handlers, balancer := f.pick()
+			if g == nil {
+				w.handlers = nil
+				continue
+			}
+			w.group = g
+			w.handlers = handlers
+			w.balancer = balancer
+			continue
+		}
+
+		w.handlers = w.group.handlers
+		w.balancer = w.group.balancer
+	}
+
+	f.dispatch()
+}
+
+// without returns handlers except those in exclude.
+func without(handlers []string, exclude map[string]bool) []string {
+	if len(exclude) == 0 {
+		return handlers
+	}
+
+	rest := make([]string, 0, len(handlers))
+	for _, h := range handlers {
+		if !exclude[h] {
+			rest = append(rest, h)
+		}
+	}
+
+	return rest
+}
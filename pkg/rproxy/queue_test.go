@@ -0,0 +1,225 @@
+package rproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newQueueFunction returns a function with a single group of handlers that
+// serve maxConcurrency requests at once.
+func newQueueFunction(t *testing.T, maxConcurrency int, handlers ...string) (*function, *group) {
+	t.Helper()
+
+	b, err := NewBalancer(BalancerRoundRobin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &group{name: DefaultGroup, weight: 1, handlers: handlers, balancer: b}
+
+	f := &function{
+		groups:         []*group{g},
+		handlers:       handlers,
+		active:         make(map[string]int64),
+		maxConcurrency: maxConcurrency,
+	}
+
+	return f, g
+}
+
+// queuedAcquire starts acquiring a handler in the background and waits until
+// the request is queued. The chosen handler, or "" if there is none, is sent
+// on the returned channel.
+func queuedAcquire(t *testing.T, ctx context.Context, f *function, g *group, queueSize int, timeout time.Duration) <-chan string {
+	t.Helper()
+
+	before := f.queued()
+	res := make(chan string, 1)
+
+	go func() {
+		_, h, _, _ := f.acquire(ctx, g, g.handlers, nil, g.balancer, nil, queueSize, timeout)
+		res <- h
+	}()
+
+	for i := 0; f.queued() == before; i++ {
+		if i == 100 {
+			t.Fatal("request was not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return res
+}
+
+// pending fails if a handler was chosen for a queued request.
+func pending(t *testing.T, res <-chan string) {
+	t.Helper()
+
+	select {
+	case h := <-res:
+		t.Fatalf("queued request got handler %q", h)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// got waits for a queued request to get handler want.
+func got(t *testing.T, res <-chan string, want string) {
+	t.Helper()
+
+	select {
+	case h := <-res:
+		if h != want {
+			t.Fatalf("queued request got handler %q, want %q", h, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued request got no handler")
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	f, g := newQueueFunction(t, 1, "a")
+	ctx := context.Background()
+
+	_, h, _, ok := f.acquire(ctx, g, g.handlers, nil, g.balancer, nil, 10, time.Minute)
+	if !ok || h != "a" {
+		t.Fatalf("got handler %q, %v for the first request", h, ok)
+	}
+
+	first := queuedAcquire(t, ctx, f, g, 10, time.Minute)
+	second := queuedAcquire(t, ctx, f, g, 10, time.Minute)
+
+	pending(t, first)
+	pending(t, second)
+
+	// requests are served in the order they arrived
+	f.release("a")
+	got(t, first, "a")
+	pending(t, second)
+
+	f.release("a")
+	got(t, second, "a")
+
+	f.release("a")
+
+	if n := f.queued(); n != 0 {
+		t.Errorf("%d requests left in the queue", n)
+	}
+
+	if n := f.active["a"]; n != 0 {
+		t.Errorf("%d requests still active on a", n)
+	}
+
+	if n := f.shed.Load(); n != 0 {
+		t.Errorf("%d requests were shed", n)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	tests := map[string]struct {
+		// queueSize requests are queued before the one under test
+		queueSize int
+		timeout   time.Duration
+		cancel    bool
+		shed      bool
+	}{
+		"queue full": {queueSize: 2, timeout: time.Minute, shed: true},
+		"no queue":   {queueSize: 0, timeout: time.Minute, shed: true},
+		"timeout":    {queueSize: 2, timeout: 50 * time.Millisecond, shed: true},
+		"cancelled":  {queueSize: 2, timeout: time.Minute, cancel: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			f, g := newQueueFunction(t, 1, "a")
+
+			ctx := context.Background()
+
+			_, _, _, ok := f.acquire(ctx, g, g.handlers, nil, g.balancer, nil, tc.queueSize, tc.timeout)
+			if !ok {
+				t.Fatal("first request was not served")
+			}
+
+			// fill the queue unless the request under test should wait in it
+			fill := tc.queueSize
+			if tc.timeout < time.Minute || tc.cancel {
+				fill = tc.queueSize - 1
+			}
+
+			for i := 0; i < fill; i++ {
+				queuedAcquire(t, ctx, f, g, tc.queueSize, time.Minute)
+			}
+
+			// only the request under test is cancelled
+			rctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			if tc.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			_, h, _, ok := f.acquire(rctx, g, g.handlers, nil, g.balancer, nil, tc.queueSize, tc.timeout)
+
+			if ok {
+				t.Fatalf("request got handler %q", h)
+			}
+
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("request was rejected after %s", d)
+			}
+
+			if got := f.shed.Load() == 1; got != tc.shed {
+				t.Errorf("shed %d requests, want shed %v", f.shed.Load(), tc.shed)
+			}
+
+			if n := f.queued(); n != fill {
+				t.Errorf("%d requests in the queue, want %d", n, fill)
+			}
+		})
+	}
+}
+
+func TestQueueExclude(t *testing.T) {
+	f, g := newQueueFunction(t, 1, "a", "b")
+	ctx := context.Background()
+
+	// without any handler left, a request fails right away
+	_, _, _, ok := f.acquire(ctx, g, g.handlers, map[string]bool{"a": true, "b": true}, g.balancer, nil, 10, time.Minute)
+	if ok {
+		t.Fatal("request got an excluded handler")
+	}
+
+	_, h, _, ok := f.acquire(ctx, g, g.handlers, map[string]bool{"a": true}, g.balancer, nil, 10, time.Minute)
+	if !ok || h != "b" {
+		t.Fatalf("got handler %q, %v, want b", h, ok)
+	}
+
+	// a is free but the queued request must not go there
+	res := make(chan string, 1)
+	go func() {
+		_, h, _, _ := f.acquire(ctx, g, g.handlers, map[string]bool{"a": true}, g.balancer, nil, 10, time.Minute)
+		res <- h
+	}()
+
+	pending(t, res)
+
+	f.release("b")
+	got(t, res, "b")
+}
+
+func TestQueueScaleUp(t *testing.T) {
+	f, g := newQueueFunction(t, 1, "a")
+	ctx := context.Background()
+
+	f.acquire(ctx, g, g.handlers, nil, g.balancer, nil, 10, time.Minute)
+
+	res := queuedAcquire(t, ctx, f, g, 10, time.Minute)
+
+	// a new handler serves the queued request right away
+	g.handlers = []string{"a", "b"}
+	f.handlers = g.handlers
+	f.updateQueue(1)
+
+	got(t, res, "b")
+}
@@ -0,0 +1,198 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keys of RateLimit.
+const (
+	// RateLimitFunction shares one bucket among all requests to a function.
+	RateLimitFunction = "function"
+	// RateLimitClient gives each client address a bucket of its own.
+	RateLimitClient = "client"
+	// RateLimitAPIKey gives each API key that passes the function's
+	// AuthAPIKey policy a bucket of its own. Other requests are limited by
+	// their client address, so that made up keys do not get fresh buckets.
+	RateLimitAPIKey = "api-key"
+)
+
+// MaxRateLimitBuckets is the number of clients or API keys whose buckets are
+// kept per function. Buckets that have filled up again are dropped first,
+// then the ones that were used the longest time ago.
+const MaxRateLimitBuckets = 10000
+
+// RateLimit limits the requests to a function with a token bucket that holds
+// up to Burst tokens and is refilled with Rate tokens per second. Every
+// request takes a token, requests that find the bucket empty are rejected.
+type RateLimit struct {
+	Rate float64 `json:"rate"`
+	// Burst defaults to Rate, but at least 1
+	Burst int `json:"burst,omitempty"`
+	// Per is what a bucket is kept for, RateLimitFunction by default
+	Per string `json:"per,omitempty"`
+}
+
+// Validate checks that l is complete.
+func (l *RateLimit) Validate() error {
+	_, err := newLimiter(l)
+	return err
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter enforces a RateLimit.
+type limiter struct {
+	limit   RateLimit
+	burst   float64
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+func newLimiter(l *RateLimit) (*limiter, error) {
+	if l.Rate <= 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return nil, fmt.Errorf("invalid rate %v", l.Rate)
+	}
+
+	if l.Burst < 0 {
+		return nil, fmt.Errorf("invalid burst %d", l.Burst)
+	}
+
+	switch l.Per {
+	case "", RateLimitFunction, RateLimitClient, RateLimitAPIKey:
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %s", l.Per)
+	}
+
+	burst := float64(l.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(l.Rate))
+	}
+
+	return &limiter{
+		limit:   *l,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// key returns the bucket a request from client with headers takes its token
+// from. The rate limit is checked before the request is authenticated, so an
+// API key is only used if auth, the authorizer of the function, accepts it.
+func (l *limiter) key(client string, headers map[string]string, auth *authorizer) string {
+	switch l.limit.Per {
+	case RateLimitClient:
+		return "client:" + client
+	case RateLimitAPIKey:
+		if auth == nil || auth.policy.Type != AuthAPIKey || auth.checkAPIKey(headers) != nil {
+			return "client:" + client
+		}
+
+		k, _ := lookupHeader(headers, APIKeyHeader)
+		// keep no keys in memory
+		h := sha256.Sum256([]byte(k))
+		return "key:" + string(h[:])
+	default:
+		return ""
+	}
+}
+
+// take takes a token for a request. If there is none, it returns how long
+// until there will be one.
+func (l *limiter) take(client string, headers map[string]string, auth *authorizer) (time.Duration, bool) {
+	key := l.key(client, headers, auth)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= MaxRateLimitBuckets {
+			l.prune(now)
+		}
+
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second)), false
+	}
+
+	b.tokens--
+
+	return 0, true
+}
+
+// prune drops buckets that would be full by now, as they are no different
+// from new ones. If that does not free enough space, the tenth of the buckets
+// that were used the longest time ago is dropped, so that pruning does not
+// happen for every new bucket. The caller must hold l.mu.
+func (l *limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+
+	if len(l.buckets) < MaxRateLimitBuckets {
+		return
+	}
+
+	keys := make([]string, 0, len(l.buckets))
+	for k := range l.buckets {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return l.buckets[keys[i]].last.Before(l.buckets[keys[j]].last)
+	})
+
+	for _, k := range keys[:len(keys)-MaxRateLimitBuckets*9/10] {
+		delete(l.buckets, k)
+	}
+}
+
+// Allow reports whether a request from client to function name is within
+// the rate limit of the function, and if not, after how long the client may
+// try again. client is the address of the client without its port. Requests
+// to unknown functions are allowed, Call rejects them.
+func (r *RProxy) Allow(name string, client string, headers map[string]string) (time.Duration, bool) {
+	r.hl.RLock()
+	f, ok := r.hosts[name]
+	var l *limiter
+	var auth *authorizer
+	if ok {
+		l = f.limiter
+		auth = f.auth
+	}
+	r.hl.RUnlock()
+
+	if l == nil {
+		return 0, true
+	}
+
+	wait, ok := l.take(client, headers, auth)
+	if !ok {
+		f.limited.Add(1)
+	}
+
+	return wait, ok
+}
+
+// RetryAfter rounds wait up to whole seconds, as in a Retry-After header.
+func RetryAfter(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,96 @@
+package rproxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitAPIKey(t *testing.T) {
+	l, err := newLimiter(&RateLimit{Rate: 0.001, Burst: 1, Per: RateLimitAPIKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := newAuthorizer(&AuthPolicy{Type: AuthAPIKey, APIKeys: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	take := func(client string, key string) bool {
+		_, ok := l.take(client, map[string]string{APIKeyHeader: key}, auth)
+		return ok
+	}
+
+	if !take("10.0.0.1", "a") || take("10.0.0.1", "a") {
+		t.Fatal("key a does not have a bucket with a single token")
+	}
+
+	// another valid key has a bucket of its own, even from the same client
+	if !take("10.0.0.1", "b") {
+		t.Error("key b shares the bucket of key a")
+	}
+
+	// made up keys share the bucket of their client
+	if !take("10.0.0.2", "made-up-1") {
+		t.Error("client with an invalid key was limited right away")
+	}
+
+	for i := 2; i < 10; i++ {
+		if take("10.0.0.2", "made-up-"+strconv.Itoa(i)) {
+			t.Fatalf("made up key %d got a fresh bucket", i)
+		}
+	}
+
+	// without an api-key policy, no key can be checked
+	_, ok := l.take("10.0.0.3", map[string]string{APIKeyHeader: "a"}, nil)
+	if !ok {
+		t.Error("key a was taken from the bucket of the key instead of the client")
+	}
+}
+
+func TestRateLimitPrune(t *testing.T) {
+	l, err := newLimiter(&RateLimit{Rate: 0.001, Burst: 1, Per: RateLimitClient})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a limited client that keeps sending requests
+	_, ok := l.take("victim", nil, nil)
+	if !ok {
+		t.Fatal("first request was limited")
+	}
+
+	for i := 0; i < 2*MaxRateLimitBuckets; i++ {
+		l.take("client-"+strconv.Itoa(i), nil, nil)
+
+		if i%1000 == 0 {
+			_, ok := l.take("victim", nil, nil)
+			if ok {
+				t.Fatalf("limited client got a fresh bucket after %d other clients", i)
+			}
+		}
+	}
+
+	if len(l.buckets) > MaxRateLimitBuckets {
+		t.Errorf("limiter keeps %d buckets, at most %d allowed", len(l.buckets), MaxRateLimitBuckets)
+	}
+
+	// buckets that have not been used for the longest time go first
+	l.buckets["client:client-0"] = &bucket{last: time.Now().Add(-time.Minute)}
+	l.buckets["client:victim"].last = time.Now()
+
+	for i := 0; len(l.buckets) < MaxRateLimitBuckets; i++ {
+		l.buckets["filler-"+strconv.Itoa(i)] = &bucket{last: time.Now()}
+	}
+
+	l.take("new", nil, nil)
+
+	if _, ok := l.buckets["client:client-0"]; ok {
+		t.Error("oldest bucket was kept")
+	}
+
+	if _, ok := l.buckets["client:victim"]; !ok {
+		t.Error("recently used bucket was dropped")
+	}
+}
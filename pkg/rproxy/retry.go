@@ -0,0 +1,92 @@
+package rproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultRetryAttempts is the number of attempts of a request to a
+	// function with a retry policy, unless the policy sets its own.
+	DefaultRetryAttempts = 3
+	// DefaultRetryBackoff is how long to wait before the first retry,
+	// unless the policy sets its own. The wait doubles with every retry.
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// RetryPolicy retries synchronous requests to a function that could not
+// reach a handler or that got one of StatusCodes from the function. Every
+// attempt goes to a handler that has not been tried yet, so there are at
+// most as many attempts as the function has handlers.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// BackoffMS is the wait before the first retry in milliseconds
+	BackoffMS   int   `json:"backoff_ms,omitempty"`
+	StatusCodes []int `json:"status_codes,omitempty"`
+}
+
+// Validate checks that p is complete.
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("invalid max attempts %d", p.MaxAttempts)
+	}
+
+	if p.BackoffMS < 0 {
+		return fmt.Errorf("invalid backoff %d", p.BackoffMS)
+	}
+
+	for _, c := range p.StatusCodes {
+		if c < 100 || c > 599 {
+			return fmt.Errorf("invalid status code %d", c)
+		}
+	}
+
+	return nil
+}
+
+// attempts returns the maximum number of attempts of a request. Without a
+// policy, there is only one.
+func (p *RetryPolicy) attempts() int {
+	switch {
+	case p == nil:
+		return 1
+	case p.MaxAttempts == 0:
+		return DefaultRetryAttempts
+	default:
+		return p.MaxAttempts
+	}
+}
+
+// backoff returns how long to wait before attempt n, counting from 1.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	b := time.Duration(p.BackoffMS) * time.Millisecond
+	if b == 0 {
+		b = DefaultRetryBackoff
+	}
+
+	// keep the wait from overflowing with many attempts
+	return b << min(n-2, 16)
+}
+
+// retryable reports whether an attempt that returned code or failed with err
+// may be retried. Without a response, code is 0. An attempt that got a
+// response but failed reading it is not retried, as the function has already
+// run.
+func (p *RetryPolicy) retryable(code int, err error) bool {
+	if p == nil {
+		return false
+	}
+
+	if err != nil {
+		return code == 0
+	}
+
+	for _, c := range p.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
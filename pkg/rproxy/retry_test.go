@@ -0,0 +1,265 @@
+package rproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	policy := &RetryPolicy{StatusCodes: []int{502, 503}}
+	errConn := errors.New("connection refused")
+
+	tests := map[string]struct {
+		policy *RetryPolicy
+		code   int
+		err    error
+		want   bool
+	}{
+		"no policy":          {policy: nil, code: 0, err: errConn, want: false},
+		"connection error":   {policy: policy, code: 0, err: errConn, want: true},
+		"read error":         {policy: policy, code: 200, err: errConn, want: false},
+		"listed status":      {policy: policy, code: 503, want: true},
+		"unlisted status":    {policy: policy, code: 500, want: false},
+		"client error":       {policy: policy, code: 404, want: false},
+		"success":            {policy: policy, code: 200, want: false},
+		"no listed statuses": {policy: &RetryPolicy{}, code: 503, want: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.policy.retryable(tc.code, tc.err); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var nilPolicy *RetryPolicy
+	if n := nilPolicy.attempts(); n != 1 {
+		t.Errorf("got %d attempts without a policy, want 1", n)
+	}
+
+	if n := (&RetryPolicy{}).attempts(); n != DefaultRetryAttempts {
+		t.Errorf("got %d attempts by default, want %d", n, DefaultRetryAttempts)
+	}
+
+	p := &RetryPolicy{BackoffMS: 10}
+
+	for n, want := range map[int]time.Duration{
+		2:   10 * time.Millisecond,
+		3:   20 * time.Millisecond,
+		4:   40 * time.Millisecond,
+		100: 10 * time.Millisecond << 16,
+	} {
+		if got := p.backoff(n); got != want {
+			t.Errorf("got backoff %s before attempt %d, want %s", got, n, want)
+		}
+	}
+
+	if got := (&RetryPolicy{}).backoff(2); got != DefaultRetryBackoff {
+		t.Errorf("got default backoff %s, want %s", got, DefaultRetryBackoff)
+	}
+}
+
+// closedAddr returns an address that nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+func TestRetry(t *testing.T) {
+	quiet(t)
+
+	// handlers answer with their status codes in turn
+	type handler struct {
+		closed bool
+		codes  []int
+	}
+
+	tests := map[string]struct {
+		handlers []handler
+		retry    *RetryPolicy
+		status   Status
+		code     int
+		// requests each handler receives, or in total if the balancer may
+		// choose any of them
+		requests []int64
+		total    int64
+	}{
+		"listed status": {
+			handlers: []handler{{codes: []int{503}}, {codes: []int{200}}},
+			retry:    &RetryPolicy{StatusCodes: []int{503}, BackoffMS: 1},
+			status:   StatusOK,
+			code:     200,
+			requests: []int64{1, 1},
+		},
+		"unlisted status": {
+			handlers: []handler{{codes: []int{500}}, {codes: []int{200}}},
+			retry:    &RetryPolicy{StatusCodes: []int{503}, BackoffMS: 1},
+			status:   StatusOK,
+			code:     500,
+			requests: []int64{1, 0},
+		},
+		"client error": {
+			handlers: []handler{{codes: []int{400}}, {codes: []int{200}}},
+			retry:    &RetryPolicy{StatusCodes: []int{503}, BackoffMS: 1},
+			status:   StatusOK,
+			code:     400,
+			requests: []int64{1, 0},
+		},
+		"connection error": {
+			handlers: []handler{{closed: true}, {codes: []int{200}}},
+			retry:    &RetryPolicy{BackoffMS: 1},
+			status:   StatusOK,
+			code:     200,
+			requests: []int64{0, 1},
+		},
+		"no policy": {
+			handlers: []handler{{codes: []int{503}}, {codes: []int{200}}},
+			retry:    nil,
+			status:   StatusOK,
+			code:     503,
+			requests: []int64{1, 0},
+		},
+		"max attempts": {
+			handlers: []handler{{codes: []int{503}}, {codes: []int{503}}, {codes: []int{503}}},
+			retry:    &RetryPolicy{MaxAttempts: 2, StatusCodes: []int{503}, BackoffMS: 1},
+			status:   StatusOK,
+			code:     503,
+			total:    2,
+		},
+		"all handlers tried": {
+			handlers: []handler{{codes: []int{503}}, {codes: []int{503}}},
+			retry:    &RetryPolicy{MaxAttempts: 5, StatusCodes: []int{503}, BackoffMS: 1},
+			status:   StatusError,
+			requests: []int64{1, 1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests := make([]atomic.Int64, len(tc.handlers))
+			ips := make([]string, len(tc.handlers))
+
+			for i, h := range tc.handlers {
+				if h.closed {
+					ips[i] = closedAddr(t)
+					continue
+				}
+
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					n := requests[i].Add(1)
+					w.WriteHeader(h.codes[int(n-1)%len(h.codes)])
+				}))
+				defer srv.Close()
+
+				ips[i] = strings.TrimPrefix(srv.URL, "http://")
+			}
+
+			r := New("", "", "")
+
+			// round robin tries the handlers in order
+			err := r.Add("fn", ips, Config{Balancer: BalancerRoundRobin, Retry: tc.retry, Timeout: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, code, _ := r.invoke(context.Background(), "fn", nil, nil)
+
+			if status != tc.status {
+				t.Errorf("got status %d, want %d", status, tc.status)
+			}
+
+			if status == StatusOK && code != tc.code {
+				t.Errorf("got code %d, want %d", code, tc.code)
+			}
+
+			var total int64
+			for i := range requests {
+				total += requests[i].Load()
+			}
+
+			for i, want := range tc.requests {
+				if got := requests[i].Load(); got != want {
+					t.Errorf("handler %d got %d requests, want %d", i, got, want)
+				}
+			}
+
+			if tc.total != 0 && total != tc.total {
+				t.Errorf("handlers got %d requests, want %d", total, tc.total)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	quiet(t)
+
+	var requests atomic.Int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ip := strings.TrimPrefix(srv.URL, "http://")
+
+	// the backoff is longer than the function may take
+	r := New("", "", "")
+	err := r.Add("fn", []string{ip, closedAddr(t)}, Config{
+		Balancer: BalancerRoundRobin,
+		Retry:    &RetryPolicy{StatusCodes: []int{503}, BackoffMS: 10000},
+		Timeout:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	status, _, _ := r.invoke(context.Background(), "fn", nil, nil)
+
+	if status != StatusTimeout {
+		t.Errorf("got status %d, want %d", status, StatusTimeout)
+	}
+
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("request took %s, longer than its timeout", d)
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("handler got %d requests, want 1", n)
+	}
+
+	// the client's deadline applies as well
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	status, _, _ = r.invoke(ctx, "fn", nil, nil)
+
+	if status != StatusTimeout {
+		t.Errorf("got status %d with a client deadline, want %d", status, StatusTimeout)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("request took %s, longer than the client's deadline", d)
+	}
+}
@@ -2,13 +2,20 @@ package rproxy
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"math"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Status uint32
@@ -18,36 +25,370 @@ const (
 	StatusAccepted
 	StatusNotFound
 	StatusError
+	// StatusUnauthorized means the request has no valid credentials for
+	// the function, see AuthPolicy
+	StatusUnauthorized
+	// StatusForbidden means the credentials of the request do not grant
+	// access to the function
+	StatusForbidden
+	// StatusOverloaded means all handlers of the function are busy and the
+	// request was shed, see Config.MaxConcurrency
+	StatusOverloaded
+	// StatusTimeout means the function did not answer before the deadline
+	// of the request or its own timeout
+	StatusTimeout
+	// StatusCircuitOpen means the function failed too often and requests
+	// are rejected for a while, see CircuitBreaker
+	StatusCircuitOpen
 )
 
+const (
+	// DefaultHandlerPort is the port function handlers listen on if an
+	// address does not specify one.
+	DefaultHandlerPort = "8000"
+	// ColdStartTimeout is how long a request waits for a function without
+	// any handlers to be scaled up.
+	ColdStartTimeout = 30 * time.Second
+	// ColdStartQueueSize is the maximum number of requests that wait for a
+	// function to be scaled up. Any further requests fail immediately.
+	ColdStartQueueSize = 100
+	// DefaultTimeout is how long a function may take to answer a request,
+	// unless it sets its own timeout.
+	DefaultTimeout = 5 * time.Minute
+	// TimeoutHeader carries the time left until the deadline of a request in
+	// seconds, e.g., "2.5". Clients may set it to limit how long they wait,
+	// and functions receive it to know how much time they have left.
+	TimeoutHeader = "X-tinyFaaS-Timeout"
+)
+
+// Stats describes the current load of a function.
+type Stats struct {
+	InFlight    int64     `json:"inflight"`
+	Requests    int64     `json:"requests"`
+	Handlers    int       `json:"handlers"`
+	LastRequest time.Time `json:"last_request"`
+	// Draining is the number of requests still in flight to handlers that
+	// have been removed from the function.
+	Draining int64 `json:"draining"`
+	// RateLimited is the number of requests rejected by the rate limit.
+	RateLimited int64 `json:"rate_limited"`
+	// Queued is the number of requests waiting for a free handler, Shed the
+	// number of requests that were rejected because none became free.
+	Queued int   `json:"queued"`
+	Shed   int64 `json:"shed"`
+	// Retries is the number of times requests were sent again, Circuit the
+	// state of the circuit breaker, if any.
+	Retries int64                 `json:"retries"`
+	Circuit string                `json:"circuit,omitempty"`
+	Groups  map[string]GroupStats `json:"groups"`
+}
+
+// Config is the configuration of a function, sent along with its handlers
+// when a function is added.
+type Config struct {
+	// Balancer is the load balancing strategy, see NewBalancer.
+	Balancer string `json:"balancer,omitempty"`
+	// BalancerHeader is the header to hash on for consistent hashing.
+	BalancerHeader string `json:"balancer_header,omitempty"`
+	// Auth, if set, restricts who may call the function.
+	Auth *AuthPolicy `json:"auth,omitempty"`
+	// RateLimit, if set, limits how often the function may be called.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// MaxConcurrency, if set, is the number of requests each handler serves
+	// at once. Further requests wait in a queue of up to QueueSize requests
+	// (DefaultQueueSize by default) for up to QueueTimeout seconds
+	// (DefaultQueueTimeout by default).
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	QueueSize      int `json:"queue_size,omitempty"`
+	QueueTimeout   int `json:"queue_timeout,omitempty"`
+	// Timeout is how many seconds the function may take to answer a
+	// request, DefaultTimeout if not set.
+	Timeout int `json:"timeout,omitempty"`
+	// Retry, if set, retries failed synchronous requests.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// CircuitBreaker, if set, rejects requests while the function keeps
+	// failing.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+}
+
+// Validate checks the limits of c that are not checked by their own types.
+func (c *Config) Validate() error {
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("invalid max concurrency %d", c.MaxConcurrency)
+	}
+
+	if c.QueueSize < 0 {
+		return fmt.Errorf("invalid queue size %d", c.QueueSize)
+	}
+
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("invalid queue timeout %d", c.QueueTimeout)
+	}
+
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", c.Timeout)
+	}
+
+	if c.Retry != nil {
+		err := c.Retry.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid retry policy: %w", err)
+		}
+	}
+
+	if c.CircuitBreaker != nil {
+		err := c.CircuitBreaker.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid circuit breaker: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// queue returns the size and timeout of the queue of requests waiting for a
+// free handler.
+func (c *Config) queue() (int, time.Duration) {
+	size := c.QueueSize
+	if size == 0 {
+		size = DefaultQueueSize
+	}
+
+	timeout := time.Duration(c.QueueTimeout) * time.Second
+	if timeout == 0 {
+		timeout = DefaultQueueTimeout
+	}
+
+	return size, timeout
+}
+
+// timeout returns how long the function may take to answer a request.
+func (c *Config) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// ParseTimeout parses the value of a TimeoutHeader.
+func ParseTimeout(v string) (time.Duration, error) {
+	s, err := strconv.ParseFloat(v, 64)
+	if err != nil || s <= 0 || math.IsInf(s, 0) || math.IsNaN(s) {
+		return 0, fmt.Errorf("invalid timeout %s", v)
+	}
+
+	return time.Duration(s * float64(time.Second)), nil
+}
+
+// FormatTimeout formats d as the value of a TimeoutHeader.
+func FormatTimeout(d time.Duration) string {
+	return strconv.FormatFloat(max(d, 0).Seconds(), 'f', 3, 64)
+}
+
+type function struct {
+	config Config
+	// auth checks requests if the function has an AuthPolicy
+	auth *authorizer
+	// limiter enforces the rate limit of the function, if any
+	limiter *limiter
+	// limited counts requests rejected by limiter
+	limited atomic.Int64
+	// breaker enforces the circuit breaker of the function, if any
+	breaker *breaker
+	// retries counts requests that were sent again
+	retries atomic.Int64
+	groups  []*group
+	// handlers of all groups
+	handlers []string
+	// ready is closed once the function has at least one handler
+	ready       chan struct{}
+	waiting     atomic.Int64
+	inflight    atomic.Int64
+	requests    atomic.Int64
+	lastRequest atomic.Int64
+	// health of each handler, see health.go
+	health map[string]*replicaHealth
+	hm     sync.Mutex
+	// active counts the requests in flight to each handler, including
+	// handlers that have been removed but still have requests to finish
+	active map[string]int64
+	// maxConcurrency limits active per handler, requests beyond that wait
+	// in queue, see queue.go
+	maxConcurrency int
+	queue          []*waiter
+	am             sync.Mutex
+	// shed counts requests that found the queue full or timed out in it
+	shed atomic.Int64
+}
+
 type RProxy struct {
-	hosts map[string][]string
-	hl    sync.RWMutex
+	hosts       map[string]*function
+	hl          sync.RWMutex
+	managerAddr string
+	// managerToken authenticates wake requests to the management service
+	managerToken string
+	invocations  *invocations
 }
 
-func New() *RProxy {
-	return &RProxy{
-		hosts: make(map[string][]string),
+// New creates a new RProxy. If managerAddr is not empty, the management
+// service at that address is asked to start functions that are scaled to
+// zero when a request for them arrives, using managerToken as a bearer token
+// if it is set. The health of all handlers is checked periodically and
+// unhealthy handlers do not receive requests. Asynchronous invocations are
+// stored in invocationsDir, or only in memory if it is empty.
+func New(managerAddr string, managerToken string, invocationsDir string) *RProxy {
+	r := &RProxy{
+		hosts:        make(map[string]*function),
+		managerAddr:  managerAddr,
+		managerToken: managerToken,
 	}
+
+	r.invocations = newInvocations(r, invocationsDir)
+
+	go r.checkHealth()
+
+	return r
 }
 
-func (r *RProxy) Add(name string, ips []string) error {
-	if len(ips) == 0 {
-		return fmt.Errorf("no ips given")
+// Add registers a function or updates its handlers and configuration. A
+// function may have no handlers, e.g., when it is scaled to zero. Requests to
+// such a function wait until handlers are added. All handlers are part of
+// DefaultGroup.
+func (r *RProxy) Add(name string, ips []string, c Config) error {
+	return r.AddGroups(name, []Group{{Name: DefaultGroup, IPs: ips, Weight: 1}}, c)
+}
+
+// AddGroups registers a function or updates its groups of handlers and its
+// configuration. Groups that are no longer given are removed.
+func (r *RProxy) AddGroups(name string, groups []Group, c Config) error {
+	err := validateGroups(groups)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	_, err = NewBalancer(c.Balancer, c.BalancerHeader)
+	if err != nil {
+		return err
+	}
+
+	var auth *authorizer
+	if c.Auth != nil {
+		auth, err = newAuthorizer(c.Auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.RateLimit != nil {
+		_, err = newLimiter(c.RateLimit)
+		if err != nil {
+			return err
+		}
 	}
 
 	r.hl.Lock()
 	defer r.hl.Unlock()
 
 	// if function exists, we should update!
-	// if _, ok := r.hosts[name]; ok {
-	// 	return fmt.Errorf("function already exists")
-	// }
+	f, ok := r.hosts[name]
+	if !ok {
+		f = &function{
+			ready:  make(chan struct{}),
+			active: make(map[string]int64),
+		}
+		// a new function counts as just used so it is not considered idle
+		// right away
+		f.lastRequest.Store(time.Now().UnixNano())
+		r.hosts[name] = f
+	}
+
+	configChanged := f.config.Balancer != c.Balancer || f.config.BalancerHeader != c.BalancerHeader
+
+	existing := make(map[string]*group, len(f.groups))
+	for _, g := range f.groups {
+		existing[g.name] = g
+	}
+
+	fgroups := make([]*group, 0, len(groups))
+	addrs := make([]string, 0)
+
+	for _, gc := range groups {
+		g, ok := existing[gc.Name]
+		if !ok {
+			g = &group{
+				name: gc.Name,
+			}
+		}
+
+		// keep the balancer (and its state) unless the strategy changes
+		if g.balancer == nil || configChanged {
+			g.balancer, _ = NewBalancer(c.Balancer, c.BalancerHeader)
+		}
+
+		g.weight = gc.Weight
+		g.handlers = handlerAddrs(gc.IPs)
+
+		fgroups = append(fgroups, g)
+		addrs = append(addrs, g.handlers...)
+	}
+
+	// keep the buckets of the rate limit unless it changes
+	switch {
+	case c.RateLimit == nil:
+		f.limiter = nil
+	case f.limiter == nil || f.limiter.limit != *c.RateLimit:
+		f.limiter, _ = newLimiter(c.RateLimit)
+	}
+
+	// keep the state of the circuit unless the breaker changes
+	switch {
+	case c.CircuitBreaker == nil:
+		f.breaker = nil
+	case f.breaker == nil || f.breaker.config != *c.CircuitBreaker:
+		f.breaker = newBreaker(c.CircuitBreaker)
+	}
+
+	f.config = c
+	f.auth = auth
+	f.groups = fgroups
+
+	hadHandlers := len(f.handlers) > 0
+	f.handlers = addrs
+	f.updateHealth(addrs)
+	f.updateQueue(c.MaxConcurrency)
+
+	switch {
+	case !hadHandlers && len(addrs) > 0:
+		close(f.ready)
+	case hadHandlers && len(addrs) == 0:
+		f.ready = make(chan struct{})
+	}
 
-	r.hosts[name] = ips
 	return nil
 }
 
+// handlerAddrs returns the addresses of handlers given as plain ips (listening
+// on the default port) or as ip:port, e.g., when several handlers share a
+// host.
+func handlerAddrs(ips []string) []string {
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		if _, _, err := net.SplitHostPort(ip); err == nil {
+			addrs[i] = ip
+			continue
+		}
+		addrs[i] = net.JoinHostPort(ip, DefaultHandlerPort)
+	}
+
+	return addrs
+}
+
 func (r *RProxy) Del(name string) error {
 	r.hl.Lock()
 	defer r.hl.Unlock()
@@ -60,68 +401,404 @@ func (r *RProxy) Del(name string) error {
 	return nil
 }
 
-func (r *RProxy) Call(name string, payload []byte, async bool, headers map[string]string) (Status, []byte) {
+// Stats returns the current load of all functions.
+func (r *RProxy) Stats() map[string]Stats {
+	r.hl.RLock()
+	defer r.hl.RUnlock()
+
+	stats := make(map[string]Stats, len(r.hosts))
+	for name, f := range r.hosts {
+		groups := make(map[string]GroupStats, len(f.groups))
+		for _, g := range f.groups {
+			groups[g.name] = GroupStats{
+				Weight:   g.weight,
+				Handlers: len(g.handlers),
+				Requests: g.requests.Load(),
+				Errors:   g.errors.Load(),
+			}
+		}
+
+		stats[name] = Stats{
+			InFlight:    f.inflight.Load(),
+			Requests:    f.requests.Load(),
+			Handlers:    len(f.handlers),
+			LastRequest: time.Unix(0, f.lastRequest.Load()),
+			Draining:    f.draining(),
+			RateLimited: f.limited.Load(),
+			Queued:      f.queued(),
+			Shed:        f.shed.Load(),
+			Retries:     f.retries.Load(),
+			Circuit:     f.breaker.current(),
+			Groups:      groups,
+		}
+	}
+
+	return stats
+}
+
+// queued returns the number of requests waiting for a free handler.
+func (f *function) queued() int {
+	f.am.Lock()
+	defer f.am.Unlock()
+
+	return len(f.queue)
+}
+
+// draining returns the number of requests in flight to handlers that are no
+// longer part of the function. The caller must hold r.hl.
+func (f *function) draining() int64 {
+	f.am.Lock()
+	defer f.am.Unlock()
+
+	current := make(map[string]struct{}, len(f.handlers))
+	for _, h := range f.handlers {
+		current[h] = struct{}{}
+	}
+
+	var n int64
+	for h, a := range f.active {
+		if _, ok := current[h]; !ok {
+			n += a
+		}
+	}
 
-	handler, ok := r.hosts[name]
+	return n
+}
+
+// handlers chooses a group of handlers of a function for a request and
+// returns its handlers and balancer. If the function currently has no
+// handlers, the request is queued until the function has been scaled up.
+func (r *RProxy) handlers(ctx context.Context, name string, f *function) (*group, []string, Balancer, bool) {
+	r.hl.RLock()
+	g, handler, balancer := f.pick()
+	ready := f.ready
+	r.hl.RUnlock()
+
+	if g != nil {
+		return g, handler, balancer, true
+	}
+
+	waiting := f.waiting.Add(1)
+	defer f.waiting.Add(-1)
+
+	if waiting > ColdStartQueueSize {
+		log.Printf("function %s has no handlers and cold start queue is full", name)
+		return nil, nil, nil, false
+	}
+
+	log.Printf("function %s has no handlers, waiting for cold start (%d waiting)", name, waiting)
+
+	// the first request to arrive wakes up the function
+	if waiting == 1 {
+		go r.wake(name)
+	}
+
+	select {
+	case <-ready:
+	case <-time.After(ColdStartTimeout):
+		log.Printf("function %s not ready after %s", name, ColdStartTimeout)
+		return nil, nil, nil, false
+	case <-ctx.Done():
+		log.Printf("gave up waiting for function %s: %s", name, ctx.Err())
+		return nil, nil, nil, false
+	}
+
+	r.hl.RLock()
+	g, handler, balancer = f.pick()
+	r.hl.RUnlock()
+
+	return g, handler, balancer, g != nil
+}
+
+// pick chooses a group for a request and returns it along with its handlers
+// and balancer, or nil if the function has no handlers. The caller must hold
+// r.hl.
+func (f *function) pick() (*group, []string, Balancer) {
+	g := f.pickGroup()
+	if g == nil {
+		return nil, nil, nil
+	}
+
+	return g, g.handlers, g.balancer
+}
+
+// wake asks the management service to start a function that is scaled to
+// zero.
+func (r *RProxy) wake(name string) {
+	if r.managerAddr == "" {
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		FunctionName string `json:"name"`
+	}{
+		FunctionName: name,
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	log.Printf("asking manager to wake function %s", name)
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/wake", r.managerAddr), bytes.NewBuffer(b))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if r.managerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.managerToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("error waking function %s: %s", name, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("error waking function %s: manager returned status code %d", name, resp.StatusCode)
+	}
+}
+
+// Call sends a request to function name and returns its result. The request
+// is cancelled when ctx is done, e.g., when the client disconnects, and it
+// may take no longer than the timeout of the function. Synchronous requests
+// are retried on other handlers according to the retry policy of the
+// function, and requests to a function whose circuit is open fail right
+// away. An asynchronous request is stored in the invocation queue and its
+// result is the ID of the invocation, see Invocation.
+func (r *RProxy) Call(ctx context.Context, name string, payload []byte, async bool, headers map[string]string) (Status, []byte) {
+
+	r.hl.RLock()
+	f, ok := r.hosts[name]
+	var auth *authorizer
+	if ok {
+		auth = f.auth
+	}
+	r.hl.RUnlock()
 
 	if !ok {
 		log.Printf("function not found: %s", name)
 		return StatusNotFound, nil
 	}
 
-	log.Printf("have handlers: %s", handler)
+	// rejected requests neither count as load nor wake up the function
+	if auth != nil {
+		err := auth.check(payload, headers)
+		if err != nil {
+			log.Printf("rejected request to %s: %s", name, err)
+			if errors.Is(err, ErrForbidden) {
+				return StatusForbidden, nil
+			}
+			return StatusUnauthorized, nil
+		}
+	}
+
+	if async {
+		id, status := r.invocations.submit(name, payload, headers)
+		if status != StatusAccepted {
+			return status, nil
+		}
+
+		log.Printf("async request accepted as invocation %s", id)
+
+		return StatusAccepted, []byte(id)
+	}
+
+	status, _, body := r.invoke(ctx, name, payload, headers)
+	return status, body
+}
+
+// invoke sends a request to function name without checking its access
+// policy and returns the status code of the function along with its result.
+func (r *RProxy) invoke(ctx context.Context, name string, payload []byte, headers map[string]string) (Status, int, []byte) {
+
+	r.hl.RLock()
+	f, ok := r.hosts[name]
+	var queueSize int
+	var queueTimeout, timeout time.Duration
+	var retry *RetryPolicy
+	var br *breaker
+	if ok {
+		queueSize, queueTimeout = f.config.queue()
+		timeout = f.config.timeout()
+		retry = f.config.Retry
+		br = f.breaker
+	}
+	r.hl.RUnlock()
+
+	if !ok {
+		log.Printf("function not found: %s", name)
+		return StatusNotFound, 0, nil
+	}
+
+	// an open circuit fails fast, without waking up the function
+	if !br.allow() {
+		log.Printf("circuit of function %s is open, rejecting request", name)
+		return StatusCircuitOpen, 0, nil
+	}
+
+	// the earlier of the client's deadline and the timeout of the function
+	// applies
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	f.requests.Add(1)
+	f.inflight.Add(1)
+	f.lastRequest.Store(time.Now().UnixNano())
+	defer f.inflight.Add(-1)
+
+	// every allowed request must tell the circuit breaker how it went
+	result := outcomeNone
+	defer func() {
+		br.record(name, result)
+	}()
+
+	g, handler, balancer, ok := r.handlers(ctx, name, f)
+
+	if !ok {
+		return contextStatus(ctx, StatusError), 0, nil
+	}
+
+	log.Printf("have handlers: %s (group %s)", handler, g.name)
+
+	var tried map[string]bool
+	attempts := retry.attempts()
+
+	for n := 1; ; n++ {
+		// let the balancer choose one of the healthy handlers that are not
+		// busy and have not been tried yet
+		g, h, balancer, ok := f.acquire(ctx, g, handler, tried, balancer, headers, queueSize, queueTimeout)
+
+		if !ok {
+			if ctx.Err() != nil {
+				return contextStatus(ctx, StatusError), 0, nil
+			}
+			if n > 1 {
+				log.Printf("no other handler of function %s to retry on", name)
+				result = outcomeFailure
+				return StatusError, 0, nil
+			}
+			log.Printf("function %s is overloaded, shedding request", name)
+			return StatusOverloaded, 0, nil
+		}
+
+		g.requests.Add(1)
 
-	// choose random handler
-	h := handler[rand.Intn(len(handler))]
+		log.Printf("chosen handler: %s (attempt %d of %d)", h, n, attempts)
 
-	log.Printf("chosen handler: %s", h)
+		code, body, err := f.attempt(ctx, g, h, balancer, payload, headers)
+		result = callOutcome(ctx, code, err)
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:8000/fn", h), bytes.NewBuffer(payload))
+		if n < attempts && ctx.Err() == nil && retry.retryable(code, err) {
+			if tried == nil {
+				tried = make(map[string]bool)
+			}
+			tried[h] = true
+			f.retries.Add(1)
+
+			wait := retry.backoff(n + 1)
+			log.Printf("retrying request to %s on another handler in %s", name, wait)
+
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return contextStatus(ctx, StatusError), 0, nil
+			}
+		}
+
+		if err != nil {
+			return contextStatus(ctx, StatusError), 0, nil
+		}
+
+		return StatusOK, code, body
+	}
+}
+
+// attempt sends a request to handler h of group g and returns the status
+// code and body of the response, or a code of 0 if the handler could not be
+// reached.
+func (f *function) attempt(ctx context.Context, g *group, h string, balancer Balancer, payload []byte, headers map[string]string) (int, []byte, error) {
+	defer balancer.Done(h)
+	defer f.release(h)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/fn", h), bytes.NewBuffer(payload))
 	if err != nil {
+		g.errors.Add(1)
 		log.Print(err)
-		return StatusError, nil
+		return 0, nil, err
 	}
 	for k, v := range headers {
 		cleanedKey := cleanHeaderKey(k) // remove special chars from key
 		req.Header.Set(cleanedKey, v)
 	}
 
-	// call function asynchronously
-	if async {
-		log.Printf("async request accepted")
-		go func() {
-			resp, err2 := http.DefaultClient.Do(req)
-			if err2 != nil {
-				return
-			}
-			resp.Body.Close()
-			log.Printf("async request finished")
-		}()
-		return StatusAccepted, nil
+	// tell the function how much time it has left
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(TimeoutHeader, FormatTimeout(time.Until(deadline)))
 	}
 
-	// call function and return results
-	log.Printf("sync request starting")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Print(err)
-		return StatusError, nil
+		// a client that went away is not the function's fault
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			g.errors.Add(1)
+		}
+		f.reportCallFailure(ctx, h, err)
+		return 0, nil, err
 	}
-
-	log.Printf("sync request finished")
+	f.reportSuccess(h)
 
 	defer resp.Body.Close()
+
+	// the function itself failed, which does not make the handler unhealthy
+	if resp.StatusCode >= http.StatusInternalServerError {
+		g.errors.Add(1)
+	}
+
 	res_body, err := io.ReadAll(resp.Body)
 
 	if err != nil {
 		log.Print(err)
-		return StatusError, nil
+		g.errors.Add(1)
+		return resp.StatusCode, nil, err
+	}
+
+	// log.Printf("have response for request: %s", res_body)
+
+	return resp.StatusCode, res_body, nil
+}
+
+// callOutcome tells the circuit breaker how a request went. Requests whose
+// client went away say nothing about the function.
+func callOutcome(ctx context.Context, code int, err error) outcome {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return outcomeNone
+	case err != nil, code >= http.StatusInternalServerError:
+		return outcomeFailure
+	default:
+		return outcomeSuccess
 	}
+}
 
-	// log.Printf("have response for sync request: %s", res_body)
+// contextStatus returns StatusTimeout if the deadline of ctx has passed and
+// status otherwise.
+func contextStatus(ctx context.Context, status Status) Status {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return StatusTimeout
+	}
 
-	return StatusOK, res_body
+	return status
 }
+
 func cleanHeaderKey(key string) string {
 	// a regex pattern to match special characters
 	re := regexp.MustCompile(`[:()<>@,;:\"/[\]?={} \t]`)
@@ -0,0 +1,229 @@
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// Archive formats that function sources can be uploaded in.
+const (
+	FormatUnknown = ""
+	FormatZip     = "zip"
+	FormatTar     = "tar"
+	FormatTarGz   = "tar.gz"
+	// FormatImage is a container image as written by docker save, or any
+	// other OCI image layout in a (gzipped) tarball
+	FormatImage = "image"
+)
+
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+	tarMagic      = []byte("ustar")
+	// tarMagicOffset is where the magic of a POSIX tar header starts
+	tarMagicOffset = 257
+)
+
+// DetectArchive returns the format of the archive at archivePath based on its
+// first bytes. Tarballs that contain an image are reported as FormatImage.
+// Finding out whether a tarball is an image means reading it, which stops
+// with ErrExtractLimit once it exceeds DefaultExtractLimits.
+func DetectArchive(archivePath string) (string, error) {
+	return detectArchive(archivePath, DefaultExtractLimits)
+}
+
+func detectArchive(archivePath string, limits ExtractLimits) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	head, err := r.Peek(tarMagicOffset + len(tarMagic))
+	if err != nil && err != io.EOF {
+		return FormatUnknown, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, zipMagic) || bytes.HasPrefix(head, emptyZipMagic):
+		return FormatZip, nil
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return FormatUnknown, err
+		}
+		defer gz.Close()
+
+		image, err := isImage(gz, limits)
+		if err != nil {
+			return FormatUnknown, err
+		}
+
+		if image {
+			return FormatImage, nil
+		}
+
+		return FormatTarGz, nil
+	case len(head) > tarMagicOffset && bytes.HasPrefix(head[tarMagicOffset:], tarMagic):
+		image, err := isImage(r, limits)
+		if err != nil {
+			return FormatUnknown, err
+		}
+
+		if image {
+			return FormatImage, nil
+		}
+
+		return FormatTar, nil
+	}
+
+	return FormatUnknown, nil
+}
+
+// isImage reports whether the tarball read from r is a container image. Both
+// OCI image layouts and the legacy docker save format have marker files in
+// their top-level directory. As docker save writes those last, the whole
+// tarball may have to be read, but no more than limits allow.
+func isImage(r io.Reader, limits ExtractLimits) (bool, error) {
+	tr := tar.NewReader(&limitedReader{r: r, n: limits.MaxSize, limit: limits.MaxSize})
+
+	manifest, repositories := false, false
+
+	for entries := 0; ; entries++ {
+		if entries > limits.MaxEntries {
+			return false, fmt.Errorf("%w: more than %d entries", ErrExtractLimit, limits.MaxEntries)
+		}
+
+		h, err := tr.Next()
+		if err == io.EOF {
+			return manifest && repositories, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		switch path.Clean(h.Name) {
+		case "oci-layout":
+			return true, nil
+		case "manifest.json":
+			manifest = true
+		case "repositories":
+			repositories = true
+		}
+	}
+}
+
+// limitedReader reads at most n bytes from r and fails with ErrExtractLimit
+// if there is more.
+type limitedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// there may be nothing left anyway
+		n, err := l.r.Read(p[:min(len(p), 1)])
+		if n > 0 {
+			return 0, fmt.Errorf("%w: more than %d bytes", ErrExtractLimit, l.limit)
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+
+	return n, err
+}
+
+// Extract unpacks the archive at archivePath into directory p. The format is
+// the one returned by DetectArchive for the archive.
+func Extract(archivePath string, format string, p string) error {
+	switch format {
+	case FormatZip:
+		return Unzip(archivePath, p)
+	case FormatTar:
+		return Untar(archivePath, p, false)
+	case FormatTarGz:
+		return Untar(archivePath, p, true)
+	case FormatImage:
+		return fmt.Errorf("%s is an image and cannot be extracted", archivePath)
+	}
+
+	return fmt.Errorf("unknown archive format of %s", archivePath)
+}
+
+// Untar unpacks the (gzipped, if gz is set) tarball at tarPath into
+// directory p with the same safeguards as Unzip. Only directories, regular
+// files, and symlinks are extracted, other entries are skipped.
+func Untar(tarPath string, p string, gz bool) error {
+	return untar(tarPath, p, gz, DefaultExtractLimits)
+}
+
+func untar(tarPath string, p string, gz bool, limits ExtractLimits) error {
+
+	log.Printf("Untarring %s to %s", tarPath, p)
+
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+
+	if gz {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	e := newExtractor(p, limits)
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Extracting %s", h.Name)
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(h.Name)
+		case tar.TypeReg:
+			err = e.file(h.Name, tr, h.FileInfo().Mode())
+		case tar.TypeSymlink:
+			err = e.symlink(h.Name, h.Linkname)
+		default:
+			log.Printf("Skipping %s of type %c", h.Name, h.Typeflag)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeTar builds a tarball from entries, like makeZip.
+func makeTar(t testing.TB, entries []testEntry, gz bool) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+
+	var tw *tar.Writer
+	var gw *gzip.Writer
+
+	if gz {
+		gw = gzip.NewWriter(buf)
+		tw = tar.NewWriter(gw)
+	} else {
+		tw = tar.NewWriter(buf)
+	}
+
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:     e.name,
+			Mode:     int64(e.mode.Perm()),
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(e.body)),
+		}
+
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+
+		switch {
+		case e.mode&fs.ModeSymlink != 0:
+			h.Typeflag = tar.TypeSymlink
+			h.Linkname = e.body
+			h.Size = 0
+		case e.name[len(e.name)-1] == '/':
+			h.Typeflag = tar.TypeDir
+			h.Size = 0
+		}
+
+		err := tw.WriteHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte(e.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gw != nil {
+		err = gw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestDetectArchive(t *testing.T) {
+	fn := []testEntry{{name: "fn.py", body: "x"}}
+	image := []testEntry{{name: "manifest.json", body: "[]"}, {name: "oci-layout", body: "{}"}}
+	legacyImage := []testEntry{{name: "manifest.json", body: "[]"}, {name: "repositories", body: "{}"}}
+
+	tests := map[string]struct {
+		data   []byte
+		format string
+	}{
+		"zip":             {makeZip(t, fn), FormatZip},
+		"empty zip":       {makeZip(t, nil), FormatZip},
+		"tar":             {makeTar(t, fn, false), FormatTar},
+		"tar.gz":          {makeTar(t, fn, true), FormatTarGz},
+		"image":           {makeTar(t, image, false), FormatImage},
+		"gzip image":      {makeTar(t, image, true), FormatImage},
+		"legacy image":    {makeTar(t, legacyImage, false), FormatImage},
+		"only a manifest": {makeTar(t, []testEntry{{name: "manifest.json", body: "[]"}}, false), FormatTar},
+		"garbage":         {[]byte("garbage"), FormatUnknown},
+		"empty":           {nil, FormatUnknown},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			archivePath, _ := writeArchive(t, tt.data)
+
+			format, err := DetectArchive(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if format != tt.format {
+				t.Errorf("got format %q, want %q", format, tt.format)
+			}
+		})
+	}
+}
+
+func TestDetectArchiveLimits(t *testing.T) {
+	limits := ExtractLimits{MaxSize: 1 << 12, MaxEntries: 4}
+
+	many := make([]testEntry, 0, 8)
+	for i := 0; i < cap(many); i++ {
+		many = append(many, testEntry{name: fmt.Sprintf("f%d", i), body: "x"})
+	}
+
+	large := []testEntry{{name: "large", body: strings.Repeat("x", 1<<13)}, {name: "manifest.json", body: "[]"}}
+
+	tests := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"within limits":     {makeTar(t, many[:2], true), nil},
+		"too many entries":  {makeTar(t, many, false), ErrExtractLimit},
+		"too many gzipped":  {makeTar(t, many, true), ErrExtractLimit},
+		"too large":         {makeTar(t, large, false), ErrExtractLimit},
+		"too large gzipped": {makeTar(t, large, true), ErrExtractLimit},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			archivePath, _ := writeArchive(t, tt.data)
+
+			_, err := detectArchive(archivePath, limits)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUntar(t *testing.T) {
+	quiet(t)
+
+	archivePath, dst := writeArchive(t, makeTar(t, []testEntry{
+		{name: "./"},
+		{name: "./fn.sh", body: "#!/bin/sh\n", mode: 0755},
+		{name: "./lib/util.sh", body: "true\n"},
+		{name: "./link", body: "lib/util.sh", mode: fs.ModeSymlink | 0777},
+	}, true))
+
+	format, err := DetectArchive(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Extract(archivePath, format, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "fn.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0100 == 0 {
+		t.Errorf("fn.sh lost its executable bit: %s", fi.Mode())
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "true\n" {
+		t.Errorf("link resolves to %q, want %q", b, "true\n")
+	}
+}
+
+func TestUntarRejects(t *testing.T) {
+	quiet(t)
+
+	tests := map[string][]testEntry{
+		"parent":        {{name: "../evil", body: "x"}},
+		"absolute":      {{name: "/tmp/evil", body: "x"}},
+		"escaping link": {{name: "link", body: "../evil", mode: fs.ModeSymlink | 0777}},
+		"through link":  {{name: "sub/"}, {name: "link", body: "sub", mode: fs.ModeSymlink | 0777}, {name: "link/evil", body: "x"}},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			archivePath, dst := writeArchive(t, makeTar(t, entries, false))
+
+			err := Untar(archivePath, dst, false)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			checkContained(t, filepath.Dir(dst))
+		})
+	}
+}
+
+func FuzzUntar(f *testing.F) {
+	quiet(f)
+
+	seeds := [][]testEntry{
+		{{name: "./"}, {name: "./fn.sh", body: "#!/bin/sh\n", mode: 0755}, {name: "./lib/util.sh", body: "true\n"}},
+		{{name: "../evil", body: "x"}},
+		{{name: "/tmp/evil", body: "x"}},
+		{{name: "link", body: "..", mode: fs.ModeSymlink | 0777}, {name: "link/evil", body: "x"}},
+		{{name: "a/", mode: 0700}, {name: "a/b", body: strings.Repeat("b", 4096)}},
+	}
+
+	for _, entries := range seeds {
+		f.Add(makeTar(f, entries, false), false)
+		f.Add(makeTar(f, entries, true), true)
+	}
+
+	limits := ExtractLimits{MaxSize: 1 << 12, MaxEntries: 16}
+
+	f.Fuzz(func(t *testing.T, data []byte, gz bool) {
+		tarPath, dst := writeArchive(t, data)
+
+		// most inputs are not valid tarballs, all that matters is that
+		// nothing escapes and the limits hold
+		untar(tarPath, dst, gz, limits)
+
+		checkContained(t, filepath.Dir(dst))
+		checkLimits(t, dst, limits)
+	})
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file in the same directory as
+// name and renames it to name once everything has been synced to disk.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// CopyFileAtomic copies the file src to dst, replacing dst if it exists.
+// Unlike CopyFile, dst is only replaced once the copy is complete.
+func CopyFileAtomic(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractLimits protects against archive bombs when extracting archives.
+type ExtractLimits struct {
+	// MaxSize is the total number of bytes that may be extracted
+	MaxSize int64
+	// MaxEntries is the number of files, directories, and links that may be
+	// extracted
+	MaxEntries int
+}
+
+// DefaultExtractLimits are the limits that Unzip, Untar, and Extract apply.
+var DefaultExtractLimits = ExtractLimits{
+	MaxSize:    4 << 30,
+	MaxEntries: 100000,
+}
+
+// maxLinkSize is the longest symlink target that is read from a zip.
+const maxLinkSize = 4096
+
+// ErrExtractLimit is returned when an archive exceeds the ExtractLimits.
+var ErrExtractLimit = errors.New("archive exceeds extraction limits")
+
+// extractor writes the entries of an archive into directory dir. Entries
+// must stay within dir: absolute paths and paths that lead outside of dir,
+// either directly or through a symlink, are rejected.
+type extractor struct {
+	dir     string
+	limits  ExtractLimits
+	size    int64
+	entries int
+}
+
+func newExtractor(dir string, limits ExtractLimits) *extractor {
+	return &extractor{
+		dir:    dir,
+		limits: limits,
+	}
+}
+
+// target checks the name of an entry and returns where to extract it.
+func (e *extractor) target(name string) (string, error) {
+	e.entries++
+	if e.entries > e.limits.MaxEntries {
+		return "", fmt.Errorf("%w: more than %d entries", ErrExtractLimit, e.limits.MaxEntries)
+	}
+
+	// some archivers add a leading ./ to all entries
+	name = strings.TrimPrefix(name, "./")
+
+	if name == "" || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+
+	// all symlinks we create point to somewhere within dir, but writing
+	// through them could still replace files that were extracted earlier or
+	// follow links that the archive swapped in, so they are not followed
+	p := e.dir
+	for _, c := range strings.Split(path.Clean(name), "/") {
+		p = path.Join(p, c)
+
+		fi, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("path %q in archive leads through a symlink", name)
+		}
+	}
+
+	return path.Join(e.dir, name), nil
+}
+
+// mkdir creates directory name and any missing parents.
+func (e *extractor) mkdir(name string) error {
+	// archives of "." contain the extraction directory itself
+	if path.Clean(strings.TrimPrefix(name, "./")) == "." {
+		return nil
+	}
+
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(target, 0777)
+}
+
+// file writes the contents of r to file name, creating its parent
+// directories. Only the permission bits of perm are kept, but the file is
+// always readable and writable by its owner.
+func (e *extractor) file(name string, r io.Reader, perm fs.FileMode) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(target), 0777)
+	if err != nil {
+		return err
+	}
+
+	w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm.Perm()|0600)
+	if err != nil {
+		return err
+	}
+
+	// the sizes in the headers of an archive cannot be trusted, so count
+	// what is actually written
+	remaining := e.limits.MaxSize - e.size
+	n, err := io.CopyN(w, r, remaining+1)
+	e.size += n
+
+	if err2 := w.Close(); err == nil || err == io.EOF {
+		err = err2
+	}
+
+	if err == nil && n > remaining {
+		err = fmt.Errorf("%w: more than %d bytes", ErrExtractLimit, e.limits.MaxSize)
+	}
+
+	if err != nil {
+		// don't leave partial files behind
+		os.Remove(target)
+		return err
+	}
+
+	return nil
+}
+
+// symlink creates a symlink name that points to linkname. The link must
+// point to somewhere within the extraction directory.
+func (e *extractor) symlink(name string, linkname string) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	if linkname == "" || path.IsAbs(linkname) || !filepath.IsLocal(path.Join(path.Dir(strings.TrimPrefix(name, "./")), linkname)) {
+		return fmt.Errorf("invalid link %q to %q in archive", name, linkname)
+	}
+
+	err = os.MkdirAll(path.Dir(target), 0777)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(linkname, target)
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// HashDir returns a hex encoded SHA-256 digest of the directory tree at p. The
+// digest covers the paths, permissions, and contents of all files and the
+// targets of all symlinks, but not timestamps or owners, so that the same
+// source always has the same digest.
+func HashDir(p string) (string, error) {
+	return hashTree(os.DirFS(p), ".", func(name string) (string, error) {
+		return os.Readlink(path.Join(p, name))
+	})
+}
+
+// HashFS is like HashDir for directory root of fsys, e.g., an embed.FS.
+// Symlinks are only hashed by their names.
+func HashFS(fsys fs.FS, root string) (string, error) {
+	return hashTree(fsys, root, nil)
+}
+
+func hashTree(fsys fs.FS, root string, readlink func(name string) (string, error)) (string, error) {
+	h := sha256.New()
+
+	// fs.WalkDir visits entries in lexical order, which makes the digest
+	// deterministic
+	err := fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel := name
+		if root != "." {
+			rel = name[len(root):]
+		}
+
+		fmt.Fprintf(h, "%q %s\n", rel, info.Mode())
+
+		switch {
+		case info.Mode().IsRegular():
+			f, err := fsys.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			fmt.Fprintf(h, "%d\n", info.Size())
+
+			_, err = io.Copy(h, f)
+			return err
+		case info.Mode()&fs.ModeSymlink != 0 && readlink != nil:
+			target, err := readlink(name)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(h, "%q\n", target)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashDir(t *testing.T) {
+	makeDir := func(t *testing.T, content string, mode os.FileMode) string {
+		t.Helper()
+
+		dir := t.TempDir()
+
+		err := os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filepath.Join(dir, "fn.sh"), []byte(content), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Chmod(filepath.Join(dir, "fn.sh"), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filepath.Join(dir, "lib", "util.sh"), []byte("true\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return dir
+	}
+
+	hash := func(t *testing.T, dir string) string {
+		t.Helper()
+
+		h, err := HashDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return h
+	}
+
+	a := makeDir(t, "echo a\n", 0755)
+	same := makeDir(t, "echo a\n", 0755)
+
+	// timestamps do not matter
+	err := os.Chtimes(filepath.Join(same, "fn.sh"), time.Unix(0, 0), time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash(t, a) != hash(t, same) {
+		t.Error("identical directories have different digests")
+	}
+
+	if hash(t, a) == hash(t, makeDir(t, "echo b\n", 0755)) {
+		t.Error("different contents have the same digest")
+	}
+
+	if hash(t, a) == hash(t, makeDir(t, "echo a\n", 0644)) {
+		t.Error("different permissions have the same digest")
+	}
+
+	err = os.Symlink("fn.sh", filepath.Join(same, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash(t, a) == hash(t, same) {
+		t.Error("an added symlink does not change the digest")
+	}
+}
@@ -7,3 +7,9 @@ func IsAlphaNumeric(s string) bool {
 
 	return reg.MatchString(s)
 }
+
+func IsAlphaNumericDash(s string) bool {
+	reg := regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+	return reg.MatchString(s)
+}
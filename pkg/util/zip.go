@@ -3,12 +3,18 @@ package util
 import (
 	"archive/zip"
 	"io"
+	"io/fs"
 	"log"
-	"os"
-	"path"
 )
 
+// Unzip extracts the zip at zipPath into directory p. Entries that would end
+// up outside of p are rejected, as are archives that exceed the
+// DefaultExtractLimits. File permissions and symlinks within p are kept.
 func Unzip(zipPath string, p string) error {
+	return unzip(zipPath, p, DefaultExtractLimits)
+}
+
+func unzip(zipPath string, p string, limits ExtractLimits) error {
 
 	log.Printf("Unzipping %s to %s", zipPath, p)
 
@@ -16,53 +22,53 @@ func Unzip(zipPath string, p string) error {
 	if err != nil {
 		return err
 	}
+	defer archive.Close()
+
+	e := newExtractor(p, limits)
 
 	// extract zip
 	for _, f := range archive.File {
 		log.Printf("Extracting %s", f.Name)
 
-		if f.FileInfo().IsDir() {
-			path := path.Join(p, f.Name)
-			log.Printf("Creating directory %s in %s", f.Name, path)
-
-			err = os.MkdirAll(path, 0777)
-			if err != nil {
-				return err
-			}
-			continue
-		}
-
-		// open file
-		rc, err := f.Open()
+		err = unzipFile(e, f)
 		if err != nil {
 			return err
 		}
+	}
 
-		// create file
-		path := path.Join(p, f.Name)
-		// err = os.MkdirAll(path, 0777)
-		// if err != nil {
-		// return err
-		// }
+	return nil
+}
 
-		// write file
-		w, err := os.Create(path)
-		if err != nil {
-			return err
-		}
+// unzipFile extracts a single entry f of a zip.
+func unzipFile(e *extractor, f *zip.File) error {
+	mode := f.Mode()
+
+	if mode.IsDir() {
+		return e.mkdir(f.Name)
+	}
 
-		// copy
-		_, err = io.Copy(w, rc)
+	if mode&^fs.ModePerm != 0 && mode&fs.ModeSymlink == 0 {
+		log.Printf("Skipping %s of mode %s", f.Name, mode)
+		return nil
+	}
+
+	// open file
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// the target of a symlink is stored as its contents
+	if mode&fs.ModeSymlink != 0 {
+		link, err := io.ReadAll(io.LimitReader(rc, maxLinkSize))
 		if err != nil {
 			return err
 		}
 
-		log.Printf("Extracted %s to %s", f.Name, path)
-
-		// close
-		rc.Close()
-		w.Close()
+		return e.symlink(f.Name, string(link))
 	}
 
-	return nil
+	// zips created without unix permissions report 0666
+	return e.file(f.Name, rc, mode)
 }
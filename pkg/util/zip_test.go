@@ -0,0 +1,290 @@
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name string
+	body string
+	mode fs.FileMode
+}
+
+// makeZip builds a zip from entries. Entries with fs.ModeSymlink set are
+// links to their body, names ending in "/" are directories.
+func makeZip(t testing.TB, entries []testEntry) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	for _, e := range entries {
+		h := &zip.FileHeader{
+			Name:   e.name,
+			Method: zip.Deflate,
+		}
+
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if strings.HasSuffix(e.name, "/") {
+			mode |= fs.ModeDir
+		}
+		h.SetMode(mode)
+
+		f, err := w.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Write([]byte(e.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// writeArchive writes data to a file in a new temporary directory and returns
+// the path of that file and of an empty destination directory next to it.
+func writeArchive(t testing.TB, data []byte) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive")
+	dst := filepath.Join(dir, "dst")
+
+	err := os.WriteFile(archivePath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Mkdir(dst, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archivePath, dst
+}
+
+func quiet(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func TestUnzip(t *testing.T) {
+	quiet(t)
+
+	zipPath, dst := writeArchive(t, makeZip(t, []testEntry{
+		{name: "fn.sh", body: "#!/bin/sh\necho hi\n", mode: 0755},
+		{name: "data/nested/input.txt", body: "hello"},
+		{name: "empty/"},
+		{name: "link", body: "data/nested/input.txt", mode: fs.ModeSymlink | 0777},
+	}))
+
+	err := Unzip(zipPath, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "fn.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0100 == 0 {
+		t.Errorf("fn.sh lost its executable bit: %s", fi.Mode())
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("link resolves to %q, want %q", b, "hello")
+	}
+
+	fi, err = os.Stat(filepath.Join(dst, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Errorf("empty is not a directory")
+	}
+}
+
+func TestUnzipRejects(t *testing.T) {
+	quiet(t)
+
+	tests := map[string][]testEntry{
+		"parent":        {{name: "../evil", body: "x"}},
+		"nested parent": {{name: "a/../../evil", body: "x"}},
+		"absolute":      {{name: "/tmp/evil", body: "x"}},
+		"absolute link": {{name: "link", body: "/etc/passwd", mode: fs.ModeSymlink | 0777}},
+		"escaping link": {{name: "a/link", body: "../../evil", mode: fs.ModeSymlink | 0777}},
+		"through link":  {{name: "sub/"}, {name: "link", body: "sub", mode: fs.ModeSymlink | 0777}, {name: "link/evil", body: "x"}},
+		"over link":     {{name: "file", body: "x"}, {name: "link", body: "file", mode: fs.ModeSymlink | 0777}, {name: "link", body: "y"}},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			zipPath, dst := writeArchive(t, makeZip(t, entries))
+
+			err := Unzip(zipPath, dst)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			checkContained(t, filepath.Dir(dst))
+		})
+	}
+}
+
+func TestUnzipLimits(t *testing.T) {
+	quiet(t)
+
+	zipPath, dst := writeArchive(t, makeZip(t, []testEntry{
+		{name: "big", body: strings.Repeat("0", 1<<20)},
+	}))
+
+	err := unzip(zipPath, dst, ExtractLimits{MaxSize: 1 << 10, MaxEntries: 10})
+	if !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("expected size limit error, got %v", err)
+	}
+
+	entries := make([]testEntry, 20)
+	for i := range entries {
+		entries[i] = testEntry{name: strings.Repeat("a", i+1), body: "x"}
+	}
+
+	zipPath, dst = writeArchive(t, makeZip(t, entries))
+
+	err = unzip(zipPath, dst, ExtractLimits{MaxSize: 1 << 10, MaxEntries: 10})
+	if !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("expected entry limit error, got %v", err)
+	}
+}
+
+// checkContained fails if anything but the archive and the destination
+// directory ended up in dir, or if anything within the destination resolves
+// to somewhere outside of it.
+func checkContained(t testing.TB, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		if e.Name() != "archive" && e.Name() != "dst" {
+			t.Errorf("%s was extracted outside of the destination", e.Name())
+		}
+	}
+
+	dst, err := filepath.EvalSymlinks(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filepath.WalkDir(dst, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		resolved, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			// dangling links are harmless
+			return nil
+		}
+
+		rel, err := filepath.Rel(dst, resolved)
+		if err != nil || !filepath.IsLocal(rel) && rel != "." {
+			t.Errorf("link %s resolves to %s outside of the destination", p, resolved)
+		}
+
+		return nil
+	})
+}
+
+func FuzzUnzip(f *testing.F) {
+	quiet(f)
+
+	f.Add(makeZip(f, []testEntry{
+		{name: "fn.py", body: "def fn(input, headers):\n    return input\n"},
+		{name: "lib/util.py", body: "x = 1\n", mode: 0600},
+	}))
+	f.Add(makeZip(f, []testEntry{{name: "../evil", body: "x"}}))
+	f.Add(makeZip(f, []testEntry{{name: "link", body: "..", mode: fs.ModeSymlink | 0777}, {name: "link/evil", body: "x"}}))
+	f.Add(makeZip(f, []testEntry{{name: "a/", mode: 0700}, {name: "a/b", body: strings.Repeat("b", 4096)}}))
+
+	limits := ExtractLimits{MaxSize: 1 << 12, MaxEntries: 16}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		zipPath, dst := writeArchive(t, data)
+
+		// most inputs are not valid zips, all that matters is that nothing
+		// escapes and the limits hold
+		unzip(zipPath, dst, limits)
+
+		checkContained(t, filepath.Dir(dst))
+		checkLimits(t, dst, limits)
+	})
+}
+
+// checkLimits fails if more than limits allow was extracted to dst.
+func checkLimits(t testing.TB, dst string, limits ExtractLimits) {
+	t.Helper()
+
+	var size int64
+	entries := 0
+
+	filepath.WalkDir(dst, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dst {
+			return nil
+		}
+
+		// parent directories are created implicitly
+		if !d.IsDir() {
+			entries++
+		}
+
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err == nil {
+				size += fi.Size()
+			}
+		}
+
+		return nil
+	})
+
+	if size > limits.MaxSize {
+		t.Errorf("extracted %d bytes, limit is %d", size, limits.MaxSize)
+	}
+
+	if entries > limits.MaxEntries {
+		t.Errorf("extracted %d entries, limit is %d", entries, limits.MaxEntries)
+	}
+}
@@ -8,4 +8,4 @@ then
     exit
 fi
 
-curl localhost:8080/list
+curl ${TF_TOKEN:+--oauth2-bearer "$TF_TOKEN"} localhost:8080/list
@@ -23,5 +23,5 @@ then
 fi
 
 pushd "$1" >/dev/null || exit
-curl http://localhost:8080/upload --data "{\"name\": \"$2\", \"env\": \"$3\", \"threads\": $4, \"zip\": \"$(zip -r - ./* | base64 | tr -d '\n')\"}"
+curl ${TF_TOKEN:+--oauth2-bearer "$TF_TOKEN"} http://localhost:8080/upload --data "{\"name\": \"$2\", \"env\": \"$3\", \"threads\": $4, \"zip\": \"$(zip -r - ./* | base64 | tr -d '\n')\"}"
 popd >/dev/null || exit
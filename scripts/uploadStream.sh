@@ -0,0 +1,21 @@
+#!/bin/bash
+
+# uploadStream.sh folder-name name env threads
+
+set -e
+
+if ! command -v curl &> /dev/null
+then
+    echo "curl could not be found but is a pre-requisite for this script"
+    exit
+fi
+
+if ! command -v zip &> /dev/null
+then
+    echo "zip could not be found but is a pre-requisite for this script"
+    exit
+fi
+
+pushd "$1" >/dev/null || exit
+zip -r - ./* | curl ${TF_TOKEN:+--oauth2-bearer "$TF_TOKEN"} -X POST -H "Content-Type: application/zip" -T - "http://localhost:8080/uploadStream?name=$2&env=$3&threads=$4"
+popd >/dev/null || exit